@@ -0,0 +1,162 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"image"
+	"math"
+	"os"
+	"sort"
+
+	. "ascottix/funtracer/maths"
+)
+
+// Aperture is the shape of the lens opening, which is also the shape of out of focus highlights (bokeh)
+type Aperture interface {
+	// SampleAperture converts samples from [0,1)x[0,1) into a point of the aperture, inside the unit disk
+	SampleAperture(u, v float64) (float64, float64)
+}
+
+// CircularAperture is the aperture of an ideal lens, and the default if no aperture is specified
+type CircularAperture struct{}
+
+func (a CircularAperture) SampleAperture(u, v float64) (float64, float64) {
+	return ConcentricSampleDisk(u, v)
+}
+
+// BladedAperture is a regular polygon, like the diaphragm of real lenses with straight blades
+type BladedAperture struct {
+	Blades   int     // Number of sides of the polygon, at least 3
+	Rotation float64 // Rotation of the polygon in radians
+}
+
+func NewBladedAperture(blades int, rotation float64) *BladedAperture {
+	if blades < 3 {
+		blades = 3
+	}
+
+	return &BladedAperture{Blades: blades, Rotation: rotation}
+}
+
+func (a *BladedAperture) SampleAperture(u, v float64) (float64, float64) {
+	// Pick a triangle between the center and one side, then reuse what's left of u to sample it uniformly
+	n := float64(a.Blades)
+	side := math.Floor(u * n)
+	u = u*n - side
+
+	theta0 := a.Rotation + 2*Pi*side/n
+	theta1 := theta0 + 2*Pi/n
+
+	su := math.Sqrt(u)
+	b0 := su * (1 - v)
+	b1 := su * v
+
+	x := b0*math.Cos(theta0) + b1*math.Cos(theta1)
+	y := b0*math.Sin(theta0) + b1*math.Sin(theta1)
+
+	return x, y
+}
+
+// ImageAperture has the shape of a grayscale image: brighter pixels let more light thru,
+// which can be used for custom bokeh shapes (hearts, stars...) or to model lens imperfections
+type ImageAperture struct {
+	w, h     int
+	rowCdf   []float64 // Cumulative distribution of the rows
+	pixelCdf []float64 // Cumulative distribution of the pixels within each row
+}
+
+func NewImageAperture(img image.Image) *ImageAperture {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	a := &ImageAperture{
+		w:        w,
+		h:        h,
+		rowCdf:   make([]float64, h),
+		pixelCdf: make([]float64, w*h),
+	}
+
+	rowSum := 0.0
+
+	for y := 0; y < h; y++ {
+		sum := 0.0
+
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			sum += float64(r+g+b) / (3 * 65535)
+			a.pixelCdf[x+y*w] = sum
+		}
+
+		rowSum += sum
+		a.rowCdf[y] = rowSum
+	}
+
+	return a
+}
+
+func LoadImageAperture(filename string) (*ImageAperture, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewImageAperture(img), nil
+}
+
+func (a *ImageAperture) SampleAperture(u, v float64) (float64, float64) {
+	total := a.rowCdf[a.h-1]
+
+	if total == 0 {
+		return 0, 0 // Black image, the lens is closed
+	}
+
+	// Pick a row, then a pixel in the row, with probability proportional to brightness
+	y := sort.SearchFloat64s(a.rowCdf, u*total)
+	if y >= a.h {
+		y = a.h - 1
+	}
+
+	row := a.pixelCdf[y*a.w : (y+1)*a.w]
+	x := sort.SearchFloat64s(row, v*row[a.w-1])
+	if x >= a.w {
+		x = a.w - 1
+	}
+
+	// Jitter the point inside the pixel by reusing the leftover of the samples
+	du := 0.5
+	dv := 0.5
+
+	if lo, hi := rowStart(a.rowCdf, y), a.rowCdf[y]; hi > lo {
+		du = (u*total - lo) / (hi - lo)
+	}
+
+	if lo, hi := rowStart(row, x), row[x]; hi > lo {
+		dv = (v*row[a.w-1] - lo) / (hi - lo)
+	}
+
+	// Map the image to the square inscribed in the unit disk, with +y up and +x to the left as in camera space
+	s := 2 / math.Sqrt2
+	px := 0.5 - (float64(x)+dv)/float64(a.w)
+	py := 0.5 - (float64(y)+du)/float64(a.h)
+
+	return px * s, py * s
+}
+
+func rowStart(cdf []float64, i int) float64 {
+	if i == 0 {
+		return 0
+	}
+
+	return cdf[i-1]
+}
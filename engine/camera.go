@@ -5,6 +5,7 @@
 package engine
 
 import (
+	"image"
 	"math"
 
 	. "ascottix/funtracer/maths"
@@ -12,19 +13,41 @@ import (
 	. "ascottix/funtracer/traits"
 )
 
+// Projection selects how the camera maps directions to the image
+type Projection int
+
+const (
+	ProjectionPerspective      Projection = iota // Pinhole camera
+	ProjectionOrthographic                       // Parallel rays, the view size is given in world units by OrthoSize
+	ProjectionFisheye                            // Equidistant fisheye: the distance from the center is proportional to the angle
+	ProjectionFisheyeEquisolid                   // Equisolid fisheye: each pixel covers the same solid angle
+	ProjectionEquirectangular                    // 360x180 degrees panorama, longitude and latitude map to x and y
+)
+
 type Camera struct {
+	Namer
 	Transformer
-	HSize      int     // Image width in pixel
-	VSize      int     // Image height in pixel
-	FOV        float64 // Field of view in radians
-	aspect     float64 // Aspect ratio
-	halfwidth  float64 // Half width of projected image
-	halfheight float64 // Half height of projected image
-	pixsize    float64 // Size of one pixel
+	HSize      int        // Image width in pixel
+	VSize      int        // Image height in pixel
+	FOV        float64    // Field of view in radians, for fisheye projections it's the angle covered by the image circle
+	Projection Projection // Perspective by default
+	OrthoSize  float64    // Size of the view in world units, for the orthographic projection
+	StereoParams
+	// Lens parameters
+	LensRadius    float64         // Radius of the lens in world units, zero for a pinhole camera
+	FocalDistance float64         // Distance of the plane in focus
+	Aperture      Aperture        // Shape of the lens opening, circular if nil
+	Exposure      float64         // Scale applied to the rendered image
+	Physical      *PhysicalCamera // If set, field of view, lens radius and exposure are derived from it
+	AutoFocus     *AutoFocus      // If set, the focal distance is computed before rendering
+	aspect        float64         // Aspect ratio
+	halfwidth     float64         // Half width of projected image
+	halfheight    float64         // Half height of projected image
+	pixsize       float64         // Size of one pixel
 }
 
 func NewCamera(hsize, vsize int, fov float64) *Camera {
-	c := &Camera{HSize: hsize, VSize: vsize}
+	c := &Camera{HSize: hsize, VSize: vsize, Exposure: 1}
 
 	c.SetTransform()
 	c.SetFieldOfView(fov) // Triggers initialization of other parameters
@@ -32,18 +55,39 @@ func NewCamera(hsize, vsize int, fov float64) *Camera {
 	return c
 }
 
+// Frame returns the rectangle covered by the camera view, in pixels
+func (c *Camera) Frame() image.Rectangle {
+	return image.Rect(0, 0, c.HSize, c.VSize)
+}
+
 func (c *Camera) SetFieldOfView(fov float64) {
 	c.FOV = fov
 	c.SetViewSize(c.HSize, c.VSize)
 }
 
+// SetProjection changes the camera projection, for the orthographic projection size is the width
+// of the view in world units (or the height if the view is taller than wide) and it's ignored otherwise
+func (c *Camera) SetProjection(projection Projection, size float64) {
+	c.Projection = projection
+	c.OrthoSize = size
+	c.SetViewSize(c.HSize, c.VSize)
+}
+
 func (c *Camera) SetViewSize(hsize, vsize int) {
 	c.HSize = hsize
 	c.VSize = vsize
 	c.aspect = float64(hsize) / float64(vsize)
 
+	if c.Physical != nil {
+		c.FOV = c.Physical.FieldOfView(c.aspect)
+	}
+
 	halfview := math.Tan(c.FOV / 2)
 
+	if c.Projection == ProjectionOrthographic {
+		halfview = c.OrthoSize / 2
+	}
+
 	if c.aspect >= 1 {
 		c.halfwidth = halfview
 		c.halfheight = halfview / c.aspect
@@ -56,6 +100,11 @@ func (c *Camera) SetViewSize(hsize, vsize int) {
 }
 
 func (c *Camera) RayForPixel(x, y float64) Ray {
+	if c.Projection != ProjectionPerspective {
+		ray, _ := c.CameraRay(x, y, 0, 0, nil)
+		return ray
+	}
+
 	// Offset of the pixel center from edge of canvas
 	xoffset := x * c.pixsize
 	yoffset := y * c.pixsize
@@ -63,7 +112,7 @@ func (c *Camera) RayForPixel(x, y float64) Ray {
 	// Note: camera is placed at (0,0,0) and looks toward -z, with +x to the left
 
 	// Get untransformed world coordinates
-	worldx := c.halfwidth - xoffset
+	worldx := c.halfwidth - xoffset + c.shift
 	worldy := c.halfheight - yoffset
 
 	// Apply the transformation
@@ -71,7 +120,99 @@ func (c *Camera) RayForPixel(x, y float64) Ray {
 	origin := c.Tinverse.MulT(Point(0, 0, 0))
 	direction := pixel.Sub(origin).Normalize()
 
-	return Ray{Origin: origin, Direction: direction}
+	return NewRay(origin, direction)
+}
+
+// cameraSpaceRay returns origin and direction of the ray for the specified image point in camera space,
+// where the camera is placed at (0,0,0) and looks toward -z: it fails for points outside the image circle of fisheye lenses
+func (c *Camera) cameraSpaceRay(x, y float64) (origin, direction Tuple, ok bool) {
+	// Offset of the point from the image center, with +x to the left as in perspective view
+	dx := float64(c.HSize)/2 - x
+	dy := float64(c.VSize)/2 - y
+
+	switch c.Projection {
+	case ProjectionOrthographic:
+		return Point(dx*c.pixsize, dy*c.pixsize, 0), Vector(0, 0, -1), true
+
+	case ProjectionFisheye, ProjectionFisheyeEquisolid:
+		// The image circle is inscribed in the image
+		radius := float64(c.HSize) / 2
+		if c.VSize < c.HSize {
+			radius = float64(c.VSize) / 2
+		}
+
+		rho := math.Hypot(dx, dy) / radius
+		if rho > 1 {
+			return origin, direction, false
+		}
+
+		// Get the angle from the optical axis
+		theta := rho * c.FOV / 2
+		if c.Projection == ProjectionFisheyeEquisolid {
+			theta = 2 * math.Asin(rho*math.Sin(c.FOV/4))
+		}
+
+		phi := math.Atan2(dy, dx)
+		sinTheta := math.Sin(theta)
+
+		return Point(0, 0, 0), Vector(sinTheta*math.Cos(phi), sinTheta*math.Sin(phi), -math.Cos(theta)), true
+
+	case ProjectionEquirectangular:
+		phi := 2 * Pi * dx / float64(c.HSize) // Longitude, zero in the image center
+		lambda := Pi * dy / float64(c.VSize)  // Latitude
+		cosLambda := math.Cos(lambda)
+
+		// For omni-directional stereo the eye moves on a circle, so that it's always offset sideways from the ray
+		origin := Point(c.eye*math.Cos(phi), 0, c.eye*math.Sin(phi))
+
+		return origin, Vector(cosLambda*math.Sin(phi), math.Sin(lambda), -cosLambda*math.Cos(phi)), true
+	}
+
+	return Point(0, 0, 0), Vector(c.halfwidth-x*c.pixsize+c.shift, c.halfheight-y*c.pixsize, -1), true
+}
+
+// CameraRay returns the ray for the specified image point with any projection, with depth of field if lensRadius is positive.
+// It returns false if the point is not covered by the projection, e.g. it's outside the image circle of a fisheye lens
+func (c *Camera) CameraRay(x, y, lensRadius, focalDistance float64, rand FloatGenerator) (Ray, bool) {
+	if c.Projection == ProjectionPerspective {
+		if lensRadius > 0 {
+			return c.RayForPixelDepthOfField(x, y, lensRadius, focalDistance, rand), true
+		}
+
+		return c.RayForPixel(x, y), true
+	}
+
+	origin, direction, ok := c.cameraSpaceRay(x, y)
+
+	if !ok {
+		return Ray{}, false
+	}
+
+	if lensRadius > 0 {
+		// Thin lens perpendicular to the ray: all rays leaving the lens converge at focal distance,
+		// which is a plane for the orthographic projection and a sphere for the others
+		direction = direction.Normalize()
+		focus := origin.Add(direction.Mul(focalDistance))
+
+		lensX, lensY := c.SampleLens(rand(), rand())
+		t, b := OrthonormalBasis(direction)
+		origin = origin.Add(t.Mul(lensX * lensRadius)).Add(b.Mul(lensY * lensRadius))
+		direction = focus.Sub(origin)
+	}
+
+	origin = c.Tinverse.MulT(origin)
+	direction = c.Tinverse.MulT(direction).Normalize()
+
+	return NewRay(origin, direction), true
+}
+
+// SampleLens converts samples from [0,1)x[0,1) into a point of the aperture, in the unit disk
+func (c *Camera) SampleLens(u, v float64) (float64, float64) {
+	if c.Aperture != nil {
+		return c.Aperture.SampleAperture(u, v)
+	}
+
+	return ConcentricSampleDisk(u, v)
 }
 
 // ConcentricSampleDisk converts samples from [0,1)x[0,1) into
@@ -102,11 +243,11 @@ func ConcentricSampleDisk(u, v float64) (float64, float64) {
 
 func (c *Camera) RayForPixelDepthOfField(x, y, lensRadius, focalDistance float64, rand FloatGenerator) Ray {
 	// Displace origin to a random point on the lens
-	lensX, lensY := ConcentricSampleDisk(rand(), rand())
+	lensX, lensY := c.SampleLens(rand(), rand())
 	origin := Point(lensX*lensRadius, lensY*lensRadius, 0)
 
 	// Get the target pixel on the camera plane (in world coordinates)
-	pixel := Point(c.halfwidth-x*c.pixsize, c.halfheight-y*c.pixsize, -1)
+	pixel := Point(c.halfwidth-x*c.pixsize+c.shift, c.halfheight-y*c.pixsize, -1)
 
 	// Adjust the target pixel to account for focal distance
 	ft := focalDistance / -pixel.Normalize().Z // How far the pixel is from the focal plane
@@ -122,5 +263,5 @@ func (c *Camera) RayForPixelDepthOfField(x, y, lensRadius, focalDistance float64
 	origin = c.Tinverse.MulT(origin)
 	direction := pixel.Sub(origin).Normalize()
 
-	return Ray{Origin: origin, Direction: direction}
+	return NewRay(origin, direction)
 }
@@ -9,6 +9,9 @@ import (
 	"testing"
 
 	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
 )
 
 const Pi2 = Pi / 2
@@ -54,3 +57,110 @@ func TestCameraRays(t *testing.T) {
 		t.Error("ray for pixel 2 failed")
 	}
 }
+
+func TestCameraProjections(t *testing.T) {
+	c := NewCamera(200, 100, Pi)
+
+	// Orthographic: all rays are parallel and the view size is in world units
+	c.SetProjection(ProjectionOrthographic, 10)
+	r1 := c.RayForPixel(100, 50)
+	r2 := c.RayForPixel(0, 0)
+	if !r1.Origin.Equals(Point(0, 0, 0)) || !r2.Origin.Equals(Point(5, 2.5, 0)) || !r1.Direction.Equals(r2.Direction) {
+		t.Errorf("orthographic projection failed: %+v %+v", r1, r2)
+	}
+
+	// Fisheye: the image circle covers the field of view, with nothing outside
+	for _, p := range []Projection{ProjectionFisheye, ProjectionFisheyeEquisolid} {
+		c.SetProjection(p, 0)
+
+		if r, ok := c.CameraRay(100, 50, 0, 0, nil); !ok || !r.Direction.Equals(Vector(0, 0, -1)) {
+			t.Errorf("fisheye center failed: %+v", r)
+		}
+
+		if r, ok := c.CameraRay(50, 50, 0, 0, nil); !ok || !r.Direction.Equals(Vector(1, 0, 0)) {
+			t.Errorf("fisheye edge failed: %+v", r)
+		}
+
+		if _, ok := c.CameraRay(10, 50, 0, 0, nil); ok {
+			t.Errorf("fisheye should not cover the corners")
+		}
+	}
+
+	// Equidistant fisheye maps angles linearly, equisolid compresses the edges
+	c.SetProjection(ProjectionFisheye, 0)
+	r1, _ = c.CameraRay(75, 50, 0, 0, nil)
+	c.SetProjection(ProjectionFisheyeEquisolid, 0)
+	r2, _ = c.CameraRay(75, 50, 0, 0, nil)
+	if !FloatEqual(r1.Direction.X, math.Sin(Pi/4)) || r2.Direction.X >= r1.Direction.X {
+		t.Errorf("fisheye mapping failed: %+v %+v", r1, r2)
+	}
+
+	// Equirectangular: the image covers all directions
+	c.SetProjection(ProjectionEquirectangular, 0)
+	tests := []struct {
+		x, y float64
+		dir  Tuple
+	}{
+		{100, 50, Vector(0, 0, -1)},
+		{50, 50, Vector(1, 0, 0)},
+		{150, 50, Vector(-1, 0, 0)},
+		{0, 50, Vector(0, 0, 1)},
+		{100, 0, Vector(0, 1, 0)},
+	}
+	for _, test := range tests {
+		if r := c.RayForPixel(test.x, test.y); !r.Direction.Equals(test.dir) {
+			t.Errorf("equirectangular projection failed at (%f,%f): %+v", test.x, test.y, r.Direction)
+		}
+	}
+}
+
+func TestCameraProjectionsDepthOfField(t *testing.T) {
+	c := NewCamera(200, 100, Pi)
+	rand := NewRandomGenerator(1)
+
+	for _, p := range []Projection{ProjectionOrthographic, ProjectionFisheye, ProjectionEquirectangular} {
+		c.SetProjection(p, 10)
+		r0 := c.RayForPixel(60, 30)
+
+		// All rays thru the lens converge at focal distance
+		focus := r0.Position(3)
+		for i := 0; i < 10; i++ {
+			r, _ := c.CameraRay(60, 30, 0.5, 3, rand)
+			v := focus.Sub(r.Origin).Normalize()
+
+			if r.Origin.Equals(r0.Origin) || !v.Equals(r.Direction) {
+				t.Errorf("depth of field failed for projection %d: %+v", p, r)
+			}
+		}
+	}
+}
+
+func TestCameraProjectionsScene(t *testing.T) {
+	TestWithImage(t)
+
+	floor := NewPlane()
+	floor.SetMaterial(NewMaterial().SetPattern(NewCheckerPattern(White, Gray(0.5))))
+
+	w := NewWorld()
+	w.AddObjects(floor)
+	w.AddLights(NewPointLight(Point(-10, 10, -10), White))
+
+	for i := 0; i < 6; i++ {
+		s := NewSphere()
+		s.SetTransform(Translation(4*math.Cos(float64(i)*Pi/3), 1, 4*math.Sin(float64(i)*Pi/3)))
+		s.Material().SetDiffuseColor(RGB(float64(i%2), float64(i%3)/2, float64(i)/5))
+		w.AddObjects(s)
+	}
+
+	c := NewCamera(400, 200, Pi)
+	c.SetTransform(EyeViewpoint(Point(0, 1, 0), Point(0, 1, -1), Vector(0, 1, 0)))
+
+	c.SetProjection(ProjectionEquirectangular, 0)
+	w.RenderToPNG(c, "test_camera_equirectangular.png")
+
+	c = NewCamera(300, 300, Pi)
+	c.SetTransform(EyeViewpoint(Point(0, 3, 0), Point(0, 0, 0), Vector(0, 0, 1)))
+
+	c.SetProjection(ProjectionFisheye, 0)
+	w.RenderToPNG(c, "test_camera_fisheye.png")
+}
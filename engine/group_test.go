@@ -172,3 +172,121 @@ func TestGroupHexagon(t *testing.T) {
 	scene.World.ErpCanvasToImage = ErpLinear
 	scene.World.RenderToPNG(scene.Camera, "test_hexagon.png")
 }
+
+func TestGroupParallelBVH(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	// Enough objects to build and bin in parallel
+	n := BvhParallelBinningThreshold + 1000
+	members := make([]Groupable, n)
+
+	for i := range members {
+		s := NewSphere()
+		s.SetTransform(Translation(rand()*100-50, rand()*100-50, rand()*100-50), Scaling(0.1))
+		members[i] = s
+	}
+
+	g := NewGroup()
+	g.Add(members...)
+	g.BuildBVH()
+
+	stats := g.Bvh().Stats()
+
+	leafObjects := 0
+	for size, count := range stats.LeafSizes {
+		leafObjects += size * count
+	}
+
+	if stats.Objects != n || leafObjects != n || stats.Nodes != 2*stats.Leaves-1 || stats.MaxDepth < 10 || stats.SAHCost <= 1 {
+		t.Errorf("bad BVH stats: %s", stats)
+	}
+
+	// All objects must be in the group exactly once
+	seen := map[Groupable]bool{}
+	for i := 0; i < g.Len(); i++ {
+		seen[g.Members(i)] = true
+	}
+
+	if len(seen) != n {
+		t.Errorf("objects lost while building the BVH: %d", len(seen))
+	}
+
+	// The BVH must find the same hits as a plain list
+	for i := 0; i < 200; i++ {
+		r := NewRay(Point(rand()*100-50, rand()*100-50, -60), Vector(rand()*0.2-0.1, rand()*0.2-0.1, 1))
+
+		xs := NewIntersections()
+		g.AddIntersections(r, xs)
+
+		expected := NewIntersections()
+		for _, s := range members {
+			s.AddIntersections(r, expected)
+		}
+
+		if xs.Len() != expected.Len() {
+			t.Fatalf("BVH found %d intersections instead of %d", xs.Len(), expected.Len())
+		}
+	}
+}
+
+func createRandomSpheresGroup(n int) *Group {
+	rand := NewRandomGenerator(1)
+
+	g := NewGroup()
+
+	for i := 0; i < n; i++ {
+		s := NewSphere()
+		s.SetTransform(Translation(rand()*20-10, rand()*20-10, rand()*20-10), Scaling(0.05+rand()*0.2))
+		g.Add(s)
+	}
+
+	g.SetTransform(RotationY(0.5), Scaling(0.5))
+	g.BuildBVH()
+
+	return g
+}
+
+func TestGroupWideBVH(t *testing.T) {
+	rand := NewRandomGenerator(2)
+
+	g := createRandomSpheresGroup(5000)
+
+	for i := 0; i < 500; i++ {
+		r := NewRay(Point(rand()*10-5, rand()*10-5, -10), Vector(rand()-0.5, rand()-0.5, 1).Normalize())
+
+		g.SetBvhLayout(BvhLayoutBinary)
+		expected := NewIntersections()
+		g.AddIntersections(r, expected)
+
+		g.SetBvhLayout(BvhLayoutWide4)
+		xs := NewIntersections()
+		g.AddIntersections(r, xs)
+
+		if xs.Len() != expected.Len() || xs.Hit() != expected.Hit() {
+			t.Fatalf("wide BVH found %d intersections instead of %d", xs.Len(), expected.Len())
+		}
+	}
+
+	if stats := g.Bvh().Stats(); stats.WideNodes == 0 || stats.WideNodes > stats.Nodes/2 {
+		t.Errorf("bad number of wide nodes: %s", stats)
+	}
+}
+
+func BenchmarkGroupBVH(b *testing.B) {
+	g := createRandomSpheresGroup(100000)
+
+	for _, layout := range []BvhLayout{BvhLayoutBinary, BvhLayoutWide4} {
+		g.SetBvhLayout(layout)
+
+		b.Run(map[BvhLayout]string{BvhLayoutBinary: "binary", BvhLayoutWide4: "wide4"}[layout], func(b *testing.B) {
+			rand := NewRandomGenerator(1)
+			xs := NewIntersections()
+
+			for i := 0; i < b.N; i++ {
+				r := NewRay(Point(rand()*10-5, rand()*10-5, -10), Vector(rand()-0.5, rand()-0.5, 1).Normalize())
+				xs.Reset()
+				g.AddIntersections(r, xs)
+			}
+		})
+	}
+}
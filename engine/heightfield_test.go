@@ -0,0 +1,206 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestHeightfieldIntersect(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	const W, H = 9, 7
+
+	heights := make([]float64, W*H)
+	for i := range heights {
+		heights[i] = rand()
+	}
+
+	hf, err := NewHeightfield(W, H, heights)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The grid walk must find the same hits as all the triangles of the cells
+	triangles := []*Triangle{}
+	vertex := func(i, j int) Tuple {
+		return Point(-1+2*float64(i)/(W-1), heights[i+j*W], 1-2*float64(j)/(H-1))
+	}
+
+	for j := 0; j < H-1; j++ {
+		for i := 0; i < W-1; i++ {
+			triangles = append(triangles, NewTriangle(vertex(i, j), vertex(i+1, j), vertex(i+1, j+1)))
+			triangles = append(triangles, NewTriangle(vertex(i, j), vertex(i+1, j+1), vertex(i, j+1)))
+		}
+	}
+
+	for n := 0; n < 500; n++ {
+		var r Ray
+
+		switch n % 4 {
+		case 0: // From above
+			r = NewRay(Point(rand()*4-2, 3, rand()*4-2), Vector(rand()-0.5, -1, rand()-0.5))
+		case 1: // Grazing from the side
+			r = NewRay(Point(-3, rand(), rand()*2-1), Vector(1, rand()*0.2-0.1, rand()-0.5))
+		case 2: // From inside the bounds, in any direction
+			r = NewRay(Point(rand()*2-1, rand(), rand()*2-1), Vector(rand()-0.5, rand()-0.5, rand()-0.5).Mul(3))
+		case 3: // Vertical
+			r = NewRay(Point(rand()*2-1, 2, rand()*2-1), Vector(0, -1, 0))
+		}
+
+		want := []float64{}
+		for _, tri := range triangles {
+			want = append(want, tri.LocalIntersect(r)...)
+		}
+
+		xs := hf.Shapable().LocalIntersect(r)
+
+		sort.Float64s(want)
+		sort.Float64s(xs)
+
+		if !SliceFloatEqual(xs, want) {
+			t.Errorf("ray %d %v: heightfield intersections %v should be %v", n, r, xs, want)
+		}
+	}
+}
+
+func TestHeightfieldNormals(t *testing.T) {
+	// A ramp along x has the same normal everywhere
+	heights := []float64{0, 0.5, 1, 0, 0.5, 1, 0, 0.5, 1}
+	hf, err := NewHeightfield(3, 3, heights)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Vector(-0.5, 1, 0).Normalize()
+
+	for _, p := range []Tuple{Point(-1, 0, 1), Point(0.3, 0.65, -0.2), Point(1, 1, -1)} {
+		if n := hf.NormalAt(p); !n.Equals(want) {
+			t.Errorf("normal at %v is %v, should be %v", p, n, want)
+		}
+	}
+
+	// A bump in the middle: normals are smooth across the edges of the triangles
+	heights = []float64{0, 0, 0, 0, 1, 0, 0, 0, 0}
+	hf, err = NewHeightfield(3, 3, heights)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := hf.NormalAt(Point(0, 1, 0)); !n.Equals(Vector(0, 1, 0)) {
+		t.Errorf("normal at the top is %v", n)
+	}
+
+	n1 := hf.NormalAt(Point(0.5+1e-9, 0.5, 0.5-1e-9))
+	n2 := hf.NormalAt(Point(0.5-1e-9, 0.5, 0.5+1e-9))
+
+	if n1.Sub(n2).Length() > 1e-6 {
+		t.Errorf("normals across an edge should be the same: %v %v", n1, n2)
+	}
+
+	// UVs follow the heights, from the top left corner of the image
+	ii := IntersectionInfo{}
+	hf.Shapable().NormalAtHit(Point(-1, 0, 1), &ii)
+
+	if ii.U != 0 || ii.V != 0 {
+		t.Errorf("uv of the first height is %v,%v", ii.U, ii.V)
+	}
+
+	hf.Shapable().NormalAtHit(Point(0.5, 0, -1), &ii)
+
+	if ii.U != 0.75 || ii.V != 1 {
+		t.Errorf("uv at the bottom is %v,%v", ii.U, ii.V)
+	}
+}
+
+func TestHeightfieldSetHeights(t *testing.T) {
+	hf := &Heightfield{}
+
+	if err := hf.SetHeights(2, 2, []float64{0, 1, 1, 0}); err != nil || hf.Bounds().Max.Y != 1 {
+		t.Fatalf("valid heights not set: %v", err)
+	}
+
+	for _, test := range []struct {
+		w, h    int
+		heights []float64
+	}{
+		{1, 1, []float64{0}},
+		{4, 1, []float64{0, 1, 0, 1}},
+		{0, 0, nil},
+		{3, 2, []float64{0, 1, 0, 1}},
+	} {
+		if err := hf.SetHeights(test.w, test.h, test.heights); err == nil {
+			t.Errorf("%dx%d heightfield with %d heights should fail", test.w, test.h, len(test.heights))
+		}
+	}
+
+	// The heightfield is not changed by invalid heights
+	if hf.W != 2 || hf.H != 2 || len(hf.Heights) != 4 {
+		t.Errorf("heightfield changed to %dx%d", hf.W, hf.H)
+	}
+
+	// The constructor reports invalid heights too
+	if s, err := NewHeightfield(1, 1, []float64{0}); err == nil || s != nil {
+		t.Errorf("invalid heightfield created")
+	}
+}
+
+func TestHeightsFromImage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	img.SetGray(1, 0, color.Gray{255})
+	img.SetGray(0, 1, color.Gray{51})
+
+	w, h, heights := HeightsFromImage(img)
+
+	if w != 2 || h != 2 || !SliceFloatEqual(heights, []float64{0, 1, 0.2, 0}) {
+		t.Errorf("heights from image are %dx%d %v", w, h, heights)
+	}
+
+	heights = HeightsFromNoise(32, 32, 4)
+
+	// Noise is stretched to fill the range of heights
+	min, max := 1.0, 0.0
+	for _, f := range heights {
+		min, max = math.Min(min, f), math.Max(max, f)
+	}
+
+	if min != 0 || max != 1 {
+		t.Errorf("noise heights go from %v to %v", min, max)
+	}
+}
+
+func TestHeightfieldVisualization(t *testing.T) {
+	TestWithImage(t)
+
+	w := NewWorld()
+
+	w.AddLights(NewPointLight(Point(-10, 10, -10), White))
+
+	terrain, err := NewHeightfield(256, 256, HeightsFromNoise(256, 256, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	terrain.SetTransform(Translation(0, -1, 0), Scaling(4, 1.5, 4))
+
+	checker := NewCheckerPattern(RGB(0.4, 0.7, 0.3), RGB(0.7, 0.6, 0.4))
+	checker.SetTransform(Scaling(0.25))
+	terrain.SetMaterial(NewMaterial().SetPattern(checker))
+
+	w.AddObjects(terrain)
+
+	camera := NewCamera(640, 480, Pi/3)
+	camera.SetTransform(EyeViewpoint(Point(0, 4, -7), Point(0, 0, 0), Vector(0, 1, 0)))
+
+	w.RenderToPNG(camera, "test_heightfield.png")
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+)
+
+func TestInstance(t *testing.T) {
+	rand := NewRandomGenerator(3)
+
+	geometry := createRandomSpheresGroup(500)
+	geometry.SetTransform()
+	geometry.SetMaterial(NewMaterial().SetPattern(NewCheckerPattern(White, Black)))
+	geometry.BuildBVH()
+
+	transform := []Matrix{Translation(1, 2, 3), RotationX(0.3), Scaling(0.8)}
+
+	// A copy of the geometry and an instance of it, both nested in a group
+	clone := geometry.Clone()
+	clone.SetTransform(transform...)
+
+	g1 := NewGroup()
+	g1.Add(clone)
+	g1.SetTransform(RotationZ(0.2))
+
+	instance := NewInstance(geometry)
+	instance.SetTransform(transform...)
+
+	g2 := NewGroup()
+	g2.Add(instance)
+	g2.SetTransform(RotationZ(0.2))
+
+	if b1, b2 := g1.Bounds(), g2.Bounds(); !b1.Min.Equals(b2.Min) || !b1.Max.Equals(b2.Max) {
+		t.Errorf("instance bounds differ: %v %v", b1, b2)
+	}
+
+	hits := 0
+
+	for i := 0; i < 500; i++ {
+		r := NewRay(Point(rand()*10-5, rand()*10-5, -20), Vector(rand()*0.2-0.1, rand()*0.2-0.1, 1))
+
+		xs1 := NewIntersections()
+		g1.AddIntersections(r, xs1)
+
+		xs2 := NewIntersections()
+		g2.AddIntersections(r, xs2)
+
+		h1, h2 := xs1.Hit(), xs2.Hit()
+
+		if xs1.Len() != xs2.Len() || h1.Valid() != h2.Valid() || math.Abs(h1.T-h2.T) > Epsilon {
+			t.Fatalf("ray %d: instance hit differs: %+v %+v", i, h1, h2)
+		}
+
+		if !h1.Valid() {
+			continue
+		}
+
+		hits++
+
+		ii1 := NewIntersectionInfo(h1, r, xs1)
+		ii2 := NewIntersectionInfo(h2, r, xs2)
+
+		if !ii1.Normalv.Equals(ii2.Normalv) {
+			t.Errorf("ray %d: instance normal differs: %v %v", i, ii1.Normalv, ii2.Normalv)
+		}
+
+		if !ii1.Mat.DiffuseColor.Equals(ii2.Mat.DiffuseColor) {
+			t.Errorf("ray %d: instance pattern differs: %v %v", i, ii1.Mat.DiffuseColor, ii2.Mat.DiffuseColor)
+		}
+	}
+
+	if hits == 0 {
+		t.Errorf("no rays hit the instance")
+	}
+
+	// Material override, the geometry does not change
+	m := NewMaterial()
+	other := instance.Clone().(*Instance)
+	other.SetMaterial(m)
+
+	r := NewRay(Point(0, 0, -20), Vector(0, 0, 1))
+
+	for _, s := range []Groupable{geometry.Members(0), geometry.Members(1)} {
+		if s.(*Shape).Material() == m {
+			t.Errorf("material override changed the geometry")
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		r.Origin = Point(rand()*10-5, rand()*10-5, -20)
+
+		xs := NewIntersections()
+		other.AddIntersections(r, xs)
+
+		if hit := xs.Hit(); hit.Valid() {
+			if ii := NewIntersectionInfo(hit, r, xs); ii.O.Material() != m {
+				t.Errorf("material override not applied")
+			}
+		}
+	}
+}
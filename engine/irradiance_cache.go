@@ -0,0 +1,454 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"image"
+	"math"
+	"sync"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+)
+
+// The irradiance cache computes indirect diffuse illumination only at sparse points of the scene,
+// and then interpolates between them: since indirect light usually changes slowly, it's much faster
+// than shooting a full hemisphere of rays at every hit. The implementation follows:
+// Greg Ward, Francis Rubinstein, Robert Clear, "A Ray Tracing Solution for Diffuse Interreflection"
+// Greg Ward, Paul Heckbert, "Irradiance Gradients"
+
+type IrradianceSample struct {
+	Pos       Tuple
+	Normal    Tuple
+	E         Color    // Irradiance
+	R         float64  // Harmonic mean distance to the surfaces seen from the point
+	RotGrad   [3]Tuple // Rotational gradient, one vector for each color component
+	TransGrad [3]Tuple // Translational gradient, one vector for each color component
+}
+
+type irradianceNode struct {
+	bounds   Box
+	samples  []*IrradianceSample
+	children [8]*irradianceNode
+}
+
+// IrradianceCache stores samples into an octree, it can be safely shared among many goroutines
+type IrradianceCache struct {
+	sync.RWMutex
+	root     *irradianceNode
+	accuracy float64 // Maximum error allowed when interpolating, smaller values yield more samples
+	minR     float64 // The harmonic mean distance is clamped to avoid too many or too few samples
+	maxR     float64
+}
+
+const IrradianceMaxOctreeDepth = 24
+
+// irradianceQuery is a point where the irradiance is needed but can't be interpolated from the cache
+type irradianceQuery struct {
+	p, n Tuple
+}
+
+func NewIrradianceCache(bounds Box, accuracy float64) *IrradianceCache {
+	diagonal := bounds.Diagonal().Length()
+
+	ic := &IrradianceCache{
+		root:     &irradianceNode{bounds: bounds},
+		accuracy: accuracy,
+		minR:     diagonal / 500,
+		maxR:     diagonal / 10,
+	}
+
+	return ic
+}
+
+// emptyCopy returns an empty cache with the same parameters
+func (ic *IrradianceCache) emptyCopy() *IrradianceCache {
+	return &IrradianceCache{
+		root:     &irradianceNode{bounds: ic.root.bounds},
+		accuracy: ic.accuracy,
+		minR:     ic.minR,
+		maxR:     ic.maxR,
+	}
+}
+
+func boxContains(b Box, p Tuple) bool {
+	return p.X >= b.Min.X && p.X <= b.Max.X && p.Y >= b.Min.Y && p.Y <= b.Max.Y && p.Z >= b.Min.Z && p.Z <= b.Max.Z
+}
+
+func (node *irradianceNode) childBounds(i int) Box {
+	c := node.bounds.Min.Add(node.bounds.Max).Mul(0.5)
+	b := node.bounds
+
+	if i&1 != 0 {
+		b.Min.X = c.X
+	} else {
+		b.Max.X = c.X
+	}
+
+	if i&2 != 0 {
+		b.Min.Y = c.Y
+	} else {
+		b.Max.Y = c.Y
+	}
+
+	if i&4 != 0 {
+		b.Min.Z = c.Z
+	} else {
+		b.Max.Z = c.Z
+	}
+
+	return b
+}
+
+// Add inserts a sample into all the nodes that overlap its area of validity,
+// stopping at nodes that are about as small as the area itself
+func (ic *IrradianceCache) Add(sample *IrradianceSample) {
+	ic.Lock()
+	defer ic.Unlock()
+
+	radius := sample.R * ic.accuracy
+	r := Vector(radius, radius, radius)
+	area := NewBox(sample.Pos.Sub(r), sample.Pos.Add(r))
+
+	if !boxContains(ic.root.bounds, sample.Pos) {
+		ic.root.samples = append(ic.root.samples, sample) // Outside the octree, will be checked by all lookups
+		return
+	}
+
+	var add func(node *irradianceNode, depth int)
+
+	add = func(node *irradianceNode, depth int) {
+		if depth == IrradianceMaxOctreeDepth || node.bounds.Diagonal().Length() < 2*area.Diagonal().Length() {
+			node.samples = append(node.samples, sample)
+			return
+		}
+
+		for i := range node.children {
+			b := node.childBounds(i)
+
+			if b.Min.X > area.Max.X || b.Max.X < area.Min.X || b.Min.Y > area.Max.Y || b.Max.Y < area.Min.Y || b.Min.Z > area.Max.Z || b.Max.Z < area.Min.Z {
+				continue // No overlap
+			}
+
+			if node.children[i] == nil {
+				node.children[i] = &irradianceNode{bounds: b}
+			}
+
+			add(node.children[i], depth+1)
+		}
+	}
+
+	add(ic.root, 0)
+}
+
+// Interpolate estimates the irradiance at a point from the nearby samples,
+// it returns false if there aren't enough samples to compute a reliable estimate
+func (ic *IrradianceCache) Interpolate(p, n Tuple) (Color, bool) {
+	ic.RLock()
+	defer ic.RUnlock()
+
+	var sum Color
+	sumWeights := 0.0
+
+	for node := ic.root; node != nil; {
+		for _, s := range node.samples {
+			// Skip samples in front of the point, as they could see things the point doesn't see
+			v := p.Sub(s.Pos)
+			if v.DotProduct(n.Add(s.Normal).Mul(0.5)) < -0.01*s.R {
+				continue
+			}
+
+			// Error estimate by Ward et al.
+			e := v.Length()/s.R + math.Sqrt(math.Max(0, 1-n.DotProduct(s.Normal)))
+
+			if e >= ic.accuracy {
+				continue
+			}
+
+			w := 1/e - 1/ic.accuracy
+			if math.IsInf(w, +1) {
+				w = 1e10 // Point is right on the sample
+			}
+
+			// Extrapolate irradiance with gradients
+			nxn := s.Normal.CrossProduct(n)
+			e0 := s.E.R + nxn.DotProduct(s.RotGrad[0]) + v.DotProduct(s.TransGrad[0])
+			e1 := s.E.G + nxn.DotProduct(s.RotGrad[1]) + v.DotProduct(s.TransGrad[1])
+			e2 := s.E.B + nxn.DotProduct(s.RotGrad[2]) + v.DotProduct(s.TransGrad[2])
+
+			sum = sum.Add(RGB(math.Max(0, e0), math.Max(0, e1), math.Max(0, e2)).Mul(w))
+			sumWeights += w
+		}
+
+		// Descend into the child that contains the point
+		var next *irradianceNode
+		if boxContains(node.bounds, p) {
+			c := node.bounds.Min.Add(node.bounds.Max).Mul(0.5)
+			i := 0
+			if p.X > c.X {
+				i |= 1
+			}
+			if p.Y > c.Y {
+				i |= 2
+			}
+			if p.Z > c.Z {
+				i |= 4
+			}
+			next = node.children[i]
+		}
+		node = next
+	}
+
+	if sumWeights == 0 {
+		return Black, false
+	}
+
+	return sum.Mul(1 / sumWeights), true
+}
+
+// ComputeIrradianceSample shoots a stratified hemisphere of rays above the point to compute
+// the irradiance due to indirect light, together with its gradients
+func (rt *Raytracer) ComputeIrradianceSample(p, n Tuple, strata int) *IrradianceSample {
+	M := strata     // Subdivisions of theta
+	N := strata * 3 // Subdivisions of phi, about pi times the subdivisions of theta as suggested by Ward
+
+	L := make([]Color, M*N)
+	dist := make([]float64, M*N)
+	sinTheta := make([]float64, M*N)
+
+	t, b := OrthonormalBasis(n)
+	origin := OffsetRayOrigin(p, PointError(p), n)
+
+	// The sample depends only on its position, not on the pixel that requested it: random numbers
+	// are reseeded (also those used to shade the hits) and the pixel sampler is left alone
+	sampler := rt.sampler
+	rt.sampler = nil
+	rt.rng.SeedHash(uint64(rt.world.Options.Seed), math.Float64bits(p.X), math.Float64bits(p.Y), math.Float64bits(p.Z))
+
+	rt.indirect = true
+	invDistSum := 0.0
+
+	for k := 0; k < N; k++ {
+		for j := 0; j < M; j++ {
+			// Sample the hemisphere with a cosine-weighted distribution, so that all cells have the same weight
+			sin2 := (float64(j) + rt.rand()) / float64(M)
+			st := math.Sqrt(sin2)
+			ct := math.Sqrt(1 - sin2)
+			phi := 2 * Pi * (float64(k) + rt.rand()) / float64(N)
+
+			dir := t.Mul(st * math.Cos(phi)).Add(b.Mul(st * math.Sin(phi))).Add(n.Mul(ct))
+			ray := NewRay(origin, dir)
+
+			i := j + k*M
+			sinTheta[i] = st
+
+			if hit := rt.Intersect(ray, VisibleInReflections); hit.Valid() {
+				dist[i] = hit.T
+				invDistSum += 1 / hit.T
+
+				ii := rt.ii
+				ii.Update(hit, ray, rt.xs)
+				L[i] = rt.ShadeHit(ii, 0)
+			} else {
+				dist[i] = math.Inf(+1)
+			}
+		}
+	}
+
+	rt.indirect = false
+	rt.sampler = sampler
+
+	s := &IrradianceSample{Pos: p, Normal: n}
+
+	// Irradiance
+	for _, l := range L {
+		s.E = s.E.Add(l)
+	}
+	s.E = s.E.Mul(Pi / float64(M*N))
+
+	// Harmonic mean distance
+	s.R = rt.world.IrradianceCache.maxR
+	if invDistSum > 0 {
+		s.R = math.Max(rt.world.IrradianceCache.minR, math.Min(s.R, float64(M*N)/invDistSum))
+	}
+
+	// Gradients
+	minR := rt.world.IrradianceCache.minR
+
+	addGrad := func(g *[3]Tuple, v Tuple, c Color) {
+		g[0] = g[0].Add(v.Mul(c.R))
+		g[1] = g[1].Add(v.Mul(c.G))
+		g[2] = g[2].Add(v.Mul(c.B))
+	}
+
+	for k := 0; k < N; k++ {
+		phi := 2 * Pi * float64(k) / float64(N) // Lower boundary of the cell in phi
+		phic := phi + Pi/float64(N)             // Center of the cell in phi
+		uc := t.Mul(math.Cos(phic)).Add(b.Mul(math.Sin(phic)))
+		vc := t.Mul(math.Cos(phic + Pi/2)).Add(b.Mul(math.Sin(phic + Pi/2))) // Perpendicular to the cell center
+		v := t.Mul(math.Cos(phi + Pi/2)).Add(b.Mul(math.Sin(phi + Pi/2)))    // Perpendicular to the lower boundary
+		kp := (k + N - 1) % N                                                // Previous cell in phi
+
+		for j := 0; j < M; j++ {
+			i := j + k*M
+
+			// Rotational gradient
+			tanTheta := sinTheta[i] / math.Sqrt(math.Max(1e-10, 1-sinTheta[i]*sinTheta[i]))
+			addGrad(&s.RotGrad, vc, L[i].Mul(-tanTheta*Pi/float64(M*N)))
+
+			// Boundaries of the cell in theta, as sin(theta) because cells are evenly spaced in sin^2(theta)
+			sinThetaLo := math.Sqrt(float64(j) / float64(M))
+			sinThetaHi := math.Sqrt(float64(j+1) / float64(M))
+
+			// Translational gradient, changes in theta across the lower boundary of the cell
+			if j > 0 {
+				cos2ThetaLo := 1 - float64(j)/float64(M)
+				r := math.Max(minR, math.Min(dist[i], dist[i-1]))
+				addGrad(&s.TransGrad, uc, L[i].Sub(L[i-1]).Mul(2*Pi/float64(N)*sinThetaLo*cos2ThetaLo/r))
+			}
+
+			// Translational gradient, changes in phi across the lower boundary of the cell
+			r := math.Max(minR, math.Min(dist[i], dist[j+kp*M]))
+			addGrad(&s.TransGrad, v, L[i].Sub(L[j+kp*M]).Mul((sinThetaHi-sinThetaLo)/r))
+		}
+	}
+
+	return s
+}
+
+// IndirectIrradiance returns the irradiance due to indirect light at a point, interpolated
+// from the cache when possible, otherwise a new sample is computed and added to the cache.
+// While rendering, the cache has been filled before (see FillIrradianceCache) and new samples are
+// kept only for the current pixel, so that the image doesn't depend on the order of the pixels
+func (rt *Raytracer) IndirectIrradiance(p, n Tuple) Color {
+	ic := rt.world.IrradianceCache
+
+	if e, ok := ic.Interpolate(p, n); ok {
+		return e
+	}
+
+	if rt.irradianceMisses != nil {
+		*rt.irradianceMisses = append(*rt.irradianceMisses, irradianceQuery{p, n})
+		return Black
+	}
+
+	if rt.pixelCache != nil {
+		ic = rt.pixelCache
+
+		if e, ok := ic.Interpolate(p, n); ok {
+			return e
+		}
+	}
+
+	s := rt.ComputeIrradianceSample(p, n, rt.world.Options.IrradianceSamples)
+	ic.Add(s)
+
+	return s.E
+}
+
+// FillIrradianceCache adds the samples needed to render the view of a camera to the cache: pixels are visited on
+// finer and finer grids, so that samples are spread evenly. For each grid the points that need a sample are found
+// and the samples are computed in parallel, then they are added to the cache in a fixed order, so that the cache
+// doesn't depend on the number of goroutines. Only the region being rendered is visited, plus a margin so that
+// pixels near its border find the samples they would find when rendering the whole view; the grids are still
+// aligned to the view, so the same pixels are visited
+func (w *World) FillIrradianceCache(goers int, camera *Camera, region image.Rectangle) {
+	const MaxStep = 16
+	const Margin = 2 * MaxStep
+
+	ic := w.IrradianceCache
+	frame := camera.Frame()
+	area := region.Inset(-Margin).Intersect(frame)
+
+	parallel := func(n int, f func(rt *Raytracer, i int)) {
+		var wg sync.WaitGroup
+
+		wg.Add(goers)
+		for g := 0; g < goers; g++ {
+			go func(g int) {
+				defer wg.Done()
+
+				rt := NewRaytracer(w)
+				for i := g; i < n; i += goers {
+					f(rt, i)
+				}
+			}(g)
+		}
+
+		wg.Wait()
+	}
+
+	for step := MaxStep; step >= 1; step /= 2 {
+		pixels := []image.Point{}
+
+		for y := frame.Min.Y; y < frame.Max.Y; y += step {
+			for x := frame.Min.X; x < frame.Max.X; x += step {
+				if step < MaxStep && (x-frame.Min.X)%(2*step) == 0 && (y-frame.Min.Y)%(2*step) == 0 {
+					continue // Already visited on the coarser grid
+				}
+
+				if !image.Pt(x, y).In(area) {
+					continue
+				}
+
+				pixels = append(pixels, image.Pt(x, y))
+			}
+		}
+
+		// Shade the center of each pixel, collecting the points where the irradiance is missing
+		misses := make([][]irradianceQuery, len(pixels))
+
+		parallel(len(pixels), func(rt *Raytracer, i int) {
+			p := pixels[i]
+			rt.StartSample(p.X, p.Y, 0)
+
+			if ray, ok := camera.CameraRay(float64(p.X)+0.5, float64(p.Y)+0.5, 0, 0, rt.rand); ok {
+				rt.irradianceMisses = &misses[i]
+				rt.ColorAt(ray)
+				rt.irradianceMisses = nil
+			}
+		})
+
+		queries := []irradianceQuery{}
+		for _, m := range misses {
+			queries = append(queries, m...)
+		}
+
+		samples := make([]*IrradianceSample, len(queries))
+
+		parallel(len(queries), func(rt *Raytracer, i int) {
+			samples[i] = rt.ComputeIrradianceSample(queries[i].p, queries[i].n, w.Options.IrradianceSamples)
+		})
+
+		// Nearby points may have computed samples that overlap, keep only the first
+		for _, s := range samples {
+			if _, ok := ic.Interpolate(s.Pos, s.Normal); !ok {
+				ic.Add(s)
+			}
+		}
+	}
+}
+
+// FiniteBounds returns the bounds of all objects in the world, ignoring infinite objects like planes
+func (w *World) FiniteBounds() Box {
+	bounds := NewBox(PointAtInfinity(+1), PointAtInfinity(-1))
+
+	for _, o := range w.Objects {
+		b := o.Bounds().Transform(o.Transform())
+
+		if !b.IsFinite() {
+			continue
+		}
+
+		bounds = bounds.Union(b)
+	}
+
+	if bounds.Min.X > bounds.Max.X {
+		bounds = NewBox(Point(-1, -1, -1), Point(1, 1, 1)) // Nothing finite in the world
+	}
+
+	return bounds
+}
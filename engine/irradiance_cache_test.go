@@ -0,0 +1,202 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestIrradianceCacheInterpolate(t *testing.T) {
+	ic := NewIrradianceCache(NewBox(Point(-10, -10, -10), Point(10, 10, 10)), 0.2)
+	up := Vector(0, 1, 0)
+
+	if _, ok := ic.Interpolate(Point(0, 0, 0), up); ok {
+		t.Errorf("empty cache should not interpolate")
+	}
+
+	ic.Add(&IrradianceSample{Pos: Point(0, 0, 0), Normal: up, E: RGB(1, 0.5, 0), R: 2})
+
+	if e, ok := ic.Interpolate(Point(0.1, 0, 0), up); !ok || !e.Equals(RGB(1, 0.5, 0)) {
+		t.Errorf("bad interpolation near sample: %+v %v", e, ok)
+	}
+
+	if _, ok := ic.Interpolate(Point(1, 0, 0), up); ok {
+		t.Errorf("sample should not be used far from its position")
+	}
+
+	if _, ok := ic.Interpolate(Point(0.1, 0, 0), Vector(1, 0, 0)); ok {
+		t.Errorf("sample should not be used with a very different normal")
+	}
+
+	// Samples outside the octree are still found
+	ic.Add(&IrradianceSample{Pos: Point(20, 0, 0), Normal: up, E: White, R: 2})
+
+	if e, ok := ic.Interpolate(Point(20, 0, 0.1), up); !ok || !e.Equals(White) {
+		t.Errorf("bad interpolation outside the octree: %+v %v", e, ok)
+	}
+}
+
+func createColorBleedingWorld() *World {
+	floor := NewPlane()
+
+	wall := NewCube()
+	wall.SetTransform(Translation(1.1, 1, 0), Scaling(0.1, 1, 2))
+	wall.Material().SetDiffuseColor(RGB(1, 0, 0))
+
+	w := NewWorld()
+	w.SetAmbient(Black)
+	w.AddObjects(floor, wall)
+	w.AddLights(NewPointLight(Point(-2, 5, 0), White))
+
+	return w
+}
+
+func TestIndirectIrradiance(t *testing.T) {
+	w := createColorBleedingWorld()
+	w.Options.IrradianceSamples = 8
+	w.Prepare()
+
+	rt := NewRaytracer(w)
+
+	// The floor next to the red wall receives red light bounced off the wall
+	e := rt.IndirectIrradiance(Point(0.5, 0, 0), Vector(0, 1, 0))
+
+	if e.R <= 0 || e.R <= 2*e.G || e.G != e.B {
+		t.Errorf("floor should be lit by red light: %+v", e)
+	}
+
+	// The sample is now in the cache
+	if _, ok := w.IrradianceCache.Interpolate(Point(0.5, 0, 0), Vector(0, 1, 0)); !ok {
+		t.Errorf("irradiance sample not cached")
+	}
+
+	// Indirect light adds to the shading of the floor
+	r := NewRay(Point(0.5, 1, 0), Vector(0, -1, 0))
+	ii := NewIntersectionInfo(NewIntersection(1, getHittableAt(w, 0)), r, nil)
+
+	c := w.ShadeHit(ii, 0)
+
+	w.IrradianceCache = nil
+	d := w.ShadeHit(ii, 0)
+
+	if c.R <= d.R || c.G-d.G >= c.R-d.R {
+		t.Errorf("indirect light should tint the floor red: %+v vs %+v", c, d)
+	}
+}
+
+func TestFillIrradianceCacheRegion(t *testing.T) {
+	w := createColorBleedingWorld()
+	w.Options.IrradianceSamples = 4
+
+	c := NewCamera(64, 48, Pi/3)
+	c.SetTransform(EyeViewpoint(Point(0, 2, -5), Point(0.5, 0, 0), Vector(0, 1, 0)))
+
+	count := func() int {
+		n := 0
+
+		var walk func(node *irradianceNode)
+		walk = func(node *irradianceNode) {
+			if node != nil {
+				n += len(node.samples) // Samples are counted once for each node they overlap, good enough to compare
+				for _, child := range node.children {
+					walk(child)
+				}
+			}
+		}
+		walk(w.IrradianceCache.root)
+
+		return n
+	}
+
+	w.Prepare()
+	w.FillIrradianceCache(2, c, c.Frame())
+	full := count()
+
+	// A small region with its margin covers only part of the view, so it needs fewer samples
+	w.Invalidate()
+	w.Prepare()
+	w.FillIrradianceCache(2, c, image.Rect(0, 0, 4, 4))
+	region := count()
+
+	if region == 0 || region >= full {
+		t.Errorf("region of the view filled with %d samples, the whole view with %d", region, full)
+	}
+}
+
+func TestIrradianceGradient(t *testing.T) {
+	// A glowing ball next to the floor, so that irradiance on the floor changes with the position
+	lamp := NewSphere()
+	lamp.SetTransform(Translation(2, 1.5, 1))
+	lamp.SetMaterial(NewMaterial().SetAmbient(1).SetDiffuse(0).SetSpecular(0))
+
+	w := NewWorld()
+	w.AddObjects(NewPlane(), lamp)
+	w.Options.IrradianceSamples = 32
+	w.Prepare()
+
+	rt := NewRaytracer(w)
+	p, up := Point(0, 0, 0), Vector(0, 1, 0)
+	s := rt.ComputeIrradianceSample(p, up, 64)
+
+	// The translational gradient matches central differences of the irradiance along the floor,
+	// within the noise of the estimates
+	const d = 0.25
+	tolerance := 0.1 * s.TransGrad[0].Length()
+
+	for _, dir := range []Tuple{Vector(1, 0, 0), Vector(0, 0, 1), Vector(-0.6, 0, 0.8)} {
+		e1 := rt.ComputeIrradianceSample(p.Add(dir.Mul(d)), up, 64).E.R
+		e0 := rt.ComputeIrradianceSample(p.Sub(dir.Mul(d)), up, 64).E.R
+		fd := (e1 - e0) / (2 * d)
+		g := s.TransGrad[0].DotProduct(dir)
+
+		if math.Abs(g-fd) > tolerance {
+			t.Errorf("gradient along %v is %f, finite differences give %f", dir, g, fd)
+		}
+	}
+}
+
+func TestIndirectIlluminationScene(t *testing.T) {
+	TestWithImage(t)
+
+	floor := NewPlane()
+
+	left := NewPlane()
+	left.SetTransform(Translation(-3, 0, 0), RotationZ(Pi/2))
+	left.Material().SetDiffuseColor(RGB(0.8, 0.1, 0.1))
+
+	right := NewPlane()
+	right.SetTransform(Translation(3, 0, 0), RotationZ(Pi/2))
+	right.Material().SetDiffuseColor(RGB(0.1, 0.8, 0.1))
+
+	back := NewPlane()
+	back.SetTransform(Translation(0, 0, 3), RotationX(Pi/2))
+
+	ceiling := NewPlane()
+	ceiling.SetTransform(Translation(0, 6, 0))
+
+	s1 := NewSphere()
+	s1.SetTransform(Translation(-1, 1, 0))
+
+	s2 := NewCube()
+	s2.SetTransform(Translation(1.2, 1, 1), RotationY(0.4))
+
+	w := NewWorld()
+	w.SetAmbient(Black)
+	w.AddObjects(floor, left, right, back, ceiling, s1, s2)
+	w.AddLights(NewPointLight(Point(0, 5, -2), Gray(0.8)))
+	w.Options.IrradianceSamples = 8
+
+	camera := NewCamera(400, 300, Pi/3)
+	camera.SetTransform(EyeViewpoint(Point(0, 3, -7), Point(0, 2, 0), Vector(0, 1, 0)))
+
+	w.RenderToPNG(camera, "test_indirect_illumination.png")
+}
@@ -8,7 +8,9 @@ import (
 	"math"
 
 	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
 	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/traits"
 )
 
 // The adaptive area sampler is my own version (see README for more information) of an adaptive algorithm for sampling area lights,
@@ -17,19 +19,31 @@ const UseAdaptiveSamplerForAreaLights = true
 
 type Light interface {
 	LightenHit(ii *IntersectionInfo, rt *Raytracer) Color
+	Illuminates(o Hittable) bool
+}
+
+// LightLinks restricts the set of objects that are lit by a light: if some objects are included
+// then only those are lit, otherwise all objects are lit except the excluded ones.
+// Naming a group (or CSG) links all the objects it contains.
+type LightLinks struct {
+	include map[string]bool
+	exclude map[string]bool
 }
 
 type PointLight struct {
+	LightLinks
 	Pos       Tuple
 	Intensity Color
 }
 
 type DirectionalLight struct {
+	LightLinks
 	Dir       Tuple
 	Intensity Color
 }
 
 type SpotLight struct {
+	LightLinks
 	Pos       Tuple
 	Dir       Tuple
 	AngleMin  float64
@@ -38,21 +52,85 @@ type SpotLight struct {
 }
 
 type RectLight struct {
+	LightLinks
 	Pos       Tuple
 	Uv        Tuple
 	Vv        Tuple
 	Intensity Color
 }
 
+func (ll *LightLinks) Include(names ...string) {
+	if ll.include == nil {
+		ll.include = make(map[string]bool)
+	}
+
+	for _, name := range names {
+		ll.include[name] = true
+	}
+}
+
+func (ll *LightLinks) Exclude(names ...string) {
+	if ll.exclude == nil {
+		ll.exclude = make(map[string]bool)
+	}
+
+	for _, name := range names {
+		ll.exclude[name] = true
+	}
+}
+
+// Illuminates returns true if the light is linked to the object
+func (ll *LightLinks) Illuminates(o Hittable) bool {
+	if len(ll.include) == 0 && len(ll.exclude) == 0 {
+		return true // Quick exit for the common case
+	}
+
+	included := len(ll.include) == 0
+
+	// Walk up the hierarchy, so that objects are linked by their own name or by the name of any container
+	var node interface{} = o
+
+	for node != nil {
+		if n, ok := node.(Namable); ok {
+			if ll.exclude[n.Name()] {
+				return false
+			}
+
+			if ll.include[n.Name()] {
+				included = true
+			}
+		}
+
+		if p, ok := node.(interface{ Parent() Container }); ok && p.Parent() != nil {
+			node = p.Parent()
+		} else {
+			node = nil
+		}
+	}
+
+	return included
+}
+
 // IsShadowed returns true if there is an opaque object between the light position and the specified point
 func IsShadowed(lightPos Tuple, rt *Raytracer, point Tuple) bool {
 	v := lightPos.Sub(point)
 	distance := v.Length()
 	direction := v.Normalize()
 	ray := NewRay(point, direction)
-	hit := rt.HitForShadow(ray)
+	ray.TMax = distance
+
+	return rt.Occluded(ray)
+}
+
+// LightTransmittance returns how much of the light at the specified position reaches the point:
+// white if nothing is in between, black if an opaque object is in between, a tint if only transparent objects are
+func LightTransmittance(lightPos Tuple, rt *Raytracer, point Tuple) Color {
+	v := lightPos.Sub(point)
+	distance := v.Length()
+	direction := v.Normalize()
+	ray := NewRay(point, direction)
 
-	return hit.Valid() && hit.T < distance
+	return rt.ShadowTransmittance(ray, distance)
 }
 
 // OrenNayar implements the Van Ouwerkerks rewrite of Oren-Nayar model,
@@ -149,13 +227,13 @@ func Lighten(light *PointLight, object Hittable, point, eyev, normalv Tuple, sha
 }
 
 func NewPointLight(pos Tuple, intensity Color) *PointLight {
-	return &PointLight{pos, intensity}
+	return &PointLight{Pos: pos, Intensity: intensity}
 }
 
 func (light *PointLight) LightenHit(ii *IntersectionInfo, rt *Raytracer) (result Color) {
-	if !IsShadowed(light.Pos, rt, ii.OverPoint) {
+	if t := LightTransmittance(light.Pos, rt, ii.OverPoint); t.IsBlack() == 0 {
 		lightv := light.Pos.Sub(ii.Point).Normalize() // Direction to the light source
-		result = LightenHit(lightv, light.Intensity, ii)
+		result = LightenHit(lightv, light.Intensity.Blend(t), ii)
 	}
 
 	return
@@ -203,11 +281,12 @@ func (light *RectLight) LightenHitWithJitteredStratified(ii *IntersectionInfo, r
 
 	for u := Epsilon; u < 1; u += usize {
 		for v := Epsilon; v < 1; v += vsize {
-			pos := light.Pos.Add(light.Uv.Mul(u + rt.rand()*usize)).Add(light.Vv.Mul(v + rt.rand()*vsize))
+			du, dv := rt.Sample2d()
+			pos := light.Pos.Add(light.Uv.Mul(u + du*usize)).Add(light.Vv.Mul(v + dv*vsize))
 
-			if !IsShadowed(pos, rt, ii.OverPoint) {
+			if t := LightTransmittance(pos, rt, ii.OverPoint); t.IsBlack() == 0 {
 				lightv := pos.Sub(ii.Point).Normalize() // Direction to the light source
-				result = result.Add(LightenHit(lightv, light.Intensity, ii))
+				result = result.Add(LightenHit(lightv, light.Intensity.Blend(t), ii))
 			}
 		}
 	}
@@ -239,13 +318,15 @@ func (light *RectLight) LightenHitWithAdaptiveSampling(ii *IntersectionInfo, rt
 	sample := func(u, v float64) Color {
 		pos := light.Pos.Add(light.Uv.Mul(u)).Add(light.Vv.Mul(v))
 
-		if IsShadowed(pos, rt, ii.OverPoint) {
+		t := LightTransmittance(pos, rt, ii.OverPoint)
+
+		if t.IsBlack() != 0 {
 			return Black
 		}
 
 		lightv := pos.Sub(ii.Point).Normalize() // Direction to the light source
 
-		return LightenHit(lightv, light.Intensity, ii)
+		return LightenHit(lightv, light.Intensity.Blend(t), ii)
 	}
 
 	var estimateArea func(u, v, w, h float64, p0, p1, p2, p3 Color, depth int, ok bool) Color
@@ -319,51 +400,61 @@ func (light *RectLight) LightenHit(ii *IntersectionInfo, rt *Raytracer) (result
 }
 
 func NewDirectionalLight(dir Tuple, intensity Color) *DirectionalLight {
-	return &DirectionalLight{dir.Normalize().Neg(), intensity}
+	return &DirectionalLight{Dir: dir.Normalize().Neg(), Intensity: intensity}
 }
 
 func (light *DirectionalLight) IsShadowed(rt *Raytracer, point Tuple) bool {
 	ray := NewRay(point, light.Dir)
 
-	hit := rt.HitForShadow(ray)
+	return rt.Occluded(ray)
+}
+
+func (light *DirectionalLight) Transmittance(rt *Raytracer, point Tuple) Color {
+	ray := NewRay(point, light.Dir)
 
-	return hit.Valid()
+	return rt.ShadowTransmittance(ray, math.Inf(+1))
 }
 
 func (light *DirectionalLight) LightenHit(ii *IntersectionInfo, rt *Raytracer) (result Color) {
-	if !light.IsShadowed(rt, ii.OverPoint) {
-		result = LightenHit(light.Dir, light.Intensity, ii)
+	if t := light.Transmittance(rt, ii.OverPoint); t.IsBlack() == 0 {
+		result = LightenHit(light.Dir, light.Intensity.Blend(t), ii)
 	}
 
 	return
 }
 
 func NewSpotLight(pos, target Tuple, angleMin, angleMax float64, intensity Color) *SpotLight {
-	return &SpotLight{pos, target.Sub(pos).Normalize(), angleMin, angleMax, intensity}
+	return &SpotLight{Pos: pos, Dir: target.Sub(pos).Normalize(), AngleMin: angleMin, AngleMax: angleMax, Intensity: intensity}
 }
 
 func (light *SpotLight) LightenHit(ii *IntersectionInfo, rt *Raytracer) (result Color) {
-	if !IsShadowed(light.Pos, rt, ii.OverPoint) {
+	if t := LightTransmittance(light.Pos, rt, ii.OverPoint); t.IsBlack() == 0 {
 		lightv := light.Pos.Sub(ii.Point).Normalize() // Direction to the light source
 
-		cosSpotAngle := lightv.Neg().DotProduct(light.Dir)
-		spotAngle := math.Acos(cosSpotAngle)
+		if intensity := light.Falloff(lightv.Neg().DotProduct(light.Dir)); intensity > 0 {
+			result = LightenHit(lightv, light.Intensity.Blend(t).Mul(intensity), ii)
+		}
+	}
 
-		a := math.Abs(spotAngle)
+	return result
+}
 
-		if a < light.AngleMax {
-			intensity := 1.0
+// Falloff returns the fraction of light emitted in a direction, given the cosine of the angle with the spot direction
+func (light *SpotLight) Falloff(cosSpotAngle float64) (intensity float64) {
+	spotAngle := math.Acos(cosSpotAngle)
 
-			if a > light.AngleMin {
-				// Modulate light so that it fades off gently
-				t := (light.AngleMax - a) / (light.AngleMax - light.AngleMin) // Linear modulation: not good enough
-				sqt := t * t                                                  // Quadratic modulation: much better! But still not perfect...
-				intensity = sqt / (2*(sqt-t) + 1)
-			}
+	a := math.Abs(spotAngle)
 
-			result = LightenHit(lightv, light.Intensity.Mul(intensity), ii)
+	if a < light.AngleMax {
+		intensity = 1.0
+
+		if a > light.AngleMin {
+			// Modulate light so that it fades off gently
+			t := (light.AngleMax - a) / (light.AngleMax - light.AngleMin) // Linear modulation: not good enough
+			sqt := t * t                                                  // Quadratic modulation: much better! But still not perfect...
+			intensity = sqt / (2*(sqt-t) + 1)
 		}
 	}
 
-	return result
+	return intensity
 }
@@ -68,6 +68,166 @@ func TestPattern(t *testing.T) {
 	}
 }
 
+func TestLightLinking(t *testing.T) {
+	w := createDefaultWorld()
+	w.Objects[0].SetName("backdrop")
+	r := NewRay(Point(0, 0, -5), Vector(0, 0, 1))
+	ambient := RGB(0.08, 0.1, 0.06) // Ambient contribution of the outer sphere
+
+	if c := w.ColorAt(r, 0); !c.Equals(RGB(0.38066119, 0.4758265, 0.2854959)) {
+		t.Errorf("linked light should light the object: %+v", c)
+	}
+
+	light := w.Lights[0].(*PointLight)
+	light.Exclude("backdrop")
+
+	if c := w.ColorAt(r, 0); !c.Equals(ambient) {
+		t.Errorf("excluded object should not be lit: %+v", c)
+	}
+
+	light.LightLinks = LightLinks{}
+	light.Include("some_other_object")
+
+	if c := w.ColorAt(r, 0); !c.Equals(ambient) {
+		t.Errorf("object not included should not be lit: %+v", c)
+	}
+
+	// Objects are linked by the name of their group as well
+	g := NewGroup()
+	g.SetName("product")
+	g.Add(w.Objects[0])
+	w.Objects[0] = g
+	light.Include("product")
+
+	if c := w.ColorAt(r, 0); !c.Equals(RGB(0.38066119, 0.4758265, 0.2854959)) {
+		t.Errorf("object included by group should be lit: %+v", c)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	w := createDefaultWorld()
+	outer := w.Objects[0]
+	r := NewRay(Point(0, 0, -5), Vector(0, 0, 1))
+	xs := NewIntersections()
+
+	outer.SetVisibility(VisibleToAll &^ VisibleToCamera)
+	xs.Visibility = VisibleToCamera
+	outer.AddIntersections(r, xs)
+
+	if xs.Len() != 0 {
+		t.Errorf("object hidden from camera should not be hit by camera rays")
+	}
+
+	xs.Visibility = VisibleInReflections
+	outer.AddIntersections(r, xs)
+
+	if xs.Len() != 2 {
+		t.Errorf("object hidden from camera should be hit by reflected rays")
+	}
+
+	// The camera now sees the inner sphere only
+	if c := w.ColorAt(r, 0); c.Equals(RGB(0.38066119, 0.4758265, 0.2854959)) || c.Equals(Black) {
+		t.Errorf("camera should see the inner sphere: %+v", c)
+	}
+
+	rt := NewRaytracer(w)
+	light := w.Lights[0].(*PointLight)
+
+	if !IsShadowed(light.Pos, rt, Point(10, -10, 10)) {
+		t.Errorf("shadow expected")
+	}
+
+	outer.SetVisibility(VisibleToAll &^ CastsShadows)
+	w.Objects[1].SetVisibility(VisibleToAll &^ CastsShadows)
+
+	if IsShadowed(light.Pos, rt, Point(10, -10, 10)) {
+		t.Errorf("no shadow expected from objects that do not cast shadows")
+	}
+}
+
+func TestShadowTransmittance(t *testing.T) {
+	w := createDefaultWorld()
+	rt := NewRaytracer(w)
+	light := w.Lights[0].(*PointLight)
+	point := Point(10, -10, 10) // In the shadow of both spheres
+
+	if c := LightTransmittance(light.Pos, rt, point); !c.Equals(Black) {
+		t.Errorf("opaque objects should cast a black shadow: %+v", c)
+	}
+
+	if c := LightTransmittance(light.Pos, rt, Point(0, 10, 0)); !c.Equals(White) {
+		t.Errorf("unoccluded point should receive all light: %+v", c)
+	}
+
+	// Make both spheres transparent: light crosses four surfaces
+	w.Options.TransmissiveShadows = true
+	getHittableAt(w, 0).Material().SetRefract(0.9, RGB(1, 0.5, 1))
+	getHittableAt(w, 1).Material().SetRefract(1, White)
+
+	if c := LightTransmittance(light.Pos, rt, point); !c.Equals(RGB(0.81, 0.2025, 0.81)) {
+		t.Errorf("transparent objects should cast a colored shadow: %+v", c)
+	}
+
+	w.Options.TransmissiveShadows = false
+
+	if c := LightTransmittance(light.Pos, rt, point); !c.Equals(Black) {
+		t.Errorf("transparent objects should cast a black shadow when disabled: %+v", c)
+	}
+}
+
+func TestShadowAtAnyScale(t *testing.T) {
+	for _, scale := range []float64{1e-4, 1, 1e4, 1e6} {
+		rand := NewRandomGenerator(1)
+		base := Vector(100*scale, 0, 50*scale)
+
+		w := NewWorld()
+
+		plane := NewPlane()
+		plane.SetTransform(Translation(base.X, base.Y, base.Z))
+
+		// A thin slab lying on the plane
+		slab := NewCube()
+		slab.SetTransform(Translation(base.X, base.Y+0.01*scale, base.Z), Scaling(scale, 0.01*scale, scale))
+
+		sphere := NewSphere()
+		sphere.SetTransform(Translation(base.X+3*scale, base.Y+scale, base.Z), Scaling(scale))
+
+		w.AddObjects(plane, slab, sphere)
+
+		light := Point(0, 10*scale, 0).Add(base)
+		w.AddLights(NewPointLight(light, White))
+
+		rt := NewRaytracer(w)
+
+		// The plane under the slab must not be lit, even if the slab is thinner than the size of the scene
+		r := NewRay(Point(0.5*scale, 5*scale, 0.5*scale).Add(base), Vector(0, -1, 0))
+		ii := NewIntersectionInfo(NewIntersection(5*scale, plane), r, nil)
+
+		if !IsShadowed(light, rt, ii.OverPoint) {
+			t.Errorf("scale %g: light leaks under the slab", scale)
+		}
+
+		// The lit side of the sphere must not shadow itself
+		eye := Point(3*scale, 5*scale, -5*scale).Add(base)
+
+		for i := 0; i < 500; i++ {
+			target := Point(3*scale+(rand()-0.5)*2*scale, scale+(rand()-0.5)*2*scale, 0).Add(base)
+			r := NewRay(eye, target.Sub(eye).Normalize())
+
+			hit := rt.Intersect(r, VisibleToCamera)
+			if hit.O != sphere {
+				continue
+			}
+
+			ii := NewIntersectionInfo(hit, r, rt.xs)
+
+			if ii.Normalv.DotProduct(light.Sub(ii.Point).Normalize()) > 0.05 && IsShadowed(light, rt, ii.OverPoint) {
+				t.Fatalf("scale %g: shadow acne at %+v", scale, ii.Point)
+			}
+		}
+	}
+}
+
 func TestRectLight(t *testing.T) {
 	TestWithImage(t)
 
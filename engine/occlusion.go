@@ -0,0 +1,50 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	. "ascottix/funtracer/textures"
+)
+
+// AmbientOcclusion returns the fraction of the hemisphere above the hit that is not occluded by objects
+// closer than maxDistance, by shooting samples*samples cosine-weighted rays in a jittered stratified pattern
+func (rt *Raytracer) AmbientOcclusion(ii *IntersectionInfo, samples int, maxDistance float64) float64 {
+	sampler := NewJitteredStratified2d(samples, samples, rt.Sample1d)
+	count := samples * samples
+	unoccluded := 0
+
+	for i := 0; i < count; i++ {
+		u, v := sampler.Next()
+		ray := NewRay(ii.OverPoint, CosineSampleHemisphere(u, v, ii.Normalv))
+		ray.TMax = maxDistance
+
+		if !rt.Occluded(ray) {
+			unoccluded++
+		}
+	}
+
+	return float64(unoccluded) / float64(count)
+}
+
+// AmbientOcclusionColor renders with ambient occlusion only, as if all objects were made of white clay
+func (rt *Raytracer) AmbientOcclusionColor(ray Ray) Color {
+	hit := rt.Intersect(ray, VisibleToCamera)
+
+	if !hit.Valid() {
+		return Black
+	}
+
+	ii := rt.ii
+	ii.Update(hit, ray, rt.xs)
+
+	options := rt.world.Options
+	samples := options.AmbientOcclusionSamples
+
+	if samples == 0 {
+		samples = 4 // Occlusion cannot be disabled in this mode, so use a sensible default
+	}
+
+	return Gray(rt.AmbientOcclusion(ii, samples, options.AmbientOcclusionDistance))
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/options"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestAmbientOcclusion(t *testing.T) {
+	floor := NewPlane()
+
+	lid := NewCube()
+	lid.SetTransform(Translation(0, 0.5, 0), Scaling(10, 0.1, 10))
+
+	w := NewWorld()
+	w.AddObjects(floor)
+	rt := NewRaytracer(w)
+
+	r := NewRay(Point(0, 1, 0), Vector(0, -1, 0))
+	ii := NewIntersectionInfo(NewIntersection(1, getHittableAt(w, 0)), r, nil)
+
+	if ao := rt.AmbientOcclusion(ii, 4, 1); ao != 1 {
+		t.Errorf("open surface should not be occluded: %f", ao)
+	}
+
+	w.AddObjects(lid)
+
+	if ao := rt.AmbientOcclusion(ii, 4, 100); ao != 0 {
+		t.Errorf("covered surface should be occluded: %f", ao)
+	}
+
+	if ao := rt.AmbientOcclusion(ii, 4, 0.3); ao != 1 {
+		t.Errorf("occluders farther than max distance should be ignored: %f", ao)
+	}
+
+	// Ambient occlusion modulates the ambient term
+	c := w.ShadeHit(ii, 0)
+	w.Options.AmbientOcclusionSamples = 4
+	w.Options.AmbientOcclusionDistance = 100
+
+	if d := w.ShadeHit(ii, 0); d.R >= c.R {
+		t.Errorf("ambient light should be darker under the lid: %+v >= %+v", d, c)
+	}
+}
+
+func TestAmbientOcclusionScene(t *testing.T) {
+	TestWithImage(t)
+
+	floor := NewPlane()
+
+	s1 := NewSphere()
+	s1.SetTransform(Translation(0, 1, 0))
+
+	s2 := NewCube()
+	s2.SetTransform(Translation(-2, 0.5, 1), RotationY(0.5), Scaling(0.5))
+
+	w := NewWorld()
+	w.AddObjects(floor, s1, s2)
+	w.Options.Integrator = IntegratorAmbientOcclusion
+	w.Options.AmbientOcclusionSamples = 6
+
+	camera := NewCamera(400, 300, Pi/3)
+	camera.SetTransform(EyeViewpoint(Point(0, 3, -6), Point(0, 0.5, 0), Vector(0, 1, 0)))
+
+	w.RenderToPNG(camera, "test_ambient_occlusion.png")
+}
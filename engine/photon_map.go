@@ -0,0 +1,247 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+	"sort"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// Photon mapping is used to render caustics, i.e. light focused by mirrors and transparent objects,
+// which the Whitted recursion of the raytracer cannot handle. Before rendering, photons are emitted by
+// the lights and traced thru specular surfaces: when they land on a diffuse surface they are stored
+// in a kd-tree, which is later used to estimate the irradiance at the hits.
+// See: Henrik Wann Jensen, "Realistic Image Synthesis Using Photon Mapping"
+
+type Photon struct {
+	Pos   Tuple // Where the photon landed
+	Dir   Tuple // Direction the photon was travelling
+	Power Color
+	axis  int // Splitting axis of the kd-tree node
+}
+
+// PhotonMap stores photons in a balanced kd-tree, laid out in an array so that
+// the node of the [lo,hi) range is at the middle and its children are on each side
+type PhotonMap struct {
+	photons []Photon
+}
+
+// PhotonEmitter is implemented by lights that can shoot photons
+type PhotonEmitter interface {
+	// EmitPhoton returns a random ray leaving the light and its intensity multiplied by the solid angle of emission
+	EmitPhoton(rand FloatGenerator) (Ray, Color)
+}
+
+func NewPhotonMap(photons []Photon) *PhotonMap {
+	pm := &PhotonMap{photons}
+
+	pm.build(0, len(photons))
+
+	return pm
+}
+
+func (pm *PhotonMap) build(lo, hi int) {
+	if hi-lo <= 1 {
+		return
+	}
+
+	// Split along the longest axis of the photon bounds
+	pmin := PointAtInfinity(+1)
+	pmax := PointAtInfinity(-1)
+
+	for i := lo; i < hi; i++ {
+		p := pm.photons[i].Pos
+		pmin = Point(math.Min(pmin.X, p.X), math.Min(pmin.Y, p.Y), math.Min(pmin.Z, p.Z))
+		pmax = Point(math.Max(pmax.X, p.X), math.Max(pmax.Y, p.Y), math.Max(pmax.Z, p.Z))
+	}
+
+	d := pmax.Sub(pmin)
+	axis := 2
+	if d.X > d.Y && d.X > d.Z {
+		axis = 0
+	} else if d.Y > d.Z {
+		axis = 1
+	}
+
+	// Note: a full sort is not needed here, but the build time is negligible compared to tracing the photons
+	photons := pm.photons[lo:hi]
+	sort.Slice(photons, func(i, j int) bool {
+		return photons[i].Pos.CompByIdx(axis) < photons[j].Pos.CompByIdx(axis)
+	})
+
+	mid := (lo + hi) / 2
+	pm.photons[mid].axis = axis
+
+	pm.build(lo, mid)
+	pm.build(mid+1, hi)
+}
+
+func (pm *PhotonMap) Len() int {
+	return len(pm.photons)
+}
+
+// Gather calls fn for all photons within radius of the specified point
+func (pm *PhotonMap) Gather(p Tuple, radius float64, fn func(ph *Photon, dist2 float64)) {
+	pm.gather(0, len(pm.photons), p, radius*radius, fn)
+}
+
+func (pm *PhotonMap) gather(lo, hi int, p Tuple, r2 float64, fn func(ph *Photon, dist2 float64)) {
+	if lo >= hi {
+		return
+	}
+
+	mid := (lo + hi) / 2
+	ph := &pm.photons[mid]
+
+	if v := p.Sub(ph.Pos); v.DotProduct(v) < r2 {
+		fn(ph, v.DotProduct(v))
+	}
+
+	if hi-lo == 1 {
+		return
+	}
+
+	// Visit the side of the splitting plane that contains the point first, then the other side if close enough
+	d := p.CompByIdx(ph.axis) - ph.Pos.CompByIdx(ph.axis)
+
+	if d < 0 {
+		pm.gather(lo, mid, p, r2, fn)
+		if d*d < r2 {
+			pm.gather(mid+1, hi, p, r2, fn)
+		}
+	} else {
+		pm.gather(mid+1, hi, p, r2, fn)
+		if d*d < r2 {
+			pm.gather(lo, mid, p, r2, fn)
+		}
+	}
+}
+
+// Irradiance estimates the light arriving at a point on a surface with normal n
+// from the density of the photons around it, weighted with a cone filter
+func (pm *PhotonMap) Irradiance(p, n Tuple, radius float64) (c Color) {
+	const k = 1.1 // Cone filter constant, must be >= 1
+
+	pm.Gather(p, radius, func(ph *Photon, dist2 float64) {
+		if ph.Dir.DotProduct(n) < 0 { // Only photons landing on the front side of the surface
+			w := 1 - math.Sqrt(dist2)/(k*radius)
+			c = c.Add(ph.Power.Mul(w))
+		}
+	})
+
+	return c.Mul(1 / ((1 - 2/(3*k)) * Pi * radius * radius))
+}
+
+func (light *PointLight) EmitPhoton(rand FloatGenerator) (Ray, Color) {
+	dir := UniformSampleSphere(rand(), rand())
+
+	return NewRay(light.Pos, dir), light.Intensity.Mul(4 * Pi)
+}
+
+func (light *SpotLight) EmitPhoton(rand FloatGenerator) (Ray, Color) {
+	cosMax := math.Cos(light.AngleMax)
+	dir := UniformSampleCone(rand(), rand(), cosMax, light.Dir)
+	power := light.Intensity.Mul(2 * Pi * (1 - cosMax) * light.Falloff(dir.DotProduct(light.Dir)))
+
+	return NewRay(light.Pos, dir), power
+}
+
+func (light *RectLight) EmitPhoton(rand FloatGenerator) (Ray, Color) {
+	pos := light.Pos.Add(light.Uv.Mul(rand())).Add(light.Vv.Mul(rand()))
+	dir := UniformSampleSphere(rand(), rand())
+
+	return NewRay(pos, dir), light.Intensity.Mul(4 * Pi)
+}
+
+func avgColor(c Color) float64 {
+	return (c.R + c.G + c.B) / 3
+}
+
+// TracePhoton follows a photon emitted by a light thru specular reflections and refractions,
+// and appends it to the list if it lands on a diffuse surface after at least one bounce
+func (rt *Raytracer) TracePhoton(light Light, ray Ray, power Color, photons []Photon) []Photon {
+	for depth := 0; depth <= rt.world.Options.ReflectionDepth; depth++ {
+		hit := rt.Intersect(ray, CastsShadows) // Objects that don't block light don't focus it either
+
+		if !hit.Valid() {
+			break
+		}
+
+		if depth == 0 {
+			// Lights do not fall off with distance in this raytracer, so the photon power is scaled
+			// to make its density match the direct illumination at the first hit
+			power = power.Mul(hit.T * hit.T)
+		}
+
+		ii := rt.ii
+		ii.Update(hit, ray, rt.xs)
+
+		m := ii.O.Material()
+
+		if depth > 0 && ii.Mat.DiffuseLevel > 0 && ii.Mat.RefractLevel == 0 && light.Illuminates(ii.O) {
+			photons = append(photons, Photon{Pos: ii.Point, Dir: ray.Direction, Power: power})
+		}
+
+		// Use Russian roulette to choose between specular reflection, refraction and absorption
+		pReflect := 0.0
+		pRefract := 0.0
+
+		if ii.Mat.ReflectLevel > 0 {
+			pReflect = avgColor(m.Reflect)
+		}
+
+		if ii.Mat.RefractLevel > 0 {
+			pRefract = avgColor(m.Refract)
+
+			if ii.Mat.ReflectLevel > 0 {
+				reflectance := SchlickReflectance(ii)
+				pReflect *= reflectance
+				pRefract *= 1 - reflectance
+			}
+		}
+
+		u := rt.rand()
+
+		if u < pReflect {
+			ray = NewRay(ii.OverPoint, ii.Reflectv)
+			power = power.Blend(m.Reflect).Mul(1 / avgColor(m.Reflect))
+		} else if u < pReflect+pRefract {
+			direction, ok := RefractedDirection(ii)
+
+			if !ok {
+				break // Total internal reflection, which the renderer treats as black too
+			}
+
+			ray = NewRay(ii.UnderPoint, direction.Normalize())
+			power = power.Blend(m.Refract).Mul(1 / avgColor(m.Refract))
+		} else {
+			break // Absorbed
+		}
+	}
+
+	return photons
+}
+
+// BuildCausticsMap shoots photons from all lights and stores those that
+// have been focused by specular surfaces into the caustics photon map
+func (w *World) BuildCausticsMap() {
+	n := w.Options.Photons
+	rt := NewRaytracer(w)
+	photons := []Photon{}
+
+	for _, light := range w.Lights {
+		if emitter, ok := light.(PhotonEmitter); ok {
+			for i := 0; i < n; i++ {
+				ray, power := emitter.EmitPhoton(rt.rand)
+				photons = rt.TracePhoton(light, ray, power.Mul(1/float64(n)), photons)
+			}
+		}
+	}
+
+	w.Caustics = NewPhotonMap(photons)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestPhotonMapGather(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	photons := []Photon{}
+	for i := 0; i < 1000; i++ {
+		photons = append(photons, Photon{Pos: Point(rand(), rand(), rand()), Power: White})
+	}
+
+	// Compute the expected results by brute force before the map shuffles the photons
+	p := Point(0.5, 0.3, 0.6)
+	radius := 0.2
+	expected := 0
+	for _, ph := range photons {
+		if v := p.Sub(ph.Pos); v.Length() < radius {
+			expected++
+		}
+	}
+
+	pm := NewPhotonMap(photons)
+
+	found := 0
+	pm.Gather(p, radius, func(ph *Photon, dist2 float64) {
+		found++
+	})
+
+	if pm.Len() != 1000 || found != expected || found == 0 {
+		t.Errorf("photon gather failed: found %d, expected %d", found, expected)
+	}
+}
+
+func createCausticsWorld() *World {
+	floor := NewPlane()
+
+	ball := NewSphere()
+	ball.SetTransform(Translation(0, 2, 0))
+	ball.SetMaterial(MatGlass())
+
+	world := NewWorld()
+	world.SetAmbient(Gray(0.05))
+	world.AddObjects(floor, ball)
+	world.AddLights(NewPointLight(Point(0, 10, 0), White))
+
+	return world
+}
+
+func TestCaustics(t *testing.T) {
+	world := createCausticsWorld()
+	world.Options.Photons = 200000
+
+	world.BuildCausticsMap()
+
+	if world.Caustics.Len() == 0 {
+		t.Fatalf("no photons stored")
+	}
+
+	up := Vector(0, 1, 0)
+	focus := world.Caustics.Irradiance(Point(0, 0, 0), up, world.Options.PhotonRadius)
+	away := world.Caustics.Irradiance(Point(3, 0, 3), up, world.Options.PhotonRadius)
+
+	// The glass ball focuses the light right under it, where it's much brighter than direct light
+	if focus.R <= 1 || !away.Equals(Black) {
+		t.Errorf("bad caustics: focus=%+v, away=%+v", focus, away)
+	}
+}
+
+func TestCausticsScene(t *testing.T) {
+	TestWithImage(t)
+
+	world := createCausticsWorld()
+	world.Options.Photons = 1000000
+	world.Options.PhotonRadius = 0.08
+	world.Options.TransmissiveShadows = true
+
+	camera := NewCamera(400, 300, Pi/3)
+	camera.SetTransform(EyeViewpoint(Point(0, 5, -7), Point(0, 1, 0), Vector(0, 1, 0)))
+
+	world.RenderToPNG(camera, "test_caustics.png")
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// PhysicalCamera describes a real camera: field of view, depth of field and exposure
+// are derived from its parameters instead of being specified directly
+type PhysicalCamera struct {
+	FocalLength   float64 // Focal length of the lens in millimeters
+	SensorWidth   float64 // Width of the sensor in millimeters, 36 for full frame
+	FNumber       float64 // Ratio between focal length and aperture diameter, zero for a pinhole camera
+	ShutterSpeed  float64 // Exposure time in seconds
+	ISO           float64 // Sensitivity of the sensor
+	MetersPerUnit float64 // Size of one world unit in meters
+}
+
+func NewPhysicalCamera() *PhysicalCamera {
+	return &PhysicalCamera{
+		FocalLength:   50,
+		SensorWidth:   36,
+		FNumber:       0,
+		ShutterSpeed:  1,
+		ISO:           100,
+		MetersPerUnit: 1,
+	}
+}
+
+// FieldOfView returns the field of view along the longer side of the image
+func (p *PhysicalCamera) FieldOfView(aspect float64) float64 {
+	size := p.SensorWidth
+
+	if aspect < 1 {
+		size /= aspect // Portrait, the sensor is taller than wide
+	}
+
+	return 2 * math.Atan(size/(2*p.FocalLength))
+}
+
+// LensRadius returns the radius of the aperture in world units
+func (p *PhysicalCamera) LensRadius() float64 {
+	if p.FNumber <= 0 {
+		return 0
+	}
+
+	return p.FocalLength / (2 * p.FNumber) / 1000 / p.MetersPerUnit
+}
+
+// EV100 returns the exposure value at ISO 100 for the camera settings
+func (p *PhysicalCamera) EV100() float64 {
+	n := p.FNumber
+	if n <= 0 {
+		n = 1 // Exposure still needs a value, assume the lens is fully open
+	}
+
+	return math.Log2(n * n / p.ShutterSpeed * 100 / p.ISO)
+}
+
+// Exposure returns the scale applied to the rendered image: it's one for EV100=0 (f/1, 1 second, ISO 100)
+// and halves for each additional stop, so that lights can be specified in the same relative units
+func (p *PhysicalCamera) Exposure() float64 {
+	return math.Exp2(-p.EV100())
+}
+
+// SetPhysical configures the camera to match a physical camera
+func (c *Camera) SetPhysical(p *PhysicalCamera) {
+	c.Physical = p
+	c.LensRadius = p.LensRadius()
+	c.Exposure = p.Exposure()
+	c.SetViewSize(c.HSize, c.VSize) // Updates the field of view
+}
+
+// AutoFocus sets the focal distance of a camera before rendering, so that a subject is in focus
+type AutoFocus struct {
+	Object string  // If not empty, focus on the center of the object with this name
+	X, Y   float64 // Otherwise focus on what's visible at this point of the image, in [0,1]x[0,1]
+}
+
+// FocusDistance returns the focal distance that puts a point in focus: the depth along the view direction
+// for planar projections, the distance from the camera for the others
+func (c *Camera) FocusDistance(p Tuple) float64 {
+	q := c.Transform().MulT(p)
+
+	if c.Projection == ProjectionPerspective || c.Projection == ProjectionOrthographic {
+		return -q.Z
+	}
+
+	return q.Sub(Point(0, 0, 0)).Length()
+}
+
+// ApplyAutoFocus sets the focal distance of the camera if it has autofocus enabled,
+// it returns false if the subject cannot be found
+func (w *World) ApplyAutoFocus(c *Camera) bool {
+	af := c.AutoFocus
+
+	if af == nil {
+		return true
+	}
+
+	if af.Object != "" {
+		o, m := w.findWithTransform(af.Object)
+
+		if o == nil {
+			return false
+		}
+
+		b := o.Bounds().Transform(m)
+		c.FocalDistance = c.FocusDistance(b.Min.Add(b.Max).Mul(0.5))
+
+		return true
+	}
+
+	ray, ok := c.CameraRay(af.X*float64(c.HSize), af.Y*float64(c.VSize), 0, 0, nil)
+
+	if !ok {
+		return false
+	}
+
+	hit := NewRaytracer(w).Intersect(ray, VisibleToCamera)
+
+	if !hit.Valid() {
+		return false
+	}
+
+	c.FocalDistance = c.FocusDistance(ray.Position(hit.T))
+
+	return true
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestPhysicalCamera(t *testing.T) {
+	p := NewPhysicalCamera()
+	p.FNumber = 2
+
+	if fov := p.FieldOfView(1.5); !FloatEqual(fov, 2*math.Atan(0.36)) {
+		t.Errorf("bad landscape field of view: %f", fov)
+	}
+
+	if fov := p.FieldOfView(0.5); !FloatEqual(fov, 2*math.Atan(0.72)) {
+		t.Errorf("bad portrait field of view: %f", fov)
+	}
+
+	if r := p.LensRadius(); !FloatEqual(r, 0.0125) {
+		t.Errorf("bad lens radius: %f", r)
+	}
+
+	p.MetersPerUnit = 0.01 // Centimeters
+	if r := p.LensRadius(); !FloatEqual(r, 1.25) {
+		t.Errorf("bad lens radius in centimeters: %f", r)
+	}
+
+	// Each stop halves or doubles the exposure
+	p.FNumber = 1
+	if e := p.Exposure(); !FloatEqual(e, 1) {
+		t.Errorf("bad reference exposure: %f", e)
+	}
+
+	p.FNumber = 2
+	p.ISO = 200
+	p.ShutterSpeed = 0.5
+	if e := p.Exposure(); !FloatEqual(e, 0.25) {
+		t.Errorf("bad exposure: %f", e)
+	}
+
+	c := NewCamera(300, 200, 1)
+	c.SetPhysical(p)
+
+	if !FloatEqual(c.FOV, 2*math.Atan(0.36)) || c.LensRadius != p.LensRadius() || c.Exposure != 0.25 {
+		t.Errorf("physical camera not applied: %+v", c)
+	}
+
+	// Field of view follows the aspect ratio
+	c.SetViewSize(200, 400)
+	if !FloatEqual(c.FOV, 2*math.Atan(0.72)) {
+		t.Errorf("field of view not updated: %f", c.FOV)
+	}
+}
+
+func TestApertures(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	// All samples must be inside the hexagon, and cover it up to the corners
+	hexagon := NewBladedAperture(6, 0)
+	apothem := math.Cos(Pi / 6)
+	maxr := 0.0
+
+	for i := 0; i < 1000; i++ {
+		x, y := hexagon.SampleAperture(rand(), rand())
+
+		for k := 0; k < 6; k++ {
+			a := Pi/6 + float64(k)*Pi/3 // Direction of the normal of each side
+			if x*math.Cos(a)+y*math.Sin(a) > apothem+Epsilon {
+				t.Fatalf("sample outside of the hexagon: %f,%f", x, y)
+			}
+		}
+
+		maxr = math.Max(maxr, math.Hypot(x, y))
+	}
+
+	if maxr < 0.9 {
+		t.Errorf("hexagon corners not sampled: %f", maxr)
+	}
+
+	// An image with a single white pixel in the top left corner
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	img.Set(0, 0, color.White)
+
+	a := NewImageAperture(img)
+
+	for i := 0; i < 100; i++ {
+		x, y := a.SampleAperture(rand(), rand())
+
+		// Camera space has +x to the left
+		if x < 0.35 || x > 0.71 || y < 0.35 || y > 0.71 {
+			t.Fatalf("sample outside of the image shape: %f,%f", x, y)
+		}
+	}
+}
+
+func TestAutoFocus(t *testing.T) {
+	s := NewSphere()
+	s.SetName("ball")
+	s.SetTransform(Translation(1, 0, -5))
+
+	w := NewWorld()
+	w.AddObjects(s)
+
+	c := NewCamera(100, 100, Pi/3)
+	c.SetTransform(EyeViewpoint(Point(1, 0, 0), Point(1, 0, -1), Vector(0, 1, 0)))
+
+	c.AutoFocus = &AutoFocus{X: 0.5, Y: 0.5}
+	if !w.ApplyAutoFocus(c) || !FloatEqual(c.FocalDistance, 4) {
+		t.Errorf("bad focus on screen point: %f", c.FocalDistance)
+	}
+
+	c.AutoFocus = &AutoFocus{Object: "ball"}
+	if !w.ApplyAutoFocus(c) || !FloatEqual(c.FocalDistance, 5) {
+		t.Errorf("bad focus on object: %f", c.FocalDistance)
+	}
+
+	// Objects are found inside groups too, at their place in the world
+	g := NewGroup()
+	g.SetTransform(Translation(0, 0, -5))
+	inner := NewSphere()
+	inner.SetName("inner")
+	inner.SetTransform(Translation(1, 0, -5))
+	g.Add(inner)
+	w.AddObjects(g)
+
+	c.AutoFocus = &AutoFocus{Object: "inner"}
+	if !w.ApplyAutoFocus(c) || !FloatEqual(c.FocalDistance, 10) {
+		t.Errorf("bad focus on object in a group: %f", c.FocalDistance)
+	}
+
+	c.AutoFocus = &AutoFocus{Object: "nothing"}
+	if w.ApplyAutoFocus(c) {
+		t.Errorf("focus on a missing object should fail")
+	}
+}
+
+func TestBokehScene(t *testing.T) {
+	TestWithImage(t)
+
+	w := NewWorld()
+	w.SetAmbient(Gray(0.1))
+	w.AddLights(NewPointLight(Point(-5, 5, -5), White))
+
+	subject := NewSphere()
+	subject.SetName("subject")
+	subject.SetTransform(Translation(0, 0, 0))
+	w.AddObjects(subject)
+
+	// Small bright spheres far behind the subject
+	for i := 0; i < 10; i++ {
+		s := NewSphere()
+		s.SetTransform(Translation(float64(i%5)*2-4, float64(i/5)*3-1, 20), Scaling(0.25))
+		s.SetMaterial(NewMaterial().SetAmbient(40))
+		w.AddObjects(s)
+	}
+
+	p := NewPhysicalCamera()
+	p.FocalLength = 85
+	p.FNumber = 1.4
+	p.ShutterSpeed = 1
+	p.ISO = 200
+	p.MetersPerUnit = 0.1
+
+	c := NewCamera(300, 200, 1)
+	c.SetTransform(EyeViewpoint(Point(0, 0, -8), Point(0, 0, 0), Vector(0, 1, 0)))
+	c.SetPhysical(p)
+	c.Aperture = NewBladedAperture(6, 0)
+	c.AutoFocus = &AutoFocus{Object: "subject"}
+
+	w.Options.Supersampling = 8
+	w.RenderToPNG(c, "test_bokeh.png")
+}
@@ -8,14 +8,21 @@ import (
 	"math"
 
 	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/options"
 	. "ascottix/funtracer/textures"
 )
 
 type Raytracer struct {
-	world *World
-	xs    *Intersections
-	ii    *IntersectionInfo
-	rand  FloatGenerator
+	world    *World
+	xs       *Intersections
+	ii       *IntersectionInfo
+	rng      *PCG
+	rand     FloatGenerator // Bound to rng, which is reseeded for each pixel sample
+	sampler  PixelSampler   // Provides the dimensions of the current pixel sample, if set
+	indirect bool           // True while computing indirect illumination
+
+	irradianceMisses *[]irradianceQuery // If set, points missing from the irradiance cache are collected here
+	pixelCache       *IrradianceCache   // If set, the irradiance cache is read-only and new samples are kept here
 }
 
 func NewRaytracer(world *World) *Raytracer {
@@ -23,31 +30,130 @@ func NewRaytracer(world *World) *Raytracer {
 		world: world,
 		xs:    NewIntersections(),
 		ii:    &IntersectionInfo{},
-		rand:  NewRandomGenerator(1),
+		rng:   NewPCG(uint64(world.Options.Seed), 0),
 	}
 
+	rt.rand = rt.rng.Float64
+
 	return &rt
 }
 
+// StartSample reseeds the random numbers for the specified sample of a pixel,
+// so that the result doesn't depend on which pixels have been rendered before
+func (rt *Raytracer) StartSample(x, y, s int) {
+	rt.rng.SeedHash(uint64(rt.world.Options.Seed), uint64(x), uint64(y), uint64(s))
+}
+
+// Sample1d returns the next dimension of the current pixel sample, or a random number if there is no pixel sampler
+func (rt *Raytracer) Sample1d() float64 {
+	if rt.sampler != nil {
+		return rt.sampler.Get1d()
+	}
+
+	return rt.rand()
+}
+
+// Sample2d returns the next two dimensions of the current pixel sample, or random numbers if there is no pixel sampler
+func (rt *Raytracer) Sample2d() (float64, float64) {
+	if rt.sampler != nil {
+		return rt.sampler.Get2d()
+	}
+
+	return rt.rand(), rt.rand()
+}
+
 func (rt *Raytracer) HitForShadow(ray Ray) Intersection {
 	xs := rt.xs
-	xs.Shadows = true // We look only for shadows now
+	xs.Visibility = CastsShadows // We look only for shadows now
+	xs.Prune = false             // Callers may look at all the intersections
 	xs.Reset()
-	for _, o := range rt.world.Objects {
-		o.AddIntersections(ray, xs)
-	}
-	xs.Shadows = false // Reset the shadow flag, as this list will be reused
+	rt.world.addIntersections(ray, xs)
+	xs.Visibility = 0 // Reset the visibility flag, as this list will be reused
 
 	return xs.Hit()
 }
 
+// Occluded returns true if any object that casts shadows is within the extent of the ray,
+// it stops at the first one found so it's much faster than looking for the closest hit
+func (rt *Raytracer) Occluded(ray Ray) bool {
+	xs := rt.xs
+	xs.Visibility = CastsShadows
+	xs.Reset()
+	occluded := rt.world.occludes(ray, xs)
+	xs.Visibility = 0
+
+	return occluded
+}
+
+// ShadowTransmittance returns the fraction of light that travels along a shadow ray for the specified distance:
+// it is white if nothing is in the way, black if an opaque object is in the way, and it is tinted
+// by the refract color of every transparent surface crossed by the ray otherwise
+func (rt *Raytracer) ShadowTransmittance(ray Ray, distance float64) Color {
+	if !rt.world.Options.TransmissiveShadows {
+		ray.TMax = distance
+
+		if rt.Occluded(ray) {
+			return Black
+		}
+
+		return White
+	}
+
+	hit := rt.HitForShadow(ray)
+
+	if !hit.Valid() || hit.T >= distance {
+		return White
+	}
+
+	// Walk all occluders: note that HitForShadow has left the intersections in the list
+	c := White
+
+	for _, x := range rt.xs.L {
+		if x.T < 0 || x.T >= distance {
+			continue
+		}
+
+		m := x.O.Material()
+
+		if m.RefractLevel == 0 {
+			return Black // Opaque, no need to look further
+		}
+
+		c = c.Blend(m.Refract) // Attenuate light every time it crosses a surface
+	}
+
+	return c
+}
+
 func (rt *Raytracer) ShadeHit(ii *IntersectionInfo, depth int) (c Color) {
 	m := ii.Mat
 
-	c = m.DiffuseColor.Blend(rt.world.Ambient.Mul(ii.O.Material().Ambient))
+	if rt.world.IrradianceCache != nil && !rt.indirect {
+		// Indirect diffuse illumination replaces the constant ambient term
+		info := *ii // Need to copy the info locally because computing irradiance will overwrite ii
+		ii = &info
+
+		e := rt.IndirectIrradiance(ii.Point, ii.Normalv)
+		c = m.DiffuseColor.Blend(e).Mul(m.DiffuseLevel / Pi)
+	} else {
+		ambient := rt.world.Ambient.Mul(ii.O.Material().Ambient)
+
+		if options := rt.world.Options; options.AmbientOcclusionSamples > 0 && ambient.IsBlack() == 0 {
+			ambient = ambient.Mul(rt.AmbientOcclusion(ii, options.AmbientOcclusionSamples, options.AmbientOcclusionDistance))
+		}
+
+		c = m.DiffuseColor.Blend(ambient)
+	}
 
 	for _, light := range rt.world.Lights {
-		c = c.Add(light.LightenHit(ii, rt))
+		if light.Illuminates(ii.O) {
+			c = c.Add(light.LightenHit(ii, rt))
+		}
+	}
+
+	if rt.world.Caustics != nil {
+		e := rt.world.Caustics.Irradiance(ii.Point, ii.SurfNormalv, rt.world.Options.PhotonRadius)
+		c = c.Add(m.DiffuseColor.Blend(e).Mul(m.DiffuseLevel))
 	}
 
 	if depth > 0 {
@@ -73,20 +179,31 @@ func (rt *Raytracer) ShadeHit(ii *IntersectionInfo, depth int) (c Color) {
 }
 
 func (rt *Raytracer) ColorForRay(r Ray, depth int) Color {
+	return rt.TraceRay(r, depth, VisibleToCamera)
+}
+
+// Intersect returns the closest hit of a ray, considering only the objects that are visible to the specified kind of ray,
+// all intersections are left in the raytracer intersection list
+func (rt *Raytracer) Intersect(r Ray, kind Visibility) Intersection {
 	xs := rt.xs // Reusing the intersection list greatly reduces memory usage and provides a very significant performance boost
+	xs.Visibility = kind
+	xs.Prune = true // Only the closest hit matters, objects behind it can be skipped
 	xs.Reset()
 
 	// Intersect ray with all objects
-	for _, o := range rt.world.Objects {
-		o.AddIntersections(r, xs)
-	}
+	rt.world.addIntersections(r, xs)
 
-	// Did we hit something?
-	hit := xs.Hit()
+	return xs.Hit()
+}
+
+// TraceRay returns the color seen by a ray, considering only the objects that are visible to the specified kind of ray
+func (rt *Raytracer) TraceRay(r Ray, depth int, kind Visibility) Color {
+	hit := rt.Intersect(r, kind)
 
+	// Did we hit something?
 	if hit.Valid() {
 		ii := rt.ii
-		ii.Update(hit, r, xs)
+		ii.Update(hit, r, rt.xs)
 
 		return rt.ShadeHit(ii, depth)
 	} else {
@@ -95,6 +212,10 @@ func (rt *Raytracer) ColorForRay(r Ray, depth int) Color {
 }
 
 func (rt *Raytracer) ColorAt(ray Ray) Color {
+	if rt.world.Options.Integrator == IntegratorAmbientOcclusion {
+		return rt.AmbientOcclusionColor(ray)
+	}
+
 	return rt.ColorForRay(ray, rt.world.Options.ReflectionDepth)
 }
 
@@ -102,7 +223,7 @@ func (rt *Raytracer) ReflectedColor(ii *IntersectionInfo, depth int) (c Color) {
 	if depth > 0 {
 		reflectedRay := NewRay(ii.OverPoint, ii.Reflectv)
 
-		c = ii.O.Material().Reflect.Blend(rt.ColorForRay(reflectedRay, depth-1))
+		c = ii.O.Material().Reflect.Blend(rt.TraceRay(reflectedRay, depth-1, VisibleInReflections))
 	}
 
 	return c
@@ -110,20 +231,29 @@ func (rt *Raytracer) ReflectedColor(ii *IntersectionInfo, depth int) (c Color) {
 
 func (rt *Raytracer) RefractedColor(ii *IntersectionInfo, depth int) (c Color) {
 	if depth > 0 {
-		// Check for total internal reflection
-		nRatio := ii.N1 / ii.N2
-		cosThetai := ii.Eyev.DotProduct(ii.Normalv)               // θi is the angle of incidence
-		sin2Thetat := nRatio * nRatio * (1 - cosThetai*cosThetai) // sin(θt)^2, where θt is the angle of refraction
-
-		if sin2Thetat <= 1 {
-			cosThetat := math.Sqrt(1 - sin2Thetat)
-			direction := ii.Normalv.Mul(nRatio*cosThetai - cosThetat).Sub(ii.Eyev.Mul(nRatio))
+		if direction, ok := RefractedDirection(ii); ok {
 			refractedRay := NewRay(ii.UnderPoint, direction)
 
-			c = ii.O.Material().Refract.Blend(rt.ColorForRay(refractedRay, depth-1))
+			c = ii.O.Material().Refract.Blend(rt.TraceRay(refractedRay, depth-1, VisibleInRefractions))
 		}
 		// ...else we got total internal reflection
 	}
 
 	return c
 }
+
+// RefractedDirection returns the direction of the refracted ray at the intersection,
+// or false in case of total internal reflection
+func RefractedDirection(ii *IntersectionInfo) (Tuple, bool) {
+	nRatio := ii.N1 / ii.N2
+	cosThetai := ii.Eyev.DotProduct(ii.Normalv)               // θi is the angle of incidence
+	sin2Thetat := nRatio * nRatio * (1 - cosThetai*cosThetai) // sin(θt)^2, where θt is the angle of refraction
+
+	if sin2Thetat > 1 {
+		return Tuple{}, false
+	}
+
+	cosThetat := math.Sqrt(1 - sin2Thetat)
+
+	return ii.Normalv.Mul(nRatio*cosThetai - cosThetat).Sub(ii.Eyev.Mul(nRatio)), true
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	. "ascottix/funtracer/utils"
+)
+
+// ParseCropWindow parses a crop window in the form "x0,y0,x1,y1", where (x0,y0) is the top left corner
+// and (x1,y1) is the bottom right corner (excluded). Values are pixels, or percentages of the view size
+// if followed by '%', e.g. "50%,0,100%,50%". The region is clipped to the view of the camera
+func ParseCropWindow(s string, hsize, vsize int) (image.Rectangle, error) {
+	fields := strings.Split(s, ",")
+
+	if len(fields) != 4 {
+		return image.Rectangle{}, fmt.Errorf("bad crop window '%s', expected x0,y0,x1,y1", s)
+	}
+
+	var v [4]float64 // In pixels
+	size := [4]float64{float64(hsize), float64(vsize), float64(hsize), float64(vsize)}
+
+	for i, f := range fields {
+		f = strings.TrimSpace(f)
+
+		if p := strings.TrimSuffix(f, "%"); p != f {
+			n, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+
+			if err != nil || n < 0 {
+				return image.Rectangle{}, fmt.Errorf("bad crop window '%s'", s)
+			}
+
+			v[i] = n * size[i] / 100
+		} else {
+			n, err := strconv.Atoi(f)
+
+			if err != nil || n < 0 {
+				return image.Rectangle{}, fmt.Errorf("bad crop window '%s'", s)
+			}
+
+			v[i] = float64(n)
+		}
+	}
+
+	// Percentages may fall inside a pixel, take the smallest region that covers them
+	region := image.Rect(int(math.Floor(v[0])), int(math.Floor(v[1])), int(math.Ceil(v[2])), int(math.Ceil(v[3])))
+
+	region = region.Intersect(image.Rect(0, 0, hsize, vsize))
+
+	if region.Empty() {
+		return image.Rectangle{}, fmt.Errorf("crop window '%s' is empty", s)
+	}
+
+	return region, nil
+}
+
+// RenderRegionToCanvas renders a region of the camera view, if the camera is stereo
+// the region is rendered for both eyes and the results are combined into a single canvas
+func (w *World) RenderRegionToCanvas(c *Camera, region image.Rectangle) Canvas {
+	if c.Stereo == StereoNone {
+		w.applyAutoFocusOrWarn(c)
+
+		return w.GoDivisionRenderRegionToCanvas(w.Options.NumThreads, c, region)
+	}
+
+	left, right := w.renderStereoRegion(c, region)
+
+	return CombineStereo(c.Stereo, left, right)
+}
+
+// applyAutoFocusOrWarn applies the autofocus of a camera, if the subject cannot be found
+// the focal distance is left unchanged and a warning is printed, as the render can go on anyway
+func (w *World) applyAutoFocusOrWarn(c *Camera) {
+	if w.ApplyAutoFocus(c) {
+		return
+	}
+
+	if c.AutoFocus.Object != "" {
+		Debugf("*** Warning: cannot find '%s' for autofocus of camera '%s'\n", c.AutoFocus.Object, c.Name())
+	} else {
+		Debugf("*** Warning: nothing to focus on at %g,%g for camera '%s'\n", c.AutoFocus.X, c.AutoFocus.Y, c.Name())
+	}
+}
+
+func (w *World) renderStereoRegion(c *Camera, region image.Rectangle) (left, right Canvas) {
+	w.applyAutoFocusOrWarn(c)
+
+	left = w.GoDivisionRenderRegionToCanvas(w.Options.NumThreads, c.EyeCamera(EyeLeft), region)
+	right = w.GoDivisionRenderRegionToCanvas(w.Options.NumThreads, c.EyeCamera(EyeRight), region)
+
+	return
+}
+
+// OutputSize returns the size of the image rendered by a camera, which depends on the stereo mode
+func (c *Camera) OutputSize() (int, int) {
+	switch c.Stereo {
+	case StereoSideBySide:
+		return c.HSize * 2, c.VSize
+	case StereoOverUnder:
+		return c.HSize, c.VSize * 2
+	}
+
+	return c.HSize, c.VSize
+}
+
+// MergeRegionToImage renders a region of the camera view and draws it over a full size image,
+// which is left unchanged. If base is nil the rest of the image is black
+func (w *World) MergeRegionToImage(c *Camera, region image.Rectangle, base image.Image) (image.Image, error) {
+	hsize, vsize := c.OutputSize()
+
+	img := image.NewRGBA(image.Rect(0, 0, hsize, vsize))
+
+	if base != nil {
+		if base.Bounds().Dx() != hsize || base.Bounds().Dy() != vsize {
+			return nil, errors.New("cannot merge region into an image of different size")
+		}
+
+		draw.Draw(img, img.Bounds(), base, base.Bounds().Min, draw.Src)
+	}
+
+	w.Prepare()
+
+	paste := func(canvas Canvas, r image.Rectangle) {
+		draw.Draw(img, r, canvas.ToImage(w.ErpCanvasToImage), image.Point{}, draw.Src)
+	}
+
+	switch c.Stereo {
+	case StereoSideBySide, StereoOverUnder:
+		// Each eye goes into its own half of the image
+		left, right := w.renderStereoRegion(c, region)
+		offset := image.Pt(c.HSize, 0)
+		if c.Stereo == StereoOverUnder {
+			offset = image.Pt(0, c.VSize)
+		}
+
+		paste(left, region)
+		paste(right, region.Add(offset))
+
+	default:
+		paste(w.RenderRegionToCanvas(c, region), region)
+	}
+
+	return img, nil
+}
+
+// RenderRegionToPNG renders a region of the camera view: if merge is false the image is as large as the region,
+// otherwise the region is merged into the existing file (if any) which must have the size of the full view
+func (w *World) RenderRegionToPNG(c *Camera, region image.Rectangle, filename string, merge bool) error {
+	var img image.Image
+
+	if merge {
+		base, err := loadPNG(filename)
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		img, err = w.MergeRegionToImage(c, region, base)
+
+		if err != nil {
+			return err
+		}
+	} else {
+		w.Prepare()
+
+		img = w.RenderRegionToCanvas(c, region).ToImage(w.ErpCanvasToImage)
+	}
+
+	f, err := os.Create(filename)
+
+	if err == nil {
+		defer f.Close()
+
+		err = png.Encode(f, img)
+	}
+
+	return err
+}
+
+func loadPNG(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return png.Decode(f)
+}
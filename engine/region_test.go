@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"image"
+	"testing"
+)
+
+func TestParseCropWindow(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected image.Rectangle
+	}{
+		{"10,20,30,40", image.Rect(10, 20, 30, 40)},
+		{"0,0,1,1", image.Rect(0, 0, 1, 1)}, // Pixels, even if all values are small
+		{"50%, 0%, 100%, 50%", image.Rect(50, 0, 100, 40)},
+		{"30%,0,70%,40", image.Rect(30, 0, 70, 40)},
+		{"25%,30%,26%,31%", image.Rect(25, 24, 26, 25)}, // Covers the whole window
+		{"90,0,200,200", image.Rect(90, 0, 100, 80)},    // Clipped
+	}
+
+	for _, test := range tests {
+		if r, err := ParseCropWindow(test.s, 100, 80); err != nil || r != test.expected {
+			t.Errorf("crop window '%s' parsed as %v: %v", test.s, r, err)
+		}
+	}
+
+	for _, s := range []string{"", "1,2,3", "a,b,c,d", "-1,0,10,10", "200,0,300,10", "50%,50%,50%,50%", "0.5,0,1,0.5", "%,0,10,10"} {
+		if _, err := ParseCropWindow(s, 100, 80); err == nil {
+			t.Errorf("bad crop window '%s' accepted", s)
+		}
+	}
+}
+
+func TestRenderRegion(t *testing.T) {
+	w, c := createPlaneScene()
+	w.Options.Supersampling = 2
+	w.Options.LensRadius = 0.1
+	w.Options.FocalDistance = 5
+
+	c.SetViewSize(40, 30)
+
+	full := w.GoDivisionRenderToCanvas(2, c)
+	region := image.Rect(11, 7, 30, 20)
+	crop := w.GoDivisionRenderRegionToCanvas(3, c, region)
+
+	if crop.Width != region.Dx() || crop.Height != region.Dy() {
+		t.Fatalf("bad crop size: %dx%d", crop.Width, crop.Height)
+	}
+
+	// The region must be exactly the same as in the full image
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			if full.FastPixelAt(x, y) != crop.FastPixelAt(x-region.Min.X, y-region.Min.Y) {
+				t.Fatalf("pixel %d,%d differs from the full image", x, y)
+			}
+		}
+	}
+
+	// Merging a region keeps the rest of the base image
+	base := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for i := range base.Pix {
+		base.Pix[i] = 255
+	}
+
+	img, err := w.MergeRegionToImage(c, region, base)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := crop.ToImage(w.ErpCanvasToImage)
+
+	if img.At(0, 0) != base.At(0, 0) || img.At(39, 29) != base.At(39, 29) || img.At(11, 7) != expected.At(0, 0) || img.At(29, 19) != expected.At(18, 12) {
+		t.Errorf("region not merged")
+	}
+
+	if _, err := w.MergeRegionToImage(c, region, image.NewRGBA(image.Rect(0, 0, 20, 15))); err == nil {
+		t.Errorf("merging into an image of different size should fail")
+	}
+
+	// Each eye of a side by side stereo camera goes into its half of the image
+	c.Stereo = StereoSideBySide
+	c.Interocular = 0.1
+
+	img, _ = w.MergeRegionToImage(c, region, nil)
+
+	if img.Bounds().Dx() != 80 || img.At(12, 8) == img.At(0, 0) || img.At(52, 8) == img.At(0, 0) || img.At(40, 8) != img.At(0, 0) {
+		t.Errorf("stereo region not merged")
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+
+	. "ascottix/funtracer/maths"
+)
+
+// Low-discrepancy samplers spread samples more evenly than random numbers, so they converge faster.
+// A sample is made of many dimensions: the first two are the position inside the pixel, the others
+// are consumed in order by the camera lens, area lights, hemisphere sampling and so on.
+// Each pixel gets its own randomization of the sequence, so that errors show as noise and not as patterns.
+
+// PixelSampler generates all the samples needed to render a pixel: Next returns the position
+// of a new sample inside the pixel, and Get1d/Get2d return the other dimensions of the same sample
+type PixelSampler interface {
+	Sampler2d
+	StartPixel(x, y int)       // Moves to the first sample of the specified pixel
+	Get1d() float64            // Returns the next dimension of the current sample
+	Get2d() (float64, float64) // Returns the next two dimensions of the current sample
+}
+
+// OneMinusEpsilon is the largest float64 less than one, all samples are clamped to it
+const OneMinusEpsilon = 0x1.fffffffffffffp-1
+
+// RandomPixelSampler adapts a Sampler2d to the PixelSampler interface, using random numbers for all other dimensions
+type RandomPixelSampler struct {
+	Sampler2d
+	rand FloatGenerator
+}
+
+func NewRandomPixelSampler(sampler Sampler2d, rand FloatGenerator) *RandomPixelSampler {
+	return &RandomPixelSampler{sampler, rand}
+}
+
+func (ss *RandomPixelSampler) StartPixel(x, y int) {
+	ss.Reset()
+}
+
+func (ss *RandomPixelSampler) Get1d() float64 {
+	return ss.rand()
+}
+
+func (ss *RandomPixelSampler) Get2d() (float64, float64) {
+	return ss.rand(), ss.rand()
+}
+
+// SequenceSampler implements PixelSampler for sequences where any dimension
+// of any sample can be computed directly from its index
+type SequenceSampler struct {
+	sample    func(index uint64, dim int, seed uint64) float64 // Returns the randomized value of a dimension
+	seed      uint64                                           // Global seed
+	pixelSeed uint64                                           // Different for each pixel
+	index     uint64                                           // Index of the current sample plus one
+	dim       int                                              // Next dimension to return
+}
+
+func (ss *SequenceSampler) StartPixel(x, y int) {
+	ss.pixelSeed = Hash(ss.seed, uint64(x), uint64(y))
+	ss.Reset()
+}
+
+func (ss *SequenceSampler) Reset() {
+	ss.index = 0
+}
+
+func (ss *SequenceSampler) Next() (float64, float64) {
+	ss.index++
+	ss.dim = 0
+
+	return ss.Get2d()
+}
+
+func (ss *SequenceSampler) Get1d() float64 {
+	dim := ss.dim
+	ss.dim++
+
+	return ss.sample(ss.index-1, dim, ss.pixelSeed)
+}
+
+func (ss *SequenceSampler) Get2d() (float64, float64) {
+	// Keep the pairs aligned, as some sequences are well distributed only in pairs of dimensions
+	ss.dim += ss.dim & 1
+
+	return ss.Get1d(), ss.Get1d()
+}
+
+// Halton sequence
+
+// HaltonMaxDimension is the number of prime bases used, higher dimensions reuse the same bases with different scrambling
+const HaltonMaxDimension = 256
+
+var haltonPrimes []uint64
+var haltonOnce sync.Once
+
+func initHaltonPrimes() {
+	for n := uint64(2); len(haltonPrimes) < HaltonMaxDimension; n++ {
+		prime := true
+
+		for _, p := range haltonPrimes {
+			if p*p > n {
+				break
+			}
+
+			if n%p == 0 {
+				prime = false
+				break
+			}
+		}
+
+		if prime {
+			haltonPrimes = append(haltonPrimes, n)
+		}
+	}
+}
+
+// ScrambledRadicalInverse mirrors the digits of a in the specified base around the decimal point,
+// each digit is shifted by a random amount that depends on the previous digits (nested scrambling)
+func ScrambledRadicalInverse(base, a, seed uint64) float64 {
+	invBase := 1 / float64(base)
+	invBaseM := 1.0
+	reversed := uint64(0)
+	prefix := seed
+
+	// Also scramble the leading zeros, until the precision of float64 is exhausted
+	for limit := uint64(1); limit < 1<<52; limit *= base {
+		digit := a % base
+		a /= base
+
+		reversed = reversed*base + (digit+MixBits(prefix)%base)%base
+		invBaseM *= invBase
+		prefix = Hash(prefix, digit)
+	}
+
+	return math.Min(float64(reversed)*invBaseM, OneMinusEpsilon)
+}
+
+// NewHaltonSampler returns a sampler based on the Halton sequence, where dimension i
+// is the radical inverse of the sample index in the base of the i-th prime number
+func NewHaltonSampler(seed uint64) *SequenceSampler {
+	haltonOnce.Do(initHaltonPrimes)
+
+	return &SequenceSampler{
+		seed: seed,
+		sample: func(index uint64, dim int, seed uint64) float64 {
+			return ScrambledRadicalInverse(haltonPrimes[dim%HaltonMaxDimension], index, Hash(seed, uint64(dim)))
+		},
+	}
+}
+
+// Sobol sequence
+
+// SobolMaxDimension is the number of dimensions of the Sobol sequence, higher dimensions are padded
+// with copies of the sequence scrambled differently
+const SobolMaxDimension = 64
+
+var sobolMatrices [][32]uint32
+var sobolOnce sync.Once
+
+// sobolDirections are the primitive polynomials (degree s and coefficients a) and the initial direction numbers m
+// of the dimensions after the first, as in the new-joe-kuo-6.21201 table of: Stephen Joe, Frances Kuo
+// "Constructing Sobol sequences with better two-dimensional projections" (2008)
+var sobolDirections = []struct {
+	s, a uint
+	m    []uint32
+}{
+	{1, 0, []uint32{1}},
+	{2, 1, []uint32{1, 3}},
+	{3, 1, []uint32{1, 3, 1}},
+	{3, 2, []uint32{1, 1, 1}},
+	{4, 1, []uint32{1, 1, 3, 3}},
+	{4, 4, []uint32{1, 3, 5, 13}},
+	{5, 2, []uint32{1, 1, 5, 5, 17}},
+	{5, 4, []uint32{1, 1, 5, 5, 5}},
+	{5, 7, []uint32{1, 1, 7, 11, 19}},
+	{5, 11, []uint32{1, 1, 5, 1, 1}},
+	{5, 13, []uint32{1, 1, 1, 3, 11}},
+	{5, 14, []uint32{1, 3, 5, 5, 31}},
+	{6, 1, []uint32{1, 3, 3, 9, 7, 49}},
+	{6, 13, []uint32{1, 1, 1, 15, 21, 21}},
+	{6, 16, []uint32{1, 3, 1, 13, 27, 49}},
+	{6, 19, []uint32{1, 1, 1, 15, 7, 5}},
+	{6, 22, []uint32{1, 3, 1, 15, 13, 25}},
+	{6, 25, []uint32{1, 1, 5, 5, 19, 61}},
+	{7, 1, []uint32{1, 3, 7, 11, 23, 15, 103}},
+	{7, 4, []uint32{1, 3, 7, 13, 13, 15, 69}},
+	{7, 7, []uint32{1, 1, 3, 13, 7, 35, 63}},
+	{7, 8, []uint32{1, 3, 5, 9, 1, 25, 53}},
+	{7, 14, []uint32{1, 3, 1, 13, 9, 35, 107}},
+	{7, 19, []uint32{1, 3, 1, 5, 27, 61, 31}},
+	{7, 21, []uint32{1, 1, 5, 11, 19, 41, 61}},
+	{7, 28, []uint32{1, 3, 5, 3, 3, 13, 69}},
+	{7, 31, []uint32{1, 1, 7, 13, 1, 19, 1}},
+	{7, 32, []uint32{1, 3, 7, 5, 13, 19, 59}},
+	{7, 37, []uint32{1, 1, 3, 9, 25, 29, 41}},
+	{7, 41, []uint32{1, 3, 5, 13, 23, 1, 55}},
+	{7, 42, []uint32{1, 3, 7, 3, 13, 59, 17}},
+	{7, 50, []uint32{1, 3, 1, 3, 5, 53, 69}},
+	{7, 55, []uint32{1, 1, 5, 5, 23, 33, 13}},
+	{7, 56, []uint32{1, 1, 7, 7, 1, 61, 123}},
+	{7, 59, []uint32{1, 1, 7, 9, 13, 61, 49}},
+	{7, 62, []uint32{1, 3, 3, 5, 3, 55, 33}},
+	{8, 14, []uint32{1, 3, 1, 15, 31, 13, 49, 245}},
+	{8, 21, []uint32{1, 3, 5, 15, 31, 59, 63, 97}},
+	{8, 22, []uint32{1, 3, 1, 11, 11, 11, 77, 249}},
+	{8, 38, []uint32{1, 3, 1, 11, 27, 43, 71, 9}},
+	{8, 47, []uint32{1, 1, 7, 15, 21, 11, 81, 45}},
+	{8, 49, []uint32{1, 3, 7, 3, 25, 31, 65, 79}},
+	{8, 50, []uint32{1, 3, 1, 1, 19, 11, 3, 205}},
+	{8, 52, []uint32{1, 1, 5, 9, 19, 21, 29, 157}},
+	{8, 56, []uint32{1, 3, 7, 11, 1, 33, 89, 185}},
+	{8, 67, []uint32{1, 3, 3, 3, 15, 9, 79, 71}},
+	{8, 70, []uint32{1, 3, 7, 11, 15, 39, 119, 27}},
+	{8, 84, []uint32{1, 1, 3, 1, 11, 31, 97, 225}},
+	{8, 97, []uint32{1, 1, 1, 3, 23, 43, 57, 177}},
+	{8, 103, []uint32{1, 3, 7, 7, 17, 17, 37, 71}},
+	{8, 115, []uint32{1, 3, 1, 5, 27, 63, 123, 213}},
+	{8, 122, []uint32{1, 1, 3, 5, 11, 43, 53, 133}},
+	{9, 8, []uint32{1, 3, 5, 5, 29, 17, 47, 173, 479}},
+	{9, 13, []uint32{1, 3, 3, 11, 3, 1, 109, 9, 69}},
+	{9, 16, []uint32{1, 1, 1, 5, 17, 39, 23, 5, 343}},
+	{9, 22, []uint32{1, 3, 1, 5, 25, 15, 31, 103, 499}},
+	{9, 25, []uint32{1, 1, 1, 11, 11, 17, 63, 105, 183}},
+	{9, 44, []uint32{1, 1, 5, 11, 9, 29, 97, 231, 363}},
+	{9, 47, []uint32{1, 1, 5, 15, 19, 45, 41, 7, 383}},
+	{9, 52, []uint32{1, 3, 7, 7, 31, 19, 83, 137, 221}},
+	{9, 55, []uint32{1, 1, 1, 3, 23, 15, 111, 223, 83}},
+	{9, 59, []uint32{1, 1, 5, 13, 31, 15, 55, 25, 161}},
+	{9, 62, []uint32{1, 1, 3, 13, 25, 47, 39, 87, 257}},
+}
+
+// initSobolMatrices computes the direction numbers of the Sobol sequence: the first dimension is the
+// van der Corput sequence, the others are built from the polynomials and initial numbers of sobolDirections
+func initSobolMatrices() {
+	var v [32]uint32
+	for k := range v {
+		v[k] = 1 << uint(31-k)
+	}
+	sobolMatrices = append(sobolMatrices, v)
+
+	for _, d := range sobolDirections[:SobolMaxDimension-1] {
+		degree := int(d.s)
+		p := uint64(1)<<d.s | uint64(d.a)<<1 | 1
+
+		m := make([]uint32, 33)
+		copy(m[1:], d.m)
+
+		for k := degree + 1; k <= 32; k++ {
+			m[k] = m[k-degree] ^ m[k-degree]<<uint(degree)
+
+			for j := 1; j < degree; j++ {
+				if p&(1<<uint(degree-j)) != 0 {
+					m[k] ^= m[k-j] << uint(j)
+				}
+			}
+		}
+
+		for k := 1; k <= 32; k++ {
+			v[k-1] = m[k] << uint(32-k)
+		}
+		sobolMatrices = append(sobolMatrices, v)
+	}
+}
+
+func sobolSample(index uint32, dim int) uint32 {
+	v := uint32(0)
+
+	for m := &sobolMatrices[dim]; index != 0; index &= index - 1 {
+		v ^= m[bits.TrailingZeros32(index)]
+	}
+
+	return v
+}
+
+// owenScramble randomly permutes the bits of v so that each bit is flipped depending on the bits above it,
+// which preserves the stratification of the sequences, see:
+// Brent Burley, "Practical Hash-based Owen Scrambling"
+func owenScramble(v uint32, seed uint64) uint32 {
+	s := uint32(seed)
+	v = bits.Reverse32(v)
+	v ^= v * 0x3d20adea
+	v += s
+	v *= (s >> 16) | 1
+	v ^= v * 0x05526c56
+	v ^= v * 0x53a22864
+
+	return bits.Reverse32(v)
+}
+
+func toUnitFloat(v uint32) float64 {
+	return math.Min(float64(v)*0x1p-32, OneMinusEpsilon)
+}
+
+// NewSobolSampler returns a sampler based on the Sobol sequence, Owen-scrambled for each pixel
+func NewSobolSampler(seed uint64) *SequenceSampler {
+	sobolOnce.Do(initSobolMatrices)
+
+	return &SequenceSampler{
+		seed: seed,
+		sample: func(index uint64, dim int, seed uint64) float64 {
+			// Shuffling the order of the samples keeps the pixels independent
+			i := owenScramble(uint32(index), seed)
+
+			return toUnitFloat(owenScramble(sobolSample(i, dim%SobolMaxDimension), Hash(seed, uint64(dim))))
+		},
+	}
+}
+
+// Progressive multi-jittered (0,2) sequences
+
+// NewPMJ02Sampler returns a sampler that uses a different progressive multi-jittered (0,2) sequence
+// for each pair of dimensions: every prefix of 2^n samples is stratified in all the 2^n elementary
+// intervals, thus also in both dimensions separately. Christensen et al. build these sequences by
+// placing points one at a time, but Owen-scrambling the first two dimensions of the Sobol sequence
+// yields the same distribution, see: Helmer et al., "Stochastic Generation of (t, s) Sample Sequences"
+func NewPMJ02Sampler(seed uint64) *SequenceSampler {
+	sobolOnce.Do(initSobolMatrices)
+
+	return &SequenceSampler{
+		seed: seed,
+		sample: func(index uint64, dim int, seed uint64) float64 {
+			seed = Hash(seed, uint64(dim/2))
+			i := owenScramble(uint32(index), seed) // Decorrelate the pairs of dimensions
+
+			return toUnitFloat(owenScramble(sobolSample(i, dim&1), Hash(seed, uint64(dim&1))))
+		},
+	}
+}
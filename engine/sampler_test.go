@@ -0,0 +1,261 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/options"
+)
+
+// polyMulMod multiplies two polynomials over GF(2) modulo the polynomial p of the specified degree
+func polyMulMod(a, b, p uint64, degree int) uint64 {
+	r := uint64(0)
+
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			r ^= a
+		}
+
+		a <<= 1
+		if a&(1<<uint(degree)) != 0 {
+			a ^= p
+		}
+	}
+
+	return r
+}
+
+// isPrimitive checks whether the polynomial p over GF(2) is primitive, i.e. if x generates all the 2^degree-1 nonzero residues
+func isPrimitive(p uint64, degree int) bool {
+	if p&1 == 0 {
+		return false
+	}
+
+	order := uint64(1)<<uint(degree) - 1
+
+	powx := func(e uint64) uint64 {
+		r, x := uint64(1), uint64(2)%p
+		if degree == 1 {
+			x = 1 // Modulo x+1, x is the same as 1
+		}
+
+		for ; e != 0; e >>= 1 {
+			if e&1 != 0 {
+				r = polyMulMod(r, x, p, degree)
+			}
+			x = polyMulMod(x, x, p, degree)
+		}
+
+		return r
+	}
+
+	if powx(order) != 1 {
+		return false
+	}
+
+	// The order of x must not be a proper divisor of 2^degree-1
+	n := order
+	for q := uint64(2); q*q <= n; q++ {
+		if n%q == 0 {
+			if powx(order/q) == 1 {
+				return false
+			}
+
+			for n%q == 0 {
+				n /= q
+			}
+		}
+	}
+
+	return n == 1 || powx(order/n) != 1
+}
+
+func TestSobolMatrices(t *testing.T) {
+	sobolOnce.Do(initSobolMatrices)
+
+	// The first two dimensions are fixed, and all dimensions must be (0,1)-sequences
+	expected := []uint32{0, 0x80000000, 0x40000000, 0xc0000000, 0x20000000, 0xa0000000, 0x60000000, 0xe0000000}
+	expected1 := []uint32{0, 0x80000000, 0xc0000000, 0x40000000, 0xa0000000, 0x20000000, 0x60000000, 0xe0000000}
+
+	for i := range expected {
+		if v := sobolSample(uint32(i), 0); v != expected[i] {
+			t.Errorf("bad sample %d in dimension 0: %x", i, v)
+		}
+		if v := sobolSample(uint32(i), 1); v != expected1[i] {
+			t.Errorf("bad sample %d in dimension 1: %x", i, v)
+		}
+	}
+
+	// The third dimension, as in any implementation of the sequence
+	expected2 := []uint32{0, 0x80000000, 0xc0000000, 0x40000000, 0x60000000, 0xe0000000, 0xa0000000, 0x20000000}
+
+	for i := range expected2 {
+		if v := sobolSample(uint32(i), 2); v != expected2[i] {
+			t.Errorf("bad sample %d in dimension 2: %x", i, v)
+		}
+	}
+
+	// The table must have distinct primitive polynomials, and odd initial numbers less than 2^k
+	polynomials := map[uint64]bool{}
+
+	for i, d := range sobolDirections {
+		p := uint64(1)<<d.s | uint64(d.a)<<1 | 1
+
+		if !isPrimitive(p, int(d.s)) || polynomials[p] || len(d.m) != int(d.s) {
+			t.Errorf("bad polynomial for dimension %d", i+1)
+		}
+
+		polynomials[p] = true
+
+		for k, m := range d.m {
+			if m&1 == 0 || m >= 2<<uint(k) {
+				t.Errorf("bad direction number %d for dimension %d", k+1, i+1)
+			}
+		}
+	}
+
+	for dim := 0; dim < SobolMaxDimension; dim++ {
+		strata := map[uint32]bool{}
+		for i := uint32(0); i < 64; i++ {
+			strata[sobolSample(i, dim)>>26] = true
+		}
+
+		if len(strata) != 64 {
+			t.Errorf("dimension %d is not stratified", dim)
+		}
+	}
+}
+
+func TestPixelSamplers(t *testing.T) {
+	const count = 64
+
+	for _, name := range []string{SamplerHalton, SamplerSobol, SamplerPMJ02} {
+		w := NewWorld()
+		w.Options.Sampler = name
+		s := w.getPixelSampler(nil)
+
+		// Integrate some functions in the dimensions used for pixel position, lens and light
+		s.StartPixel(3, 5)
+		sumxy, sumuv, sumxu, sumr := 0.0, 0.0, 0.0, 0.0
+		strata := map[int]bool{}
+
+		for i := 0; i < count; i++ {
+			x, y := s.Next()
+			u, v := s.Get2d()
+			r := s.Get1d()
+
+			for _, f := range []float64{x, y, u, v, r} {
+				if f < 0 || f >= 1 {
+					t.Fatalf("%s: sample out of range: %f", name, f)
+				}
+			}
+
+			strata[int(x*count)] = true
+			sumxy += x * y
+			sumuv += u * v
+			sumxu += x * u
+			sumr += r
+		}
+
+		for _, e := range []float64{sumxy / count, sumuv / count} {
+			if math.Abs(e-0.25) > 0.01 {
+				t.Errorf("%s: bad estimate %f, expected 0.25", name, e)
+			}
+		}
+
+		// Padded samplers are only stratified in pairs of dimensions, so allow a larger error
+		if e := sumxu / count; math.Abs(e-0.25) > 0.03 {
+			t.Errorf("%s: bad estimate %f, expected 0.25", name, e)
+		}
+
+		if math.Abs(sumr/count-0.5) > 0.01 {
+			t.Errorf("%s: bad estimate %f, expected 0.5", name, sumr/count)
+		}
+
+		if name != SamplerHalton && len(strata) != count {
+			t.Errorf("%s: pixel positions are not stratified", name)
+		}
+
+		// Each pixel gets a different sequence, but the same pixel always gets the same sequence
+		s.StartPixel(3, 5)
+		x0, y0 := s.Next()
+		s.StartPixel(4, 5)
+		x1, y1 := s.Next()
+		s.StartPixel(3, 5)
+		x2, y2 := s.Next()
+
+		if (x0 == x1 && y0 == y1) || x0 != x2 || y0 != y2 {
+			t.Errorf("%s: bad pixel randomization", name)
+		}
+	}
+}
+
+func TestSobolConvergence(t *testing.T) {
+	const pixels, spp = 64, 64
+
+	// The integral of this function over the 6 dimensions used for pixel position, lens and light is 1
+	f := func(x ...float64) float64 {
+		r := 0.0
+		for i := 0; i < len(x); i += 2 {
+			r += Pi * Pi / 4 * math.Sin(Pi*x[i]) * math.Sin(Pi*x[i+1])
+		}
+
+		return r / float64(len(x)/2)
+	}
+
+	// Root mean square error of the estimates of many pixels
+	rmse := func(sampler string) float64 {
+		w := NewWorld()
+		w.Options.Sampler = sampler
+		w.Options.Supersampling = 8
+		s := w.getPixelSampler(NewRandomGenerator(1))
+
+		sum := 0.0
+
+		for p := 0; p < pixels; p++ {
+			s.StartPixel(p, 0)
+			e := 0.0
+
+			for i := 0; i < spp; i++ {
+				x, y := s.Next()
+				u, v := s.Get2d()
+				r1, r2 := s.Get1d(), s.Get1d()
+				e += f(x, y, u, v, r1, r2)
+			}
+
+			sum += Square(e/spp - 1)
+		}
+
+		return math.Sqrt(sum / pixels)
+	}
+
+	stratified, sobol := rmse(SamplerStratified), rmse(SamplerSobol)
+
+	if sobol > stratified/2 {
+		t.Errorf("Sobol error %f should be much less than stratified error %f", sobol, stratified)
+	}
+}
+
+func TestScrambledRadicalInverse(t *testing.T) {
+	// Scrambling preserves stratification
+	for _, base := range []uint64{2, 3, 5} {
+		strata := map[int]bool{}
+
+		for i := uint64(0); i < base*base; i++ {
+			strata[int(ScrambledRadicalInverse(base, i, 42)*float64(base*base))] = true
+		}
+
+		if len(strata) != int(base*base) {
+			t.Errorf("base %d is not stratified", base)
+		}
+	}
+
+	if ScrambledRadicalInverse(2, 1, 1) == ScrambledRadicalInverse(2, 1, 2) {
+		t.Errorf("seed is ignored")
+	}
+}
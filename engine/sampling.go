@@ -0,0 +1,56 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+)
+
+// OrthonormalBasis returns two vectors that together with the normal n form an orthonormal basis,
+// see: https://graphics.pixar.com/library/OrthonormalB/paper.pdf
+func OrthonormalBasis(n Tuple) (t, b Tuple) {
+	sign := math.Copysign(1, n.Z)
+	a := -1 / (sign + n.Z)
+	c := n.X * n.Y * a
+
+	t = Vector(1+sign*n.X*n.X*a, sign*c, -sign*n.X)
+	b = Vector(c, sign+n.Y*n.Y*a, -n.Y)
+
+	return
+}
+
+// UniformSampleSphere converts samples from [0,1)x[0,1) into a direction uniformly distributed on the unit sphere
+func UniformSampleSphere(u, v float64) Tuple {
+	z := 1 - 2*u
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * Pi * v
+
+	return Vector(r*math.Cos(phi), r*math.Sin(phi), z)
+}
+
+// UniformSampleCone converts samples from [0,1)x[0,1) into a direction uniformly distributed
+// inside the cone around the axis n, where cosMax is the cosine of the cone half-angle
+func UniformSampleCone(u, v, cosMax float64, n Tuple) Tuple {
+	cosTheta := 1 - u*(1-cosMax)
+	sinTheta := math.Sqrt(math.Max(0, 1-cosTheta*cosTheta))
+	phi := 2 * Pi * v
+
+	t, b := OrthonormalBasis(n)
+
+	return t.Mul(sinTheta * math.Cos(phi)).Add(b.Mul(sinTheta * math.Sin(phi))).Add(n.Mul(cosTheta))
+}
+
+// CosineSampleHemisphere converts samples from [0,1)x[0,1) into a direction in the hemisphere around
+// the normal n, with a density proportional to the cosine of the angle with the normal (Malley's method)
+func CosineSampleHemisphere(u, v float64, n Tuple) Tuple {
+	x, y := ConcentricSampleDisk(u, v)
+	z := math.Sqrt(math.Max(0, 1-x*x-y*y))
+
+	t, b := OrthonormalBasis(n)
+
+	return t.Mul(x).Add(b.Mul(y)).Add(n.Mul(z))
+}
@@ -5,14 +5,21 @@
 package engine
 
 import (
+	"fmt"
+	"strings"
+
 	. "ascottix/funtracer/maths"
 	. "ascottix/funtracer/options"
 )
 
+// AllCameras selects all the cameras of a scene
+const AllCameras = "all"
+
 type Scene struct {
-	Name   string
-	World  *World
-	Camera *Camera
+	Name    string
+	World   *World
+	Camera  *Camera   // Main camera, i.e. the first one added to the scene
+	Cameras []*Camera // All cameras, in order of definition
 }
 
 func NewScene() *Scene {
@@ -20,20 +27,84 @@ func NewScene() *Scene {
 		"",
 		NewWorld(),
 		nil,
+		nil,
+	}
+}
+
+// AddCamera adds a camera to the scene, cameras without a name are named after their position
+func (s *Scene) AddCamera(c *Camera) {
+	if c.Name() == "" {
+		c.SetName(fmt.Sprintf("camera%d", len(s.Cameras)+1))
+	}
+
+	if s.Camera == nil {
+		s.Camera = c
+	}
+
+	s.Cameras = append(s.Cameras, c)
+}
+
+func (s *Scene) FindCamera(name string) *Camera {
+	for _, c := range s.Cameras {
+		if c.Name() == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// SelectCameras returns the cameras in a comma separated list of names:
+// an empty list selects the main camera, while "all" selects all cameras
+func (s *Scene) SelectCameras(names string) ([]*Camera, error) {
+	names = strings.TrimSpace(names)
+
+	switch names {
+	case "":
+		return []*Camera{s.Camera}, nil
+	case AllCameras:
+		return s.Cameras, nil
+	}
+
+	var cameras []*Camera
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		c := s.FindCamera(name)
+
+		if c == nil {
+			return nil, fmt.Errorf("camera '%s' not found", name)
+		}
+
+		cameras = append(cameras, c)
 	}
+
+	return cameras, nil
 }
 
 func (s *Scene) SyncOptions(options *Options) {
 	s.World.SetOptions(options)
 
 	if s.Camera == nil {
-		s.Camera = NewCamera(0, 0, Pi/2)
+		s.AddCamera(NewCamera(0, 0, Pi/2))
+	}
+
+	for _, c := range s.Cameras {
+		syncCameraViewSize(c, options)
 	}
 
+	// Report the size of the main camera, unless each camera may have its own
+	if len(s.Cameras) == 1 {
+		options.OutWidth = s.Camera.HSize
+		options.OutHeight = s.Camera.VSize
+	}
+}
+
+func syncCameraViewSize(c *Camera, options *Options) {
 	// Sync camera view size: user-specified has precedence, then scene file, then hardcoded defaults
 	w := options.OutWidth
 	if w == 0 {
-		w = s.Camera.HSize
+		w = c.HSize
 		if w == 0 {
 			w = 400
 		}
@@ -41,14 +112,11 @@ func (s *Scene) SyncOptions(options *Options) {
 
 	h := options.OutHeight
 	if h == 0 {
-		h = s.Camera.VSize
+		h = c.VSize
 		if h == 0 {
 			h = 225
 		}
 	}
 
-	s.Camera.SetViewSize(w, h)
-
-	options.OutWidth = w
-	options.OutHeight = h
+	c.SetViewSize(w, h)
 }
@@ -0,0 +1,217 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestSdfSphere(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	// A distance field sphere must be the same as a sphere
+	sphere := NewSphere()
+	sdf := NewSdfShape(SdfSphere(1), NewBox(Point(-1, -1, -1), Point(1, 1, 1)))
+
+	for i := 0; i < 200; i++ {
+		r := NewRay(Point(rand()*4-2, rand()*4-2, -5), Vector(rand()-0.5, rand()-0.5, rand()+0.5))
+
+		xs1 := sphere.Shapable().LocalIntersect(r)
+		xs2 := sdf.Shapable().LocalIntersect(r)
+
+		if len(xs1) == 2 && xs1[1]-xs1[0] < 0.1 {
+			continue // Grazing ray, may or may not hit
+		}
+
+		if len(xs1) != len(xs2) {
+			t.Fatalf("ray %d: sdf intersections %v should be %v", i, xs2, xs1)
+		}
+
+		for j := range xs1 {
+			if math.Abs(xs1[j]-xs2[j]) > 1e-5 {
+				t.Errorf("ray %d: sdf intersections %v should be %v", i, xs2, xs1)
+			}
+		}
+
+		if len(xs1) > 0 {
+			p := r.Position(xs1[0])
+
+			if n1, n2 := sphere.NormalAt(p), sdf.NormalAt(p); n1.Sub(n2).Length() > 1e-4 {
+				t.Errorf("ray %d: sdf normal %v should be %v", i, n2, n1)
+			}
+		}
+	}
+
+	// Rays from inside hit behind the origin as well
+	xs := sdf.Shapable().LocalIntersect(NewRay(Point(0, 0, 0), Vector(0, 0, 2)))
+
+	if len(xs) != 2 || math.Abs(xs[0]+0.5) > 1e-5 || math.Abs(xs[1]-0.5) > 1e-5 {
+		t.Errorf("sdf intersections from inside %v should be [-0.5 0.5]", xs)
+	}
+}
+
+func TestSdfOperators(t *testing.T) {
+	a := SdfTransform(SdfSphere(1), Translation(-1.2, 0, 0))
+	b := SdfTransform(SdfSphere(1), Translation(+1.2, 0, 0))
+	p := Point(0, 0.3, 0) // Between the spheres
+
+	if d := SdfUnion(a, b)(p); d <= 0 {
+		t.Errorf("union should not contain %v: %v", p, d)
+	}
+
+	if d := SdfSmoothUnion(a, b, 1)(p); d >= 0 {
+		t.Errorf("smooth union should contain %v: %v", p, d)
+	}
+
+	if d := SdfIntersection(a, b)(Point(0, 0, 0)); !FloatEqual(d, 0.2) {
+		t.Errorf("intersection distance is %v", d)
+	}
+
+	if d := SdfSmoothIntersection(a, b, 0.5)(Point(0, 0, 0)); d <= 0.2 {
+		t.Errorf("smooth intersection should shrink: %v", d)
+	}
+
+	if d := SdfSubtraction(a, b)(Point(-0.1, 0, 0)); !FloatEqual(d, 0.1) {
+		t.Errorf("subtraction distance is %v", d)
+	}
+
+	if d := SdfSmoothSubtraction(a, b, 0.5)(Point(-0.5, 0, 0)); d <= SdfSubtraction(a, b)(Point(-0.5, 0, 0)) {
+		t.Errorf("smooth subtraction should carve more: %v", d)
+	}
+
+	if d := SdfBox(Vector(1, 2, 3), 0)(Point(2, 0, 0)); !FloatEqual(d, 1) {
+		t.Errorf("box distance is %v", d)
+	}
+
+	if d := SdfScale(SdfSphere(1), 2)(Point(3, 0, 0)); !FloatEqual(d, 1) {
+		t.Errorf("scaled sphere distance is %v", d)
+	}
+
+	// A box twisted by a quarter turn at half its height
+	twisted := SdfTwist(SdfBox(Vector(1, 1, 0.1), 0), Pi)
+
+	if d := twisted(Point(0, 0.5, 0.9)); d >= 0 {
+		t.Errorf("twisted box should contain the top at z=0.9: %v", d)
+	}
+
+	if d := twisted(Point(0, 0, 0.9)); d <= 0 {
+		t.Errorf("twisted box should not contain the middle at z=0.9: %v", d)
+	}
+
+	// A bar bent along its length leaves the x axis
+	bent := SdfBend(SdfBox(Vector(2, 0.1, 0.1), 0), 0.5)
+
+	if d := bent(Point(0, 0, 0)); d >= 0 {
+		t.Errorf("bent bar should contain its center: %v", d)
+	}
+
+	if d := bent(Point(1, 0, 0)); d <= 0 {
+		t.Errorf("bent bar should not contain the straight bar at x=1: %v", d)
+	}
+}
+
+func TestSdfRepeat(t *testing.T) {
+	// An infinite grid of spheres, the bounds are infinite too
+	grid := NewSdfShape(SdfRepeat(SdfSphere(0.5), Vector(2, 0, 2)), NewBox(Point(math.Inf(-1), -0.5, math.Inf(-1)), Point(math.Inf(+1), 0.5, math.Inf(+1))))
+
+	for _, x := range []float64{0, 2, 10, 100, -52} {
+		xs := NewIntersections()
+		grid.AddIntersections(NewRay(Point(x, 5, 0), Vector(0, -1, 0)), xs)
+
+		if hit := xs.Hit(); !hit.Valid() || math.Abs(hit.T-4.5) > 1e-5 {
+			t.Errorf("sphere at x=%v not hit: %+v", x, hit)
+		}
+	}
+
+	// Thru the gaps
+	if xs := grid.Shapable().LocalIntersect(NewRay(Point(1, 5, 1), Vector(0, -1, 0))); len(xs) != 0 {
+		t.Errorf("gap should not be hit: %v", xs)
+	}
+
+	// Along a row, the ray crosses spheres until the maximum distance
+	xs := grid.Shapable().LocalIntersect(NewRay(Point(-1, 0, 0), Vector(1, 0, 0)))
+
+	if len(xs) < 10 || math.Abs(xs[0]-0.5) > 1e-5 || math.Abs(xs[1]-1.5) > 1e-5 || math.Abs(xs[2]-2.5) > 1e-5 {
+		t.Errorf("row of spheres not hit: %v", xs)
+	}
+}
+
+func TestSdfTwistLipschitz(t *testing.T) {
+	rand := NewRandomGenerator(2)
+
+	// The twisted box is not a true distance, all surface crossings must be found anyway
+	f := SdfTwist(SdfBox(Vector(1, 2, 0.2), 0.05), 1.5)
+	s := NewSdfShape(f, NewBox(Point(-1.2, -2, -1.2), Point(1.2, 2, 1.2)))
+	s.Shapable().(*SdfShape).Lipschitz = 2.5 // About sqrt(1 + (k*r)^2) for the twist k and the radius r
+
+	for i := 0; i < 200; i++ {
+		r := NewRay(Point(rand()*2-1, rand()*4-2, -3), Vector(rand()*0.2-0.1, rand()*0.2-0.1, 1))
+
+		xs := s.Shapable().LocalIntersect(r)
+
+		if len(xs)%2 != 0 {
+			t.Errorf("ray %d: odd number of crossings %v", i, xs)
+		}
+
+		for _, x := range xs {
+			if d := f(r.Position(x)); math.Abs(d) > 1e-5 {
+				t.Errorf("ray %d: hit at %v is not on the surface: %v", i, x, d)
+			}
+		}
+
+		// Brute force check that the first crossing is not missed
+		for x := 0.0; x < 6; x += 0.01 {
+			if f(r.Position(x)) < 0 {
+				if len(xs) == 0 || xs[0] > x {
+					t.Errorf("ray %d: crossing before %v missed: %v", i, x, xs)
+				}
+
+				break
+			}
+		}
+	}
+}
+
+func TestSdfVisualization(t *testing.T) {
+	TestWithImage(t)
+
+	w := NewWorld()
+
+	w.AddLights(NewPointLight(Point(-10, 10, -10), White))
+
+	// A blob of smoothly joined spheres, carved by a box
+	blob := SdfSmoothUnion(SdfTransform(SdfSphere(0.6), Translation(-0.5, 0, 0)), SdfTransform(SdfSphere(0.5), Translation(0.5, 0.2, 0)), 0.4)
+	blob = SdfSmoothSubtraction(blob, SdfTransform(SdfBox(Vector(0.3, 0.3, 1), 0.05), Translation(-0.5, 0, -0.5)), 0.1)
+	s1 := NewSdfShape(blob, NewBox(Point(-1.2, -0.7, -0.7), Point(1.1, 0.8, 0.7)))
+	s1.SetTransform(Translation(-2, 1, 0))
+
+	// Mandelbulb
+	s2 := NewSdfShape(SdfMandelbulb(8, 10), NewBox(Point(-1.2, -1.2, -1.2), Point(1.2, 1.2, 1.2)))
+	s2.Shapable().(*SdfShape).Precision = 1e-4
+	s2.Shapable().(*SdfShape).FirstHit = true // Its inside is not a distance and would take forever
+	s2.SetTransform(Translation(2, 1, 0))
+
+	// Twisted column
+	s3 := NewSdfShape(SdfTwist(SdfBox(Vector(0.5, 1, 0.5), 0.05), 1.5), NewBox(Point(-0.75, -1, -0.75), Point(0.75, 1, 0.75)))
+	s3.Shapable().(*SdfShape).Lipschitz = 1.5
+	s3.SetTransform(Translation(0, -1.5, 0))
+
+	// Infinite floor of bumps
+	s4 := NewSdfShape(SdfRepeat(SdfSphere(0.3), Vector(1, 0, 1)), NewBox(Point(math.Inf(-1), -0.3, math.Inf(-1)), Point(math.Inf(+1), 0.3, math.Inf(+1))))
+	s4.SetTransform(Translation(0, -3, 0))
+
+	w.AddObjects(s1, s2, s3, s4)
+
+	camera := NewCamera(640, 480, Pi/2)
+	camera.SetTransform(EyeViewpoint(Point(0, 3, -5), Point(0, 0, 0), Vector(0, 1, 0)))
+
+	w.RenderToPNG(camera, "test_sdf.png")
+}
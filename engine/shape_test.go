@@ -203,6 +203,54 @@ func TestTriangleIntersect(t *testing.T) {
 	}
 }
 
+func TestTriangleWatertight(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	// A fan of triangles around a center vertex, all sharing edges and the center
+	center := Point(0.1, 0.2, 0.3)
+	rim := []Tuple{}
+
+	for i := 0; i < 7; i++ {
+		a := 2 * math.Pi * float64(i) / 7
+		rim = append(rim, Point(math.Cos(a)*1.3, math.Sin(a)*0.7, 0.3+math.Sin(3*a)*0.4))
+	}
+
+	triangles := []*Triangle{}
+
+	for i := range rim {
+		triangles = append(triangles, NewTriangle(center, rim[i], rim[(i+1)%len(rim)]))
+	}
+
+	hits := func(target Tuple) int {
+		origin := Point(rand()*4-2, rand()*4-2, -3-rand()*2)
+		r := NewRay(origin, target.Sub(origin))
+
+		count := 0
+
+		for _, s := range triangles {
+			if len(s.LocalIntersect(r)) > 0 {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	for i := 0; i < 1000; i++ {
+		if hits(center) == 0 {
+			t.Fatalf("ray %d at shared vertex missed all triangles", i)
+		}
+
+		// Shared edge (the rim edges are not shared, rays there may miss)
+		p := rim[i%len(rim)]
+		q := p.Add(center.Sub(p).Mul(rand()))
+
+		if hits(q) == 0 {
+			t.Fatalf("ray %d at shared edge %v missed all triangles", i, q)
+		}
+	}
+}
+
 // Cylinder
 func TestCylinderIntersect(t *testing.T) {
 	c := NewInfiniteCylinder()
@@ -369,6 +417,191 @@ func TestConeVisualization(t *testing.T) {
 	w.RenderToPNG(camera, "test_cones.png")
 }
 
+// Torus
+func TestTorusIntersect(t *testing.T) {
+	s := NewTorus(2, 1).Shapable()
+
+	hit := func(px, py, pz, dx, dy, dz float64, ts ...float64) {
+		t.Helper()
+
+		xs := s.LocalIntersect(NewRay(Point(px, py, pz), Vector(dx, dy, dz)))
+
+		if !SliceFloatEqual(xs, ts) {
+			t.Errorf("torus intersections %v should be %v", xs, ts)
+		}
+	}
+
+	hit(-5, 0, 0, 1, 0, 0, 2, 4, 6, 8)
+	hit(-5, 0, 0, 0.5, 0, 0, 4, 8, 12, 16)
+	hit(2, -5, 0, 0, 1, 0, 4, 6)
+	hit(0, 5, 0, 0, -1, 0)
+	hit(-5, 1, 0, 1, 0, 0, 3, 3, 7, 7)      // Tangent to the top of the tube
+	hit(0, 0, -5, 0, 0, -1, -8, -6, -4, -2) // Hits behind the ray origin are returned as well
+
+	// Far away rays must not lose precision
+	xs := s.LocalIntersect(NewRay(Point(-1e5, 0.5, 0), Vector(1, 0, 0)))
+	x0 := 2 + math.Sqrt(0.75)
+
+	if len(xs) != 4 || math.Abs(xs[0]-(1e5-x0)) > 1e-6 || math.Abs(xs[3]-(1e5+x0)) > 1e-6 {
+		t.Errorf("far torus intersections %v are not precise", xs)
+	}
+}
+
+func TestTorusNormal(t *testing.T) {
+	s := NewTorus(2, 1)
+
+	test := func(px, py, pz, nx, ny, nz float64) {
+		t.Helper()
+
+		if n := s.NormalAt(Point(px, py, pz)); !n.Equals(Vector(nx, ny, nz)) {
+			t.Errorf("torus normal failed: %+v should be %+v", n, Vector(nx, ny, nz))
+		}
+	}
+
+	test(3, 0, 0, 1, 0, 0)
+	test(1, 0, 0, -1, 0, 0)
+	test(0, 1, 2, 0, 1, 0)
+	test(0, 0, -3, 0, 0, -1)
+	test(2+math.Sqrt(0.5), math.Sqrt(0.5), 0, math.Sqrt(0.5), math.Sqrt(0.5), 0)
+}
+
+// Disk
+func TestDiskIntersect(t *testing.T) {
+	disk := NewDisk().Shapable()
+	annulus := NewAnnulus(0.5, 2).Shapable()
+
+	hit := func(s Shapable, px, py, pz, dx, dy, dz float64, ts ...float64) {
+		t.Helper()
+
+		xs := s.LocalIntersect(NewRay(Point(px, py, pz), Vector(dx, dy, dz)))
+
+		if !SliceFloatEqual(xs, ts) {
+			t.Errorf("disk intersections %v should be %v", xs, ts)
+		}
+	}
+
+	hit(disk, 0, 1, 0, 0, -1, 0, 1)
+	hit(disk, 0.9, -2, 0, 0, 1, 0, 2)
+	hit(disk, 1.1, 1, 0, 0, -1, 0)
+	hit(disk, 0, 1, 0, 1, 0, 0)
+	hit(annulus, 0, 1, 0, 0, -1, 0)
+	hit(annulus, 0, 1, 1.5, 0, -1, 0, 1)
+	hit(annulus, -2, 1, 0, 1, -1, 0, 1)
+
+	if n := NewDisk().NormalAt(Point(0.3, 0, 0.2)); !n.Equals(Vector(0, 1, 0)) {
+		t.Errorf("disk normal failed: %+v", n)
+	}
+}
+
+// Quadric
+func TestQuadricIntersect(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	// A quadric sphere must be the same as a sphere
+	sphere := NewSphere()
+	quadric := NewQuadric(QuadricMatrix(1, 1, 1, 0, 0, 0, 0, 0, 0, -1), NewBox(PointAtInfinity(-1), PointAtInfinity(+1)))
+
+	for i := 0; i < 100; i++ {
+		r := NewRay(Point(rand()*4-2, rand()*4-2, -5), Vector(rand()-0.5, rand()-0.5, 1))
+
+		xs1 := sphere.Shapable().LocalIntersect(r)
+		xs2 := quadric.Shapable().LocalIntersect(r)
+
+		if !SliceFloatEqual(xs1, xs2) {
+			t.Fatalf("quadric intersections %v should be %v", xs2, xs1)
+		}
+
+		if len(xs1) > 0 {
+			p := r.Position(xs1[0])
+
+			if n1, n2 := sphere.NormalAt(p), quadric.NormalAt(p); !n1.Equals(n2) {
+				t.Errorf("quadric normal %v should be %v", n2, n1)
+			}
+		}
+	}
+
+	hit := func(s *Shape, px, py, pz, dx, dy, dz float64, ts ...float64) {
+		t.Helper()
+
+		xs := s.Shapable().LocalIntersect(NewRay(Point(px, py, pz), Vector(dx, dy, dz)))
+
+		if !SliceFloatEqual(xs, ts) {
+			t.Errorf("%s intersections %v should be %v", s.Name(), xs, ts)
+		}
+	}
+
+	paraboloid := NewParaboloid(0, 4)
+
+	hit(paraboloid, 0, 5, 0, 0, -1, 0, 5)
+	hit(paraboloid, -5, 1, 0, 1, 0, 0, 4, 6)
+	hit(paraboloid, -5, 5, 0, 1, 0, 0) // Above the clip box
+
+	hyperboloid := NewHyperboloid(-1, 1, 1)
+
+	hit(hyperboloid, -5, 0, 0, 1, 0, 0, 4, 6)
+	hit(hyperboloid, 0, 5, 0, 0, -1, 0) // Thru the hole
+
+	twoSheets := NewHyperboloid(-3, 3, -1)
+
+	hit(twoSheets, 0, 5, 0, 0, -1, 0, 4, 6)
+	hit(twoSheets, -5, 0, 0, 1, 0, 0) // Between the sheets
+
+	if n := paraboloid.NormalAt(Point(1, 1, 0)); !n.Equals(Vector(2, -1, 0).Normalize()) {
+		t.Errorf("paraboloid normal failed: %+v", n)
+	}
+
+	if n := hyperboloid.NormalAt(Point(0, 0, 1)); !n.Equals(Vector(0, 0, 1)) {
+		t.Errorf("hyperboloid normal failed: %+v", n)
+	}
+
+	// The apex of a cone has no normal, but a ray that hits it still needs one
+	cone := NewHyperboloid(-1, 1, 0)
+
+	for _, r := range []Ray{NewRay(Point(0, 5, 0), Vector(0, -1, 0)), NewRay(Point(1, 5, 0), Vector(-1, -5, 0))} {
+		xs := cone.Shapable().LocalIntersect(r)
+
+		if len(xs) == 0 {
+			t.Fatalf("ray %+v does not hit the apex of the cone", r)
+		}
+
+		if n := cone.NormalAt(r.Position(xs[0])); math.IsNaN(n.X+n.Y+n.Z) || !FloatEqual(n.Length(), 1) {
+			t.Errorf("normal at the apex of the cone is %+v", n)
+		}
+	}
+}
+
+func TestQuadricsVisualization(t *testing.T) {
+	TestWithImage(t)
+
+	w := NewWorld()
+
+	w.AddLights(NewPointLight(Point(-10, 10, -10), White))
+
+	torus := NewTorus(1, 0.3)
+	torus.SetTransform(Translation(-2.5, 1, 0), RotationX(-Pi/4))
+	disk := NewAnnulus(0.4, 1)
+	disk.SetTransform(Translation(2.5, 1, 0), RotationX(-Pi/3))
+	paraboloid := NewParaboloid(0, 1.5)
+	paraboloid.SetTransform(Translation(-2.5, -2, 0))
+	hyperboloid := NewHyperboloid(-1, 1, 0.3)
+	hyperboloid.SetTransform(Translation(0, -1.5, 0))
+	ellipsoid := NewQuadric(QuadricMatrix(1, 4, 2, 1, 0, 0, 0, 0, 0, -1), NewBox(Point(-1.5, -1, -1), Point(+1.5, +1, +1)))
+	ellipsoid.SetTransform(Translation(2.5, -1.5, 0))
+
+	checker := NewCheckerPattern(White, Gray(0.5))
+	checker.SetTransform(Translation(0, 0.01, 0), Scaling(0.25)) // Keeps the flat disk off a boundary of the checker
+
+	for _, o := range []*Shape{torus, disk, paraboloid, hyperboloid, ellipsoid} {
+		o.SetMaterial(NewMaterial().SetPattern(checker))
+		w.AddObjects(o)
+	}
+
+	camera := NewCamera(640, 480, Pi/2)
+	camera.SetTransform(EyeViewpoint(Point(0, 3, -5), Point(0, 0, 0), Vector(0, 1, 0)))
+
+	w.RenderToPNG(camera, "test_quadrics.png")
+}
+
 type _sphere struct {
 	x, y, z, r float64
 }
@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// StereoMode selects how the images for the left and right eye are combined into the output
+type StereoMode int
+
+const (
+	StereoNone       StereoMode = iota
+	StereoSideBySide            // Left image on the left, the output is twice as wide
+	StereoOverUnder             // Left image on top, the output is twice as tall
+	StereoAnaglyph              // Red channel from the left image, green and blue from the right one
+)
+
+type Eye int
+
+const (
+	EyeLeft Eye = iota
+	EyeRight
+)
+
+// StereoParams describes the stereo rig of a camera
+type StereoParams struct {
+	Stereo      StereoMode
+	Interocular float64 // Distance between the eyes in world units
+	Convergence float64 // Distance of the zero parallax plane, where the two images coincide (zero for infinity)
+	ToeIn       bool    // Rotate the eyes toward the convergence point, instead of shifting the image (off-axis)
+	eye         float64 // Offset of the eye for omni-directional stereo, positive to the left
+	shift       float64 // Horizontal shift of the image plane for off-axis stereo
+}
+
+// EyeCamera returns a mono camera that sees the scene from the specified eye.
+// For the equirectangular projection it renders omni-directional stereo (ODS),
+// for the perspective projection it uses off-axis stereo unless toe-in is requested,
+// for other projections the eyes are always rotated toward the convergence point
+func (c *Camera) EyeCamera(eye Eye) *Camera {
+	e := *c
+	e.Stereo = StereoNone
+
+	// Camera space has +x to the left of the image
+	x := c.Interocular / 2
+	if eye == EyeRight {
+		x = -x
+	}
+
+	if c.Projection == ProjectionEquirectangular {
+		e.eye = x
+		return &e
+	}
+
+	view := Translation(-x, 0, 0)
+
+	if c.Convergence > 0 {
+		if c.ToeIn || c.Projection != ProjectionPerspective {
+			view = RotationY(-math.Atan2(x, c.Convergence)).Mul(view)
+		} else {
+			// Shift the image so that the point at convergence distance in front of the camera stays at the center
+			e.shift = -x / c.Convergence
+		}
+	}
+
+	e.SetTransform(view, c.Transform())
+
+	return &e
+}
+
+// CombineStereo merges the images of the two eyes according to the stereo mode
+func CombineStereo(mode StereoMode, left, right Canvas) Canvas {
+	w, h := left.Width, left.Height
+
+	switch mode {
+	case StereoSideBySide:
+		canvas := NewCanvas(w*2, h)
+
+		for y := 0; y < h; y++ {
+			copy(canvas.Pix[y*w*2:], left.Pix[y*w:(y+1)*w])
+			copy(canvas.Pix[y*w*2+w:], right.Pix[y*w:(y+1)*w])
+		}
+
+		return canvas
+
+	case StereoOverUnder:
+		canvas := NewCanvas(w, h*2)
+
+		copy(canvas.Pix, left.Pix)
+		copy(canvas.Pix[w*h:], right.Pix)
+
+		return canvas
+
+	case StereoAnaglyph:
+		canvas := NewCanvas(w, h)
+
+		for i, l := range left.Pix {
+			r := right.Pix[i]
+			canvas.Pix[i] = RGB(l.R, r.G, r.B)
+		}
+
+		return canvas
+	}
+
+	return left
+}
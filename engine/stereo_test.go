@@ -0,0 +1,104 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package engine
+
+import (
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/utils"
+)
+
+func TestStereoEyeCameras(t *testing.T) {
+	c := NewCamera(201, 101, Pi/2)
+	c.SetTransform(Translation(0, -1, 0))
+	c.Interocular = 0.2
+	c.Convergence = 4
+
+	for _, toeIn := range []bool{false, true} {
+		c.ToeIn = toeIn
+
+		left := c.EyeCamera(EyeLeft).RayForPixel(100.5, 50.5)
+		right := c.EyeCamera(EyeRight).RayForPixel(100.5, 50.5)
+
+		// Eyes are apart, but both look at the convergence point in the center of the image
+		if !left.Origin.Equals(Point(0.1, 1, 0)) || !right.Origin.Equals(Point(-0.1, 1, 0)) {
+			t.Errorf("bad eye positions: %+v %+v", left.Origin, right.Origin)
+		}
+
+		focus := Point(0, 1, -4)
+		if !focus.Sub(left.Origin).Normalize().Equals(left.Direction) || !focus.Sub(right.Origin).Normalize().Equals(right.Direction) {
+			t.Errorf("eyes do not converge (toe-in %v): %+v %+v", toeIn, left, right)
+		}
+	}
+
+	// Omni-directional stereo: eyes are always offset sideways from the ray
+	c.SetProjection(ProjectionEquirectangular, 0)
+
+	tests := []struct {
+		x      float64
+		origin Tuple
+	}{
+		{100.5, Point(0.1, 1, 0)},
+		{50.25, Point(0, 1, 0.1)},
+	}
+
+	for _, test := range tests {
+		r := c.EyeCamera(EyeLeft).RayForPixel(test.x, 50.5)
+
+		if !r.Origin.Equals(test.origin) || !FloatEqual(r.Direction.DotProduct(r.Origin.Sub(Point(0, 1, 0))), 0) {
+			t.Errorf("bad omni-directional stereo ray: %+v", r)
+		}
+	}
+}
+
+func TestCombineStereo(t *testing.T) {
+	left := NewCanvas(2, 1)
+	right := NewCanvas(2, 1)
+	left.Pix[0] = RGB(1, 0.5, 0.5)
+	right.Pix[1] = RGB(0.5, 1, 1)
+
+	if c := CombineStereo(StereoSideBySide, left, right); c.Width != 4 || c.Height != 1 || c.Pix[0] != left.Pix[0] || c.Pix[3] != right.Pix[1] {
+		t.Errorf("side by side failed: %+v", c)
+	}
+
+	if c := CombineStereo(StereoOverUnder, left, right); c.Width != 2 || c.Height != 2 || c.Pix[0] != left.Pix[0] || c.Pix[3] != right.Pix[1] {
+		t.Errorf("over under failed: %+v", c)
+	}
+
+	if c := CombineStereo(StereoAnaglyph, left, right); c.Width != 2 || c.Pix[0] != RGB(1, 0, 0) || c.Pix[1] != RGB(0, 1, 1) {
+		t.Errorf("anaglyph failed: %+v", c)
+	}
+}
+
+func TestStereoScene(t *testing.T) {
+	TestWithImage(t)
+
+	floor := NewPlane()
+	floor.SetMaterial(NewMaterial().SetPattern(NewCheckerPattern(White, Gray(0.5))))
+
+	s1 := NewSphere()
+	s1.SetTransform(Translation(-1, 1, 0))
+
+	s2 := NewCube()
+	s2.SetTransform(Translation(1.5, 0.5, 2), Scaling(0.5))
+
+	w := NewWorld()
+	w.AddObjects(floor, s1, s2)
+	w.AddLights(NewPointLight(Point(-10, 10, -10), White))
+
+	c := NewCamera(300, 200, Pi/3)
+	c.SetTransform(EyeViewpoint(Point(0, 2, -6), Point(0, 1, 0), Vector(0, 1, 0)))
+	c.Interocular = 0.3
+	c.Convergence = 6
+
+	c.Stereo = StereoSideBySide
+	w.RenderToPNG(c, "test_stereo_side_by_side.png")
+
+	c.Stereo = StereoAnaglyph
+	w.RenderToPNG(c, "test_stereo_anaglyph.png")
+}
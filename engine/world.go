@@ -22,6 +22,43 @@ type World struct {
 	Ambient          Color
 	Options          *Options
 	ErpCanvasToImage Interpolator
+	Caustics         *PhotonMap       // Built before rendering if photons are enabled
+	IrradianceCache  *IrradianceCache // Created before rendering if indirect illumination is enabled
+	bvh              *Bvh             // Top-level BVH over the objects, built before rendering
+	prepared         *preparedState   // What the renderer data structures were built for, nil if stale
+}
+
+// preparedState records the options, lights and object transforms used by the last Prepare
+type preparedState struct {
+	options    Options
+	lights     int
+	transforms []Matrix
+}
+
+func newPreparedState(w *World) *preparedState {
+	s := &preparedState{options: *w.Options, lights: len(w.Lights)}
+
+	for _, o := range w.Objects {
+		m := o.Transform()
+		s.transforms = append(s.transforms, NewMatrix(m.Cols, m.Rows, m.A...))
+	}
+
+	return s
+}
+
+// matches returns true if nothing that affects the renderer data structures has changed
+func (s *preparedState) matches(w *World) bool {
+	if s.options != *w.Options || s.lights != len(w.Lights) || len(s.transforms) != len(w.Objects) {
+		return false
+	}
+
+	for i, o := range w.Objects {
+		if !s.transforms[i].Equals(o.Transform()) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func NewWorld() *World {
@@ -40,6 +77,7 @@ func (w *World) SetAmbient(color Color) {
 
 func (w *World) SetOptions(options *Options) {
 	w.Options = options
+	w.prepared = nil
 }
 
 func (w *World) ObjectAsGroup(o interface{}) *Group {
@@ -51,22 +89,117 @@ func (w *World) ObjectAsGroup(o interface{}) *Group {
 	return nil
 }
 
+// Find returns the object with the specified name, searching into groups too
 func (w *World) Find(name string) Groupable {
-	for _, o := range w.Objects {
+	o, _ := w.findWithTransform(name)
+
+	return o
+}
+
+// findWithTransform returns the object with the specified name and the transform from its space to world space
+func (w *World) findWithTransform(name string) (Groupable, Matrix) {
+	var find func(o Groupable, m Matrix) (Groupable, Matrix)
+
+	find = func(o Groupable, m Matrix) (Groupable, Matrix) {
+		m = m.Mul(o.Transform())
+
 		if o.Name() == name {
-			return o
+			return o, m
 		}
+
+		if g, ok := o.(*Group); ok {
+			for i := 0; i < g.Len(); i++ {
+				if f, fm := find(g.Members(i), m); f != nil {
+					return f, fm
+				}
+			}
+		}
+
+		return nil, m
 	}
 
-	return nil
+	for _, o := range w.Objects {
+		if f, m := find(o, Identity()); f != nil {
+			return f, m
+		}
+	}
+
+	return nil, Identity()
 }
 
 func (w *World) AddObjects(objects ...Groupable) {
 	w.Objects = append(w.Objects, objects...)
+	w.bvh = nil
+	w.prepared = nil
+}
+
+// BuildBVH builds a BVH over the objects of the world, objects which are groups
+// have their own BVH so that together they form a two-level hierarchy
+func (w *World) BuildBVH() {
+	w.bvh = NewBvh(w.Objects, Identity())
+}
+
+// SetBvhLayout selects the layout of the top-level BVH and of the BVH of all groups
+func (w *World) SetBvhLayout(layout string) {
+	l := BvhLayoutBinary
+	if layout == BvhWide4 {
+		l = BvhLayoutWide4
+	}
+
+	if w.bvh != nil {
+		w.bvh.SetLayout(l)
+	}
+
+	for _, o := range w.Objects {
+		switch t := o.(type) {
+		case *Group:
+			t.SetBvhLayout(l)
+		case *Instance:
+			t.SetBvhLayout(l)
+		}
+	}
+}
+
+// Bvh returns the top-level BVH of the world, nil if not built
+func (w *World) Bvh() *Bvh {
+	return w.bvh
+}
+
+// addIntersections adds the intersections of a ray with all objects, using the BVH if available
+func (w *World) addIntersections(ray Ray, xs *Intersections) {
+	if w.bvh != nil {
+		w.bvh.AddIntersections(ray, ray, xs)
+		return
+	}
+
+	for _, o := range w.Objects {
+		o.AddIntersections(ray, xs)
+	}
+}
+
+func (w *World) occludes(ray Ray, xs *Intersections) bool {
+	if w.bvh != nil {
+		return w.bvh.Occludes(ray, ray, xs)
+	}
+
+	for _, o := range w.Objects {
+		if o.Occludes(ray, xs) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (w *World) AddLights(lights ...Light) {
 	w.Lights = append(w.Lights, lights...)
+	w.prepared = nil
+}
+
+// Invalidate forces the next Prepare to build everything again, it is needed only
+// after changes that Prepare cannot detect, like editing the members of a group or a light
+func (w *World) Invalidate() {
+	w.prepared = nil
 }
 
 func (w *World) Intersect(ray Ray) *Intersections {
@@ -110,52 +243,85 @@ func (w *World) RefractedColor(ii *IntersectionInfo, depth int) Color {
 	return NewRaytracer(w).RefractedColor(ii, depth)
 }
 
-func (w *World) getPixelSampler(rand FloatGenerator) (s Sampler2d) {
+func (w *World) getPixelSampler(rand FloatGenerator) PixelSampler {
+	seed := uint64(w.Options.Seed)
+
+	switch w.Options.Sampler {
+	case SamplerHalton:
+		return NewHaltonSampler(seed)
+	case SamplerSobol:
+		return NewSobolSampler(seed)
+	case SamplerPMJ02:
+		return NewPMJ02Sampler(seed)
+	}
+
+	var s Sampler2d
+
 	if w.Options.Supersampling == 1 {
 		s = NewStratified2d(1, 1)
 	} else {
 		s = NewJitteredStratified2d(w.Options.Supersampling, w.Options.Supersampling, rand)
 	}
 
-	return s
+	return NewRandomPixelSampler(s, rand)
 }
 
 func (w *World) GoDivisionRenderToCanvas(goers int, camera *Camera) Canvas {
+	return w.GoDivisionRenderRegionToCanvas(goers, camera, camera.Frame())
+}
+
+// GoDivisionRenderRegionToCanvas renders only a region of the camera view into a canvas as large as the region,
+// each pixel gets exactly the same color it would get if the whole view was rendered
+func (w *World) GoDivisionRenderRegionToCanvas(goers int, camera *Camera, region image.Rectangle) Canvas {
 	var wg sync.WaitGroup
 
-	canvas := NewCanvas(camera.HSize, camera.VSize)
+	canvas := NewCanvas(region.Dx(), region.Dy())
 
 	samplesPerPixel := w.Options.Supersampling * w.Options.Supersampling
 
+	// Depth of field from the command line has precedence over the camera settings
+	lensRadius, focalDistance := camera.LensRadius, camera.FocalDistance
+	if w.Options.LensRadius > 0 {
+		lensRadius, focalDistance = w.Options.LensRadius, w.Options.FocalDistance
+	}
+
+	if w.IrradianceCache != nil {
+		w.FillIrradianceCache(goers, camera, region)
+	}
+
 	renderer := func(m, r int) {
 		defer wg.Done()
 
 		rt := NewRaytracer(w)
 
-		sampler := w.getPixelSampler(rt.rand) // NewRandomGenerator(13+int64(s)*7)
+		sampler := w.getPixelSampler(rt.rand)
+		rt.sampler = sampler
 
-		for y := 0; y < camera.VSize; y++ {
-			for x := r; x < camera.HSize; x += m {
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X + r; x < region.Max.X; x += m {
 				// Reset sampler to keep all values into the proper range
-				sampler.Reset()
+				sampler.StartPixel(x, y)
+
+				if w.IrradianceCache != nil {
+					rt.pixelCache = w.IrradianceCache.emptyCopy()
+				}
 
 				for s := 0; s < samplesPerPixel; s++ {
+					rt.StartSample(x, y, s)
+
 					// Get the pixel coordinates
 					px, py := sampler.Next()
 					px += float64(x)
 					py += float64(y)
 
-					// Get ray from viewpoint to target pixel
-					var ray Ray
-					if w.Options.LensRadius > 0 {
-						ray = camera.RayForPixelDepthOfField(px, py, w.Options.LensRadius, w.Options.FocalDistance, rt.rand)
-					} else {
-						ray = camera.RayForPixel(px, py)
-					}
+					// Get ray from viewpoint to target pixel, if the pixel is not covered by the camera it stays black
+					ray, ok := camera.CameraRay(px, py, lensRadius, focalDistance, rt.Sample1d)
 
-					// Render and store color
-					col := rt.ColorAt(ray)
-					canvas.AddPixelAt(px, py, col)
+					if ok {
+						// Render and store color
+						col := rt.ColorAt(ray)
+						canvas.AddPixelAt(px-float64(region.Min.X), py-float64(region.Min.Y), col)
+					}
 				}
 			}
 		}
@@ -168,13 +334,44 @@ func (w *World) GoDivisionRenderToCanvas(goers int, camera *Camera) Canvas {
 
 	wg.Wait()
 
-	canvas.Mul(1.0 / float64(samplesPerPixel))
+	canvas.Mul(camera.Exposure / float64(samplesPerPixel))
 
 	return canvas
 }
 
+// Prepare builds the data structures needed by the renderer, according to the current options:
+// they are built again only if objects, lights, transforms or options have changed since the last call
+func (w *World) Prepare() {
+	if w.prepared != nil && w.bvh != nil && w.prepared.matches(w) {
+		return
+	}
+
+	w.BuildBVH()
+	w.SetBvhLayout(w.Options.Bvh)
+
+	w.Caustics = nil
+	if w.Options.Photons > 0 {
+		w.BuildCausticsMap()
+	}
+
+	w.IrradianceCache = nil
+	if w.Options.IrradianceSamples > 0 {
+		w.IrradianceCache = NewIrradianceCache(w.FiniteBounds(), w.Options.IrradianceAccuracy)
+	}
+
+	w.prepared = newPreparedState(w)
+}
+
+// RenderCameraToCanvas renders the view of a camera, if the camera is stereo
+// both eyes are rendered and combined into a single canvas
+func (w *World) RenderCameraToCanvas(c *Camera) Canvas {
+	return w.RenderRegionToCanvas(c, c.Frame())
+}
+
 func (w *World) RenderToImage(c *Camera) image.Image {
-	canvas := w.GoDivisionRenderToCanvas(w.Options.NumThreads, c)
+	w.Prepare()
+
+	canvas := w.RenderCameraToCanvas(c)
 	// Alternative renderers
 	// canvas := w.RenderToCanvas(c)
 
@@ -5,10 +5,13 @@
 package engine
 
 import (
+	"fmt"
+	"image"
 	"math"
 	"testing"
 
 	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/options"
 	. "ascottix/funtracer/shapes"
 	. "ascottix/funtracer/textures"
 	. "ascottix/funtracer/utils"
@@ -269,13 +272,13 @@ func TestWorldReflect(t *testing.T) {
 	ii = NewIntersectionInfo(i, r, nil)
 	c = w.ReflectedColor(ii, 1)
 
-	if !c.Equals(RGB(0.19033232, 0.23791540, 0.14274924)) {
+	if !c.Equals(RGB(0.19033061, 0.23791327, 0.14274796)) {
 		t.Errorf("world reflect failed: %+v", c)
 	}
 
 	c = w.ShadeHit(ii, 1)
 
-	if !c.Equals(RGB(0.87675771, 0.92434079, 0.82917463)) {
+	if !c.Equals(RGB(0.87675600, 0.92433866, 0.82917335)) {
 		t.Errorf("world shade hit failed: %+v", c)
 	}
 
@@ -364,7 +367,7 @@ func TestWorldRefract(t *testing.T) {
 	ii = NewIntersectionInfo(xs.At(2), r, xs)
 	c = w.RefractedColor(ii, 5)
 
-	if !c.Equals(RGB(0, 0.99888454, 0.04721945)) {
+	if !c.Equals(RGB(0, 0.99888468, 0.04721644)) {
 		t.Errorf("refracted color failed: %+v", c)
 	}
 }
@@ -463,3 +466,275 @@ func TestWorldSchlick(t *testing.T) {
 		t.Errorf("reflectance with small angle and n2>n1 failed")
 	}
 }
+
+func TestWorldRenderIsDeterministic(t *testing.T) {
+	floor := NewPlane()
+
+	ball := NewSphere()
+	ball.SetTransform(Translation(0, 1, 0))
+
+	light := NewRectLight(White)
+	light.Pos = Point(-1, 4, -1)
+	light.Uv = Vector(2, 0, 0)
+	light.Vv = Vector(0, 0, 2)
+
+	w := NewWorld()
+	w.AddObjects(floor, ball)
+	w.AddLights(light)
+	w.Options.Supersampling = 2
+	w.Options.AreaLightSamples = 2
+	w.Options.LensRadius = 0.2
+	w.Options.FocalDistance = 5
+
+	c := NewCamera(20, 15, Pi/3)
+	c.SetTransform(EyeViewpoint(Point(0, 2, -5), Point(0, 1, 0), Vector(0, 1, 0)))
+
+	equal := func(a, b Canvas) bool {
+		for i := range a.Pix {
+			if a.Pix[i] != b.Pix[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Each render starts from an empty irradiance cache
+	render := func(goers int) Canvas {
+		w.Invalidate()
+		w.Prepare()
+
+		return w.GoDivisionRenderToCanvas(goers, c)
+	}
+
+	// The image must be the same regardless of how many threads are used
+	for _, test := range []struct {
+		sampler           string
+		irradianceSamples int
+	}{
+		{SamplerStratified, 0},
+		{SamplerSobol, 0},
+		{SamplerStratified, 4},
+	} {
+		w.Options.Sampler = test.sampler
+		w.Options.IrradianceSamples = test.irradianceSamples
+		w.Options.IrradianceAccuracy = 0.3
+
+		name := fmt.Sprintf("%s, %d irradiance samples", test.sampler, test.irradianceSamples)
+
+		c1 := render(1)
+		c2 := render(3)
+
+		if !equal(c1, c2) {
+			t.Errorf("%s: rendering depends on the number of threads", name)
+		}
+
+		if c4 := render(3); !equal(c2, c4) {
+			t.Errorf("%s: rendering is not repeatable", name)
+		}
+
+		w.Options.Seed = 2
+		c3 := render(3)
+		w.Options.Seed = 1
+
+		if equal(c1, c3) {
+			t.Errorf("%s: rendering does not depend on the seed", name)
+		}
+	}
+}
+
+func TestWorldBVH(t *testing.T) {
+	rand := NewRandomGenerator(1)
+
+	w := NewWorld()
+	w.AddObjects(NewPlane())
+
+	for i := 0; i < 500; i++ {
+		s := NewSphere()
+		s.SetTransform(Translation(rand()*20-10, rand()*20, rand()*20-10), Scaling(0.2+rand()*0.5))
+		w.AddObjects(s)
+	}
+
+	// A group with a plane inside, which cannot be partitioned by its BVH
+	g := NewGroup()
+	g.Add(NewPlane(), NewCube())
+	g.SetTransform(Translation(0, 30, 0))
+	g.BuildBVH()
+	w.AddObjects(g)
+
+	linear := NewRaytracer(w)
+	linearHits := []Intersection{}
+
+	rays := []Ray{}
+	for i := 0; i < 1000; i++ {
+		o := Point(rand()*40-20, rand()*40-5, rand()*40-20)
+		d := Vector(rand()-0.5, rand()-0.5, rand()-0.5).Normalize()
+		rays = append(rays, NewRay(o, d))
+		linearHits = append(linearHits, linear.Intersect(rays[i], VisibleToCamera))
+	}
+
+	w.Prepare()
+
+	if w.bvh == nil || w.bvh.Len() != len(w.Objects) {
+		t.Fatalf("world BVH not built")
+	}
+
+	rt := NewRaytracer(w)
+	hits := 0
+
+	for i, r := range rays {
+		hit := rt.Intersect(r, VisibleToCamera)
+
+		if hit.O != linearHits[i].O || !FloatEqual(hit.T, linearHits[i].T) {
+			t.Fatalf("BVH hit differs for ray %+v: %+v vs %+v", r, hit, linearHits[i])
+		}
+
+		if hit.Valid() {
+			hits++
+		}
+	}
+
+	if hits == 0 {
+		t.Errorf("no hits, test is not meaningful")
+	}
+
+	// Adding objects invalidates the BVH
+	w.AddObjects(NewSphere())
+
+	if w.bvh != nil {
+		t.Errorf("world BVH not invalidated")
+	}
+}
+
+func TestWorldPrepareAfterChanges(t *testing.T) {
+	ball := NewSphere()
+	other := NewSphere()
+	other.SetTransform(Translation(-3, 0, 0), Scaling(0.5))
+
+	w := NewWorld()
+	w.AddObjects(ball, other)
+	w.AddLights(NewPointLight(Point(0, 0, -5), White))
+	w.Options.IrradianceSamples = 4
+
+	c := NewCamera(11, 11, Pi/2)
+	c.SetTransform(EyeViewpoint(Point(0, 0, -5), Point(0, 0, 0), Vector(0, 1, 0)))
+
+	lit := func(img image.Image, x, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r+g+b > 0
+	}
+
+	img := w.RenderToImage(c)
+	cache := w.IrradianceCache
+
+	if !lit(img, 5, 5) {
+		t.Fatalf("ball not rendered in the middle")
+	}
+
+	// Moving the ball between two renders must update the BVH
+	ball.SetTransform(Translation(3, 0, 0))
+	img = w.RenderToImage(c)
+
+	if lit(img, 5, 5) {
+		t.Errorf("ball still rendered in the middle")
+	}
+
+	moved := false
+	for x := 6; x < 11; x++ {
+		moved = moved || lit(img, x, 5)
+	}
+
+	if !moved {
+		t.Errorf("moved ball not rendered")
+	}
+
+	// Irradiance samples of the old scene are gone
+	if w.IrradianceCache == cache {
+		t.Errorf("irradiance cache not built again")
+	}
+}
+
+func TestWorldPrepareOnlyIfChanged(t *testing.T) {
+	w := NewWorld()
+	w.AddObjects(NewSphere())
+	w.AddLights(NewPointLight(Point(0, 0, -5), White))
+	w.Options.IrradianceSamples = 4
+
+	w.Prepare()
+	bvh, cache := w.Bvh(), w.IrradianceCache
+
+	// Nothing has changed, so the data structures are kept
+	w.Prepare()
+
+	if w.Bvh() != bvh || w.IrradianceCache != cache {
+		t.Errorf("world prepared again without changes")
+	}
+
+	// Options changed in place are detected too
+	w.Options.IrradianceAccuracy /= 2
+	w.Prepare()
+
+	if w.Bvh() == bvh || w.IrradianceCache == cache {
+		t.Errorf("world not prepared again after options changed")
+	}
+
+	bvh = w.Bvh()
+	w.AddLights(NewPointLight(Point(0, 5, -5), White))
+	w.Prepare()
+
+	if w.Bvh() == bvh {
+		t.Errorf("world not prepared again after lights changed")
+	}
+}
+
+func TestWorldOcclusion(t *testing.T) {
+	rand := NewRandomGenerator(2)
+
+	w := NewWorld()
+	w.AddObjects(NewPlane())
+
+	for i := 0; i < 200; i++ {
+		s := NewSphere()
+		s.SetTransform(Translation(rand()*20-10, rand()*20, rand()*20-10), Scaling(0.2+rand()*0.5))
+		w.AddObjects(s)
+	}
+
+	csg := NewCsg(CsgDifference, NewCube(), NewSphere())
+	csg.SetTransform(Translation(0, 5, 0), Scaling(3))
+
+	g := createRandomSpheresGroup(500)
+	g.SetBvhLayout(BvhLayoutWide4)
+
+	instance := NewInstance(g)
+	instance.SetTransform(Translation(5, 10, 5))
+
+	w.AddObjects(csg, g, instance)
+	w.Prepare()
+
+	rt := NewRaytracer(w)
+	occluded := 0
+
+	for i := 0; i < 2000; i++ {
+		r := NewRay(Point(rand()*40-20, rand()*40-5, rand()*40-20), Vector(rand()-0.5, rand()-0.5, rand()-0.5).Normalize())
+		r.TMax = rand() * 20
+
+		hit := rt.HitForShadow(r)
+		expected := hit.Valid() && hit.T < r.TMax
+
+		// Pruning objects behind the closest hit must not change it
+		if closest := rt.Intersect(r, VisibleToCamera); closest.O != hit.O || closest.T != hit.T {
+			t.Fatalf("closest hit differs for ray %+v: %+v vs %+v", r, closest, hit)
+		}
+
+		if rt.Occluded(r) != expected {
+			t.Fatalf("occlusion differs for ray %+v: %+v", r, hit)
+		}
+
+		if expected {
+			occluded++
+		}
+	}
+
+	if occluded == 0 || occluded == 2000 {
+		t.Errorf("test is not meaningful: %d rays occluded", occluded)
+	}
+}
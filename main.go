@@ -8,11 +8,16 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"image"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	. "ascottix/funtracer/engine"
 	. "ascottix/funtracer/objects"
 	. "ascottix/funtracer/options"
+	. "ascottix/funtracer/shapes"
 )
 
 func fail(err error) {
@@ -61,26 +66,99 @@ func main() {
 	}
 
 	// Read scene and render!
-	scene, err := ParseSbtSceneFromFile(sceneFilename)
-
-	start := time.Now()
+	scene, err := ParseSbtSceneFromFileWithOptions(sceneFilename, SbtParserOptions{CacheDir: options.MeshCacheDir})
 
 	if err == nil {
 		scene.SyncOptions(options) // Sync options from outside with options from command line
 
 		fmt.Printf("Options: %+v\n", *options)
 
-		fmt.Printf("Rendering '%s' into '%s'...", sceneFilename, options.OutFilename)
+		// Build the BVH and the photon map once, rendering each camera only checks they are up to date
+		scene.World.Prepare()
 
-		err = scene.World.RenderToPNG(scene.Camera, options.OutFilename)
-	}
+		if options.Verbose {
+			printBvhStats(scene.World)
+		}
 
-	elapsed := time.Now().Sub(start)
+		err = render(scene, sceneFilename, options)
+	}
 
 	if err != nil {
 		fail(err)
 		os.Exit(1)
 	}
+}
+
+// printBvhStats prints the statistics of the top-level BVH and of the BVH of all groups,
+// the world must have been prepared already
+func printBvhStats(world *World) {
+	fmt.Printf("BVH world: %s\n", world.Bvh().Stats())
+
+	var walk func(Groupable)
+
+	walk = func(o Groupable) {
+		if g, ok := o.(*Group); ok {
+			if bvh := g.Bvh(); bvh != nil {
+				fmt.Printf("BVH %s: %s\n", g.Name(), bvh.Stats())
+			}
+
+			for i := 0; i < g.Len(); i++ {
+				walk(g.Members(i))
+			}
+		}
+	}
+
+	for _, o := range world.Objects {
+		walk(o)
+	}
+}
+
+// outFilename returns the name of the image rendered by a camera, when there is more than one
+// it's the output filename with the camera name appended, e.g. fun_front.png
+func outFilename(filename string, camera *Camera, many bool) string {
+	if !many {
+		return filename
+	}
+
+	ext := filepath.Ext(filename)
+
+	return strings.TrimSuffix(filename, ext) + "_" + camera.Name() + ext
+}
+
+// render renders the selected cameras one after another, the scene is loaded and prepared only once
+func render(scene *Scene, sceneFilename string, options *Options) error {
+	cameras, err := scene.SelectCameras(options.Cameras)
+
+	if err != nil {
+		return err
+	}
+
+	for _, camera := range cameras {
+		filename := outFilename(options.OutFilename, camera, len(cameras) > 1)
+
+		fmt.Printf("Rendering '%s' into '%s'...", sceneFilename, filename)
+
+		start := time.Now()
+
+		if options.Crop != "" {
+			var region image.Rectangle
+
+			if region, err = ParseCropWindow(options.Crop, camera.HSize, camera.VSize); err == nil {
+				err = scene.World.RenderRegionToPNG(camera, region, filename, options.CropMerge)
+			}
+		} else {
+			err = scene.World.RenderToPNG(camera, filename)
+		}
+
+		if err != nil {
+			fmt.Println()
+			return err
+		}
+
+		elapsed := time.Now().Sub(start)
+
+		fmt.Printf(" done in %s\n", elapsed.Round(time.Millisecond))
+	}
 
-	fmt.Printf(" done in %s\n", elapsed.Round(time.Millisecond))
+	return nil
 }
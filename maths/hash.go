@@ -0,0 +1,28 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package maths
+
+// MixBits scrambles the bits of v so that similar inputs give very different outputs,
+// see: http://zimbry.blogspot.com/2011/09/better-bit-mixing-improving-on.html
+func MixBits(v uint64) uint64 {
+	v ^= v >> 31
+	v *= 0x7fb5d329728ea185
+	v ^= v >> 27
+	v *= 0x81dadef4bc2dd44d
+	v ^= v >> 33
+
+	return v
+}
+
+// Hash combines a list of values into a single, well distributed, value
+func Hash(values ...uint64) uint64 {
+	h := uint64(0x9e3779b97f4a7c15)
+
+	for _, v := range values {
+		h = MixBits(h ^ (v + 0x9e3779b97f4a7c15 + (h << 6) + (h >> 2)))
+	}
+
+	return h
+}
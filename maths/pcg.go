@@ -0,0 +1,55 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package maths
+
+// PCG is a small and fast random number generator that can be reseeded cheaply,
+// so that each pixel sample gets its own stream of random numbers and the rendered
+// image doesn't depend on the order in which pixels are computed.
+// See: Melissa O'Neill, https://www.pcg-random.org
+type PCG struct {
+	state uint64
+	inc   uint64
+}
+
+const pcgMultiplier = 6364136223846793005
+
+func NewPCG(seed, stream uint64) *PCG {
+	r := &PCG{}
+
+	r.Seed(seed, stream)
+
+	return r
+}
+
+// Seed restarts the generator: different streams yield independent sequences for the same seed
+func (r *PCG) Seed(seed, stream uint64) {
+	r.state = 0
+	r.inc = stream<<1 | 1
+	r.Uint32()
+	r.state += seed
+	r.Uint32()
+}
+
+// SeedHash restarts the generator with a stream identified by a list of values, e.g. the coordinates of a sample
+func (r *PCG) SeedHash(values ...uint64) {
+	h := Hash(values...)
+
+	r.Seed(h, MixBits(h))
+}
+
+func (r *PCG) Uint32() uint32 {
+	old := r.state
+	r.state = old*pcgMultiplier + r.inc
+
+	xorshifted := uint32(((old >> 18) ^ old) >> 27)
+	rot := uint32(old >> 59)
+
+	return xorshifted>>rot | xorshifted<<((-rot)&31)
+}
+
+// Float64 returns a number in [0,1), it can be used as a FloatGenerator
+func (r *PCG) Float64() float64 {
+	return float64(uint64(r.Uint32())<<21|uint64(r.Uint32())>>11) * 0x1p-53
+}
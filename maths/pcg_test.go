@@ -0,0 +1,33 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package maths
+
+import (
+	"testing"
+)
+
+func TestPCG(t *testing.T) {
+	// Reference values from the pcg32 demo program
+	r := NewPCG(42, 54)
+	expected := []uint32{0xa15c02b7, 0x7b47f409, 0xba1d3330, 0x83d2f293, 0xbfa4784b, 0xcbed606e}
+
+	for i, e := range expected {
+		if v := r.Uint32(); v != e {
+			t.Errorf("bad value %d: %x, expected %x", i, v, e)
+		}
+	}
+
+	// Reseeding restarts the same sequence
+	r.SeedHash(1, 2, 3)
+	a := r.Float64()
+	r.SeedHash(1, 2, 4)
+	b := r.Float64()
+	r.SeedHash(1, 2, 3)
+	c := r.Float64()
+
+	if a != c || a == b || a < 0 || a >= 1 {
+		t.Errorf("bad reseeding: %f %f %f", a, b, c)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package maths
+
+import (
+	"math"
+	"sort"
+)
+
+// Solvers for the real roots of polynomials up to the fourth degree, based on the closed forms
+// by Jochen Schwarze in "Graphics Gems" (1990), with the roots polished by Newton iterations
+// as the closed forms for cubics and quartics lose quite some precision.
+// Coefficients go from the highest degree down, roots are returned in ascending order
+// and multiple roots may be returned only once
+
+const polyEpsilon = 1e-9 // Threshold to treat a normalized coefficient as zero
+
+func isZero(x float64) bool {
+	return x > -polyEpsilon && x < polyEpsilon
+}
+
+// SolveQuadratic returns the real roots of a*x^2 + b*x + c
+func SolveQuadratic(a, b, c float64) []float64 {
+	if a == 0 {
+		if b == 0 {
+			return nil
+		}
+
+		return []float64{-c / b}
+	}
+
+	disc := b*b - 4*a*c
+
+	if disc < 0 {
+		return nil
+	}
+
+	// Avoid the cancellation of -b + sqrt(disc) when b is large
+	q := -0.5 * (b + math.Copysign(math.Sqrt(disc), b))
+
+	if q == 0 {
+		return []float64{0, 0}
+	}
+
+	x0, x1 := q/a, c/q
+
+	if x0 > x1 {
+		x0, x1 = x1, x0
+	}
+
+	return []float64{x0, x1}
+}
+
+// SolveCubic returns the real roots of a*x^3 + b*x^2 + c*x + d
+func SolveCubic(a, b, c, d float64) []float64 {
+	if a == 0 {
+		return SolveQuadratic(b, c, d)
+	}
+
+	roots := solveNormalCubic(b/a, c/a, d/a)
+
+	return polish(roots, a, b, c, d)
+}
+
+// solveNormalCubic returns the real roots of x^3 + A*x^2 + B*x + C, not polished nor sorted
+func solveNormalCubic(A, B, C float64) []float64 {
+	// Substitute x = y - A/3 to eliminate the quadric term: y^3 + p*y + q = 0
+	sqA := A * A
+	p := (-sqA/3 + B) / 3
+	q := (2.0/27*A*sqA - A*B/3 + C) / 2
+
+	// Use Cardano's formula
+	cbp := p * p * p
+	D := q*q + cbp
+
+	var roots []float64
+
+	switch {
+	case isZero(D):
+		if isZero(q) {
+			// One triple root
+			roots = []float64{0}
+		} else {
+			// One single and one double root
+			u := math.Cbrt(-q)
+			roots = []float64{2 * u, -u}
+		}
+	case D < 0:
+		// Three real roots
+		phi := math.Acos(-q/math.Sqrt(-cbp)) / 3
+		t := 2 * math.Sqrt(-p)
+
+		roots = []float64{t * math.Cos(phi), -t * math.Cos(phi+Pi/3), -t * math.Cos(phi-Pi/3)}
+	default:
+		// One real root
+		sqrtD := math.Sqrt(D)
+		roots = []float64{math.Cbrt(sqrtD-q) - math.Cbrt(sqrtD+q)}
+	}
+
+	for i := range roots {
+		roots[i] -= A / 3
+	}
+
+	return roots
+}
+
+// SolveQuartic returns the real roots of a*x^4 + b*x^3 + c*x^2 + d*x + e
+func SolveQuartic(a, b, c, d, e float64) []float64 {
+	if a == 0 {
+		return SolveCubic(b, c, d, e)
+	}
+
+	A, B, C, D := b/a, c/a, d/a, e/a
+
+	// Substitute x = y - A/4 to eliminate the cubic term: y^4 + p*y^2 + q*y + r = 0
+	sqA := A * A
+	p := -3.0/8*sqA + B
+	q := sqA*A/8 - A*B/2 + C
+	r := -3.0/256*sqA*sqA + sqA*B/16 - A*C/4 + D
+
+	var roots []float64
+
+	if isZero(r) {
+		// No absolute term: y * (y^3 + p*y + q) = 0
+		roots = append(solveNormalCubic(0, p, q), 0)
+	} else {
+		// Solve the resolvent cubic and take the one real root it always has...
+		z := solveNormalCubic(-p/2, -r, r*p/2-q*q/8)[0]
+
+		// ...to build two quadric equations
+		u := z*z - r
+		v := 2*z - p
+
+		switch {
+		case isZero(u):
+			u = 0
+		case u > 0:
+			u = math.Sqrt(u)
+		default:
+			return nil
+		}
+
+		switch {
+		case isZero(v):
+			v = 0
+		case v > 0:
+			v = math.Sqrt(v)
+		default:
+			return nil
+		}
+
+		if q < 0 {
+			v = -v
+		}
+
+		roots = append(SolveQuadratic(1, v, z-u), SolveQuadratic(1, -v, z+u)...)
+	}
+
+	for i := range roots {
+		roots[i] -= A / 4
+	}
+
+	return polish(roots, a, b, c, d, e)
+}
+
+// polish refines the roots of a polynomial with a few Newton iterations, then sorts them:
+// a step is taken only if it gets closer to zero, so that roots don't jump elsewhere
+func polish(roots []float64, coefficients ...float64) []float64 {
+	eval := func(x float64) (f, df float64) {
+		// Horner's method for the polynomial and its derivative
+		f = coefficients[0]
+
+		for _, k := range coefficients[1:] {
+			df = df*x + f
+			f = f*x + k
+		}
+
+		return f, df
+	}
+
+	for i, x := range roots {
+		f, df := eval(x)
+
+		for iter := 0; iter < 4 && f != 0 && df != 0; iter++ {
+			next := x - f/df
+			nf, ndf := eval(next)
+
+			if math.Abs(nf) >= math.Abs(f) {
+				break
+			}
+
+			x, f, df = next, nf, ndf
+		}
+
+		roots[i] = x
+	}
+
+	sort.Float64s(roots)
+
+	return roots
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package maths
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSolveQuadratic(t *testing.T) {
+	check := func(roots []float64, expected ...float64) {
+		t.Helper()
+
+		if !SliceFloatEqual(roots, expected) {
+			t.Errorf("roots are %v, expected %v", roots, expected)
+		}
+	}
+
+	check(SolveQuadratic(1, -3, 2), 1, 2)
+	check(SolveQuadratic(1, 0, 1))
+	check(SolveQuadratic(0, 2, -1), 0.5)
+	check(SolveQuadratic(1, -2, 1), 1, 1)
+	check(SolveQuadratic(1, 1e8, 1), -1e8, -1e-8) // Would lose the small root to cancellation
+}
+
+func TestSolveCubic(t *testing.T) {
+	check := func(roots []float64, expected ...float64) {
+		t.Helper()
+
+		if !SliceFloatEqual(roots, expected) {
+			t.Errorf("roots are %v, expected %v", roots, expected)
+		}
+	}
+
+	// (x-1)(x-2)(x-3)
+	check(SolveCubic(1, -6, 11, -6), 1, 2, 3)
+	// (x+2)(x^2+1)
+	check(SolveCubic(2, 4, 2, 4), -2)
+	// (x-1)^2 (x+1), the double root is returned once
+	check(SolveCubic(1, -1, -1, 1), -1, 1)
+}
+
+func TestSolveQuartic(t *testing.T) {
+	check := func(roots []float64, expected ...float64) {
+		t.Helper()
+
+		if !SliceFloatEqual(roots, expected) {
+			t.Errorf("roots are %v, expected %v", roots, expected)
+		}
+	}
+
+	// (x-1)(x-2)(x-3)(x-4)
+	check(SolveQuartic(1, -10, 35, -50, 24), 1, 2, 3, 4)
+	// (x^2+1)(x-2)(x+5)
+	check(SolveQuartic(1, 3, -9, 3, -10), -5, 2)
+	// (x^2+1)(x^2+4)
+	check(SolveQuartic(1, 0, 5, 0, 4))
+	// x(x-1)(x+1)(x-2)
+	check(SolveQuartic(3, -6, -3, 6, 0), -1, 0, 1, 2)
+
+	// Random roots, scaled as for the intersection of a ray with a torus
+	rand := NewRandomGenerator(1)
+
+	for i := 0; i < 1000; i++ {
+		r := []float64{rand()*10 - 5, rand()*10 - 5, rand()*10 - 5, rand()*10 - 5}
+		k := rand() + 0.5
+
+		// Expand k * (x-r0)(x-r1)(x-r2)(x-r3)
+		c := []float64{k, 0, 0, 0, 0}
+		for n, root := range r {
+			for j := n + 1; j > 0; j-- {
+				c[j] -= root * c[j-1]
+			}
+		}
+
+		roots := SolveQuartic(c[0], c[1], c[2], c[3], c[4])
+
+		for _, root := range r {
+			found := false
+			for _, x := range roots {
+				found = found || math.Abs(x-root) < 1e-4
+			}
+
+			if !found {
+				t.Errorf("root %v of %v not found in %v", root, r, roots)
+			}
+		}
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/traits"
+)
+
+// CompactMesh is a triangle mesh for very large models: vertices are stored as float32 in shared buffers,
+// triangles are just indices into them and the leaves of the BVH reference triangles directly,
+// so there is no object per triangle and intersecting a triangle does not need any interface call
+type CompactMesh struct {
+	Namer
+	Grouper
+	P        []float32 // Vertex positions, three values per vertex
+	N        []float32 // Vertex normals, three values per vertex (optional)
+	UV       []float32 // Texture coordinates, two values per vertex (optional)
+	VI       []uint32  // Vertex indices, three per triangle
+	NI       []uint32  // Normal indices, three per triangle if there are normals
+	TI       []uint32  // Texture coordinates indices, three per triangle if there are texture coordinates
+	FM       []uint16  // Material of each triangle, index into the parts of the mesh
+	parts    []*CompactMeshPart
+	material *Material
+	nodes    []CompactBvhNode
+	bounds   Box
+}
+
+// CompactMeshPart is the set of triangles of a mesh that share a material, it's the object reported by intersections
+type CompactMeshPart struct {
+	mesh     *CompactMesh
+	material *Material // Material of the triangles, if nil the material of the mesh is used
+}
+
+// NewCompactMesh converts the triangles of a group (or all the triangles if group is -1) into a compact mesh
+func NewCompactMesh(info *ObjInfo, group int) *CompactMesh {
+	mesh := &CompactMesh{}
+
+	mesh.material = NewMaterial()
+
+	mesh.SetNameForKind("cmesh")
+	mesh.SetTransform()
+
+	toFloat32 := func(ts []Tuple, n int) []float32 {
+		fs := make([]float32, 0, len(ts)*n)
+		for _, t := range ts {
+			fs = append(fs, float32(t.X), float32(t.Y), float32(t.Z))
+		}
+		if n == 2 {
+			for i := range ts {
+				fs[i*2], fs[i*2+1] = float32(ts[i].X), float32(ts[i].Y)
+			}
+			fs = fs[:len(ts)*2]
+		}
+		return fs
+	}
+
+	mesh.P = toFloat32(info.V, 3)
+	mesh.N = toFloat32(info.VN, 3)
+	mesh.UV = toFloat32(info.VT, 2)
+
+	// Faces without a material use the material of the mesh
+	partIndex := map[*Material]uint16{nil: 0}
+	mesh.parts = []*CompactMeshPart{{mesh: mesh}}
+
+	for _, f := range info.F {
+		if group != -1 && f.G != group {
+			continue
+		}
+
+		m, ok := partIndex[f.M]
+		if !ok {
+			m = uint16(len(mesh.parts))
+			partIndex[f.M] = m
+			mesh.parts = append(mesh.parts, &CompactMeshPart{mesh: mesh, material: f.M})
+		}
+
+		for k := 0; k < 3; k++ {
+			mesh.VI = append(mesh.VI, uint32(f.V[k]))
+
+			if len(mesh.N) > 0 {
+				mesh.NI = append(mesh.NI, uint32(f.VN[k]))
+			}
+
+			if len(mesh.UV) > 0 {
+				mesh.TI = append(mesh.TI, uint32(f.VT[k]))
+			}
+		}
+
+		mesh.FM = append(mesh.FM, m)
+	}
+
+	mesh.bounds = NewBox(PointAtInfinity(+1), PointAtInfinity(-1))
+	for t := 0; t < mesh.Len(); t++ {
+		mesh.bounds = mesh.bounds.Union(mesh.triangleBounds(t))
+	}
+
+	// Build the BVH, then sort the triangles so that each leaf references a range of them
+	nodes, order := NewCompactBvh(mesh.Len(), mesh.triangleBounds)
+
+	mesh.nodes = nodes
+	mesh.VI = permute(mesh.VI, order, 3)
+	mesh.NI = permute(mesh.NI, order, 3)
+	mesh.TI = permute(mesh.TI, order, 3)
+	mesh.FM = permute(mesh.FM, order, 1)
+
+	return mesh
+}
+
+func permute[T any](values []T, order []int, n int) []T {
+	if len(values) == 0 {
+		return values
+	}
+
+	sorted := make([]T, 0, len(values))
+
+	for _, i := range order {
+		sorted = append(sorted, values[i*n:i*n+n]...)
+	}
+
+	return sorted
+}
+
+func (mesh *CompactMesh) vertex(i uint32) Tuple {
+	return Point(float64(mesh.P[i*3]), float64(mesh.P[i*3+1]), float64(mesh.P[i*3+2]))
+}
+
+func (mesh *CompactMesh) triangle(t int) (p1, p2, p3 Tuple) {
+	return mesh.vertex(mesh.VI[t*3]), mesh.vertex(mesh.VI[t*3+1]), mesh.vertex(mesh.VI[t*3+2])
+}
+
+func (mesh *CompactMesh) triangleBounds(t int) Box {
+	p1, p2, p3 := mesh.triangle(t)
+
+	return Box{
+		Min: Point(Min3(p1.X, p2.X, p3.X), Min3(p1.Y, p2.Y, p3.Y), Min3(p1.Z, p2.Z, p3.Z)),
+		Max: Point(Max3(p1.X, p2.X, p3.X), Max3(p1.Y, p2.Y, p3.Y), Max3(p1.Z, p2.Z, p3.Z)),
+	}
+}
+
+// Len returns the number of triangles in the mesh
+func (mesh *CompactMesh) Len() int {
+	return len(mesh.FM)
+}
+
+func (mesh *CompactMesh) Bounds() Box {
+	return mesh.bounds
+}
+
+func (mesh *CompactMesh) Material() *Material {
+	return mesh.material
+}
+
+// SetMaterial sets the material of the whole mesh, replacing the materials of the triangles
+func (mesh *CompactMesh) SetMaterial(m *Material) {
+	mesh.material = m
+
+	for _, p := range mesh.parts {
+		p.material = nil
+	}
+}
+
+// Clone returns a mesh that shares the buffers of the original one
+func (mesh *CompactMesh) Clone() Groupable {
+	o := *mesh
+
+	o.SetName("cmeshfrom_" + mesh.Name())
+	o.SetParent(nil)
+
+	o.parts = make([]*CompactMeshPart, len(mesh.parts))
+	for i, p := range mesh.parts {
+		o.parts[i] = &CompactMeshPart{mesh: &o, material: p.material}
+	}
+
+	return &o
+}
+
+func (mesh *CompactMesh) AddIntersections(ray Ray, xs *Intersections) {
+	if mesh.HiddenFrom(xs) || len(mesh.nodes) == 0 {
+		return
+	}
+
+	ray = ray.Transform(mesh.Tinverse)
+
+	invRay := ray
+	invRay.Direction = Vector(1/ray.Direction.X, 1/ray.Direction.Y, 1/ray.Direction.Z)
+
+	toVisitOffset := 0
+	currentNodeIndex := 0
+	nodesToVisit := [64]int{}
+
+	for {
+		node := &mesh.nodes[currentNodeIndex]
+
+		if node.IntersectsInvDirRange(invRay, math.Inf(-1), xs.PruneDistance()) {
+			if node.Count > 0 {
+				// Leaf: test all triangles
+				for t := int(node.Index); t < int(node.Index+node.Count); t++ {
+					if h, u, v, ok := mesh.intersectTriangle(t, ray); ok {
+						id := xs.AddWithData(mesh.parts[mesh.FM[t]], h)
+
+						id.TU = u
+						id.TV = v
+						id.Index = t
+					}
+				}
+
+				if toVisitOffset == 0 {
+					break
+				}
+
+				toVisitOffset--
+				currentNodeIndex = nodesToVisit[toVisitOffset]
+			} else {
+				// Interior: put one child on stack and advance to the other
+				currentNodeIndex = currentNodeIndex + 1
+				nodesToVisit[toVisitOffset] = int(node.Index) // Index of second child
+				toVisitOffset++
+			}
+		} else {
+			if toVisitOffset == 0 {
+				break
+			}
+
+			toVisitOffset--
+			currentNodeIndex = nodesToVisit[toVisitOffset]
+		}
+	}
+}
+
+func (mesh *CompactMesh) Occludes(ray Ray, xs *Intersections) bool {
+	if mesh.HiddenFrom(xs) || len(mesh.nodes) == 0 {
+		return false
+	}
+
+	ray = ray.Transform(mesh.Tinverse)
+
+	invRay := ray
+	invRay.Direction = Vector(1/ray.Direction.X, 1/ray.Direction.Y, 1/ray.Direction.Z)
+
+	toVisitOffset := 0
+	currentNodeIndex := 0
+	nodesToVisit := [64]int{}
+
+	for {
+		node := &mesh.nodes[currentNodeIndex]
+
+		if node.IntersectsInvDirRange(invRay, ray.TMin, ray.TMax) {
+			if node.Count > 0 {
+				for t := int(node.Index); t < int(node.Index+node.Count); t++ {
+					if h, _, _, ok := mesh.intersectTriangle(t, ray); ok && ray.InExtent(h) {
+						return true
+					}
+				}
+
+				if toVisitOffset == 0 {
+					break
+				}
+
+				toVisitOffset--
+				currentNodeIndex = nodesToVisit[toVisitOffset]
+			} else {
+				currentNodeIndex = currentNodeIndex + 1
+				nodesToVisit[toVisitOffset] = int(node.Index)
+				toVisitOffset++
+			}
+		} else {
+			if toVisitOffset == 0 {
+				break
+			}
+
+			toVisitOffset--
+			currentNodeIndex = nodesToVisit[toVisitOffset]
+		}
+	}
+
+	return false
+}
+
+func (mesh *CompactMesh) intersectTriangle(t int, ray Ray) (h, u, v float64, ok bool) {
+	p1, p2, p3 := mesh.triangle(t)
+
+	return IntersectTriangle(ray, p1, p2, p3)
+}
+
+func (p *CompactMeshPart) Material() *Material {
+	if p.material != nil {
+		return p.material
+	}
+
+	return p.mesh.material
+}
+
+// Name and Parent let light links find the mesh and the groups that contain it
+func (p *CompactMeshPart) Name() string {
+	return p.mesh.Name()
+}
+
+func (p *CompactMeshPart) Parent() Container {
+	return p.mesh
+}
+
+func (p *CompactMeshPart) WorldToObject(point Tuple) Tuple {
+	return p.mesh.WorldToObject(point)
+}
+
+func (p *CompactMeshPart) NormalAtHit(ii *IntersectionInfo, xs *Intersections) Tuple {
+	mesh := p.mesh
+	id := xs.Data(&ii.Intersection)
+	t := id.Index
+	w := 1 - id.TU - id.TV
+
+	// Texture
+	var uv1, uv2, uv3 Tuple
+
+	if len(mesh.TI) > 0 {
+		uv := func(k int) Tuple {
+			i := mesh.TI[t*3+k]
+			return Point(float64(mesh.UV[i*2]), float64(mesh.UV[i*2+1]), 0)
+		}
+
+		uv1, uv2, uv3 = uv(0), uv(1), uv(2)
+
+		vt := uv2.Mul(id.TU).Add(uv3.Mul(id.TV)).Add(uv1.Mul(w))
+		ii.U = vt.X
+		ii.V = vt.Y
+	}
+
+	// Normal
+	p1, p2, p3 := mesh.triangle(t)
+	e1 := p2.Sub(p1)
+	e2 := p3.Sub(p1)
+	N := e2.CrossProduct(e1).Normalize()
+
+	if len(mesh.NI) > 0 {
+		n := func(k int) Tuple {
+			i := mesh.NI[t*3+k]
+			return Vector(float64(mesh.N[i*3]), float64(mesh.N[i*3+1]), float64(mesh.N[i*3+2]))
+		}
+
+		N = n(1).Mul(id.TU).Add(n(2).Mul(id.TV)).Add(n(0).Mul(w))
+	}
+
+	// Apply normal map if present, tangent and bitangent are computed from the texture coordinates
+	if nmap := ii.GetNormalMap(); nmap != nil && len(mesh.TI) > 0 {
+		nm := nmap.NormalAtHit(ii)
+
+		u1, v1 := uv2.X-uv1.X, uv2.Y-uv1.Y
+		u2, v2 := uv3.X-uv1.X, uv3.Y-uv1.Y
+
+		d := 1 / (u1*v2 - v1*u2)
+
+		T := Vector(e1.X*v2-e2.X*v1, e1.Y*v2-e2.Y*v1, e1.Z*v2-e2.Z*v1).Mul(d).Normalize()
+		B := Vector(e2.X*u1-e1.X*u2, e2.Y*u1-e1.Y*u2, e2.Z*u1-e1.Z*u2).Mul(d).Normalize()
+
+		if !math.IsNaN(T.X + B.X) {
+			ii.SurfNormalv = (T.Mul(nm.X).Add(B.Mul(nm.Y)).Add(N.Mul(nm.Z))).Normalize()
+			ii.HasSurfNormalv = true
+		}
+	}
+
+	return mesh.NormalToWorld(N)
+}
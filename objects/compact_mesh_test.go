@@ -0,0 +1,103 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"math"
+	"testing"
+
+	. "ascottix/funtracer/engine"
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+)
+
+func TestCompactMesh(t *testing.T) {
+	info := ParseWavefrontObjFromFile("../objects_testdata/cow.obj")
+	info.Normalize()
+	info.Autosmooth()
+
+	g := NewGroup()
+	NewTrimesh(info, -1).AddToGroup(g)
+	g.BuildBVH()
+
+	mesh := NewCompactMesh(info, -1)
+
+	if mesh.Len() != len(info.F) {
+		t.Fatalf("compact mesh has %d triangles, expected %d", mesh.Len(), len(info.F))
+	}
+
+	for i := 0; i < 400; i++ {
+		r := NewRay(Point(float64(i%20)/10-1, float64(i/20)/10-1, -3), Vector(0.01, 0.02, 1))
+
+		xs1 := NewIntersections()
+		g.AddIntersections(r, xs1)
+
+		xs2 := NewIntersections()
+		mesh.AddIntersections(r, xs2)
+
+		h1, h2 := xs1.Hit(), xs2.Hit()
+
+		if h1.Valid() != h2.Valid() {
+			t.Fatalf("ray %d: hit differs: %+v %+v", i, h1, h2)
+		}
+
+		if !h1.Valid() {
+			continue
+		}
+
+		// Vertices are stored as float32, so results differ slightly
+		if math.Abs(h1.T-h2.T) > 1e-5 {
+			t.Errorf("ray %d: distance differs: %v %v", i, h1.T, h2.T)
+		}
+
+		n1 := NewIntersectionInfo(h1, r, xs1).Normalv
+		n2 := NewIntersectionInfo(h2, r, xs2).Normalv
+
+		if n1.Sub(n2).Length() > 1e-3 {
+			t.Errorf("ray %d: normal differs: %v %v", i, n1, n2)
+		}
+	}
+}
+
+func TestCompactMeshLightLinks(t *testing.T) {
+	info := ParseWavefrontObjFromFile("../objects_testdata/cow.obj")
+	info.Normalize()
+
+	mesh := NewCompactMesh(info, -1)
+	mesh.SetName("cow")
+
+	g := NewGroup()
+	g.SetName("farm")
+	g.Add(mesh)
+	g.BuildBVH()
+
+	xs := NewIntersections()
+	g.AddIntersections(NewRay(Point(0, 0, -3), Vector(0, 0, 1)), xs)
+
+	hit := xs.Hit()
+	if !hit.Valid() {
+		t.Fatalf("mesh not hit")
+	}
+
+	// Meshes are linked by their own name and by the name of their group
+	light := NewPointLight(Point(0, 0, -5), White)
+
+	for _, name := range []string{"cow", "farm"} {
+		light.LightLinks = LightLinks{}
+		light.Include(name)
+
+		if !light.Illuminates(hit.O) {
+			t.Errorf("mesh included by %q should be lit", name)
+		}
+
+		light.LightLinks = LightLinks{}
+		light.Exclude(name)
+
+		if light.Illuminates(hit.O) {
+			t.Errorf("mesh excluded by %q should not be lit", name)
+		}
+	}
+}
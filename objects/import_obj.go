@@ -7,6 +7,7 @@ package objects
 import (
 	"bufio"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -30,6 +31,21 @@ type ObjInfoFace struct {
 	M  *Material
 }
 
+// ObjInfoPolygon is a face as specified in the file, before it's split into triangles
+type ObjInfoPolygon struct {
+	V  []int // Indices in vertex array
+	VN []int // Indices in vertex normals array
+	VT []int // Indices in texture vertex array
+	G  int   // Group
+	M  *Material
+}
+
+// ObjInfoCrease is an edge that stays sharp when the mesh is subdivided, see Subdivide
+type ObjInfoCrease struct {
+	V         [2]int  // Indices in vertex array
+	Sharpness float64 // Number of levels of subdivision before the edge becomes smooth, may be fractional
+}
+
 type ObjInfoGroup struct {
 	Name string
 }
@@ -39,8 +55,37 @@ type ObjInfo struct {
 	VN        []Tuple
 	VT        []Tuple
 	F         []ObjInfoFace
+	P         []ObjInfoPolygon // Faces before triangulation, kept only if needed for subdivision
+	Creases   []ObjInfoCrease
 	Groups    []ObjInfoGroup
 	Materials map[string]*Material
+	Mtllibs   []string // Material libraries, as specified in the file
+
+	keepPolygons bool
+}
+
+// ObjParserOptions changes what is kept of the file
+type ObjParserOptions struct {
+	KeepPolygons bool // Keep the faces before triangulation, which Subdivide needs
+}
+
+// AddPolygon adds the triangles that make a polygon to the faces, and the polygon itself if polygons are kept
+func (o *ObjInfo) AddPolygon(p ObjInfoPolygon) {
+	if o.keepPolygons {
+		o.P = append(o.P, p)
+	}
+
+	for i := 2; i < len(p.V); i++ {
+		f := ObjInfoFace{
+			V:  [3]int{p.V[0], p.V[i-1], p.V[i]},
+			VN: [3]int{p.VN[0], p.VN[i-1], p.VN[i]},
+			VT: [3]int{p.VT[0], p.VT[i-1], p.VT[i]},
+			G:  p.G,
+			M:  p.M,
+		}
+
+		o.F = append(o.F, f)
+	}
 }
 
 func (o *ObjInfo) Bounds() Box {
@@ -206,8 +251,14 @@ func ParseWavefrontMtllib(rd io.Reader, info *ObjInfo, dir string) {
 }
 
 func ParseWavefrontObj(rd io.Reader, dir string) *ObjInfo {
+	return ParseWavefrontObjWithOptions(rd, dir, ObjParserOptions{})
+}
+
+func ParseWavefrontObjWithOptions(rd io.Reader, dir string, options ObjParserOptions) *ObjInfo {
 	info := new(ObjInfo)
 
+	info.keepPolygons = options.KeepPolygons
+
 	info.Groups = []ObjInfoGroup{{Name: "default"}}
 	info.Materials = make(map[string]*Material)
 
@@ -267,6 +318,7 @@ func ParseWavefrontObj(rd io.Reader, dir string) *ObjInfo {
 			case "mtllib":
 				// Open material library
 				filename := strings.TrimSpace(line[7:])
+				info.Mtllibs = append(info.Mtllibs, filename)
 				if f := openObjDependency(filename, dir); f != nil {
 					ParseWavefrontMtllib(f, info, dir)
 					f.Close()
@@ -278,20 +330,33 @@ func ParseWavefrontObj(rd io.Reader, dir string) *ObjInfo {
 				Debugln("Using material", name)
 			case "f":
 				// Polygon
-				i1, t1, n1 := f2cs(s[1])
-				for i := 3; i < len(s); i++ {
-					i2, t2, n2 := f2cs(s[i-1])
-					i3, t3, n3 := f2cs(s[i-0])
-
-					f := ObjInfoFace{
-						V:  [3]int{i1 - 1, i2 - 1, i3 - 1},
-						VN: [3]int{n1 - 1, n2 - 1, n3 - 1},
-						VT: [3]int{t1 - 1, t2 - 1, t3 - 1},
-						G:  len(info.Groups) - 1,
-						M:  mat,
+				p := ObjInfoPolygon{G: len(info.Groups) - 1, M: mat}
+				for i := 1; i < len(s); i++ {
+					v, t, n := f2cs(s[i])
+					p.V = append(p.V, v-1)
+					p.VN = append(p.VN, n-1)
+					p.VT = append(p.VT, t-1)
+				}
+
+				if len(p.V) >= 3 {
+					info.AddPolygon(p)
+				}
+			case "t":
+				// Tag as in OpenSubdiv, e.g. "t crease 2/1 0 1 2.5" for the edge between the first two vertices
+				// (numbered from 0) with sharpness 2.5, or more vertices for a chain of edges
+				if len(s) > 3 && s[1] == "crease" {
+					n := strings.Split(s[2], "/")
+					ints := s2i(n[0])
+					sharpness := math.Inf(+1)
+
+					if len(s) > 3+ints {
+						sharpness = s2f(s[3+ints])
 					}
 
-					info.F = append(info.F, f)
+					for i := 1; i < ints && 3+i < len(s); i++ {
+						c := ObjInfoCrease{V: [2]int{s2i(s[2+i]), s2i(s[3+i])}, Sharpness: sharpness}
+						info.Creases = append(info.Creases, c)
+					}
 				}
 			case "g":
 				// Group
@@ -324,12 +389,16 @@ func ParseWavefrontObjFromString(src string) *ObjInfo {
 }
 
 func ParseWavefrontObjFromFile(filename string) *ObjInfo {
+	return ParseWavefrontObjFromFileWithOptions(filename, ObjParserOptions{})
+}
+
+func ParseWavefrontObjFromFileWithOptions(filename string, options ObjParserOptions) *ObjInfo {
 	f, err := os.Open(filename)
 
 	if err == nil {
 		defer f.Close()
 
-		return ParseWavefrontObj(f, filepath.Dir(filename))
+		return ParseWavefrontObjWithOptions(f, filepath.Dir(filename), options)
 	}
 
 	panic(err)
@@ -23,6 +23,7 @@ import (
 
 type SbtParserOptions struct {
 	FilenameBase string
+	CacheDir     string // If not empty, meshes and their BVH are cached in this directory
 }
 
 // ParseSbtScene parses a scene description based on the .ray format, see:
@@ -50,6 +51,7 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 
 	// Init object library
 	objects := make(map[string]Groupable)
+	prototypes := make(map[string]Groupable) // Geometry shared by the instances of an object
 
 	// Init material library
 	materials := make(map[string]*Material)
@@ -174,6 +176,18 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 		return v
 	}
 
+	parseBool := func() (f bool) {
+		match('=')
+		if check("true") {
+			f = true
+		} else if !check("false") {
+			raise()
+		}
+		check(";")
+
+		return
+	}
+
 	parsePragma := func() {
 		pragma := parseString()
 
@@ -191,10 +205,32 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 		fov := Pi / 2
 		w := 0
 		h := 0
+		projection := ProjectionPerspective
+		orthosize := 2.0
+		stereo := StereoParams{Interocular: 0.065}
+		lensRadius := 0.0
+		focalDistance := 0.0
+		var aperture Aperture
+		blades := 0
+		bladesRotation := 0.0
+		var physical *PhysicalCamera
+		var autofocus *AutoFocus
+		name := ""
+
+		// Physical camera parameters are optional, the camera becomes physical as soon as one is specified
+		getPhysical := func() *PhysicalCamera {
+			if physical == nil {
+				physical = NewPhysicalCamera()
+			}
+
+			return physical
+		}
 
 		match('{')
 		for !check("}") {
 			switch {
+			case check("name"): // Used to select the camera to render when there are many
+				name = parseString()
 			case check("position"):
 				pos = Point(parseTuple())
 			case check("viewdir"):
@@ -213,14 +249,113 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 				w = int(parseFloat())
 				h = int(matchFloat())
 				match(';')
+			case check("projection"):
+				switch parseString() {
+				case "perspective":
+					projection = ProjectionPerspective
+				case "orthographic":
+					projection = ProjectionOrthographic
+				case "fisheye":
+					projection = ProjectionFisheye
+				case "fisheye_equisolid":
+					projection = ProjectionFisheyeEquisolid
+				case "equirectangular":
+					projection = ProjectionEquirectangular
+				default:
+					raise()
+				}
+			case check("orthosize"): // Width of the view in world units for the orthographic projection
+				orthosize = parseFloat()
+			case check("stereo"):
+				switch parseString() {
+				case "none":
+					stereo.Stereo = StereoNone
+				case "side_by_side":
+					stereo.Stereo = StereoSideBySide
+				case "over_under":
+					stereo.Stereo = StereoOverUnder
+				case "anaglyph":
+					stereo.Stereo = StereoAnaglyph
+				default:
+					raise()
+				}
+			case check("interocular"):
+				stereo.Interocular = parseFloat()
+			case check("convergence"):
+				stereo.Convergence = parseFloat()
+			case check("toe_in"):
+				stereo.ToeIn = parseBool()
+			case check("lens_radius"):
+				lensRadius = parseFloat()
+			case check("focal_distance"):
+				focalDistance = parseFloat()
+			case check("focal_length"): // In millimeters
+				getPhysical().FocalLength = parseFloat()
+			case check("sensor_width"): // In millimeters
+				getPhysical().SensorWidth = parseFloat()
+			case check("fstop"):
+				getPhysical().FNumber = parseFloat()
+			case check("shutter"): // In seconds
+				getPhysical().ShutterSpeed = parseFloat()
+			case check("iso"):
+				getPhysical().ISO = parseFloat()
+			case check("meters_per_unit"):
+				getPhysical().MetersPerUnit = parseFloat()
+			case check("aperture_blades"):
+				blades = int(parseFloat())
+			case check("aperture_rotation"): // In degrees
+				bladesRotation = DegToRad(parseFloat())
+			case check("aperture_image"):
+				filename := parseString()
+				if _, err := os.Stat(filename); os.IsNotExist(err) && options != nil {
+					filename = filepath.Join(options.FilenameBase, filename)
+				}
+
+				a, err := LoadImageAperture(filename)
+				if err != nil {
+					panic(err)
+				}
+				aperture = a
+			case check("focus"): // Autofocus on a named object
+				autofocus = &AutoFocus{Object: parseString()}
+			case check("focus_point"): // Autofocus on a point of the image, in [0,1]x[0,1]
+				x := parseFloat()
+				y := matchFloat()
+				match(';')
+				autofocus = &AutoFocus{X: x, Y: y}
 
 			default:
 				raise()
 			}
 		}
 
-		scene.Camera = NewCamera(w, h, fov)
-		scene.Camera.SetTransform(EyeViewpoint(pos, pos.Add(dir), upd))
+		camera := NewCamera(w, h, fov)
+		camera.SetName(name)
+		camera.SetProjection(projection, orthosize)
+		camera.StereoParams = stereo
+		if blades > 0 {
+			aperture = NewBladedAperture(blades, bladesRotation)
+		}
+
+		camera.LensRadius = lensRadius
+		camera.FocalDistance = focalDistance
+		camera.Aperture = aperture
+		camera.AutoFocus = autofocus
+
+		if physical != nil {
+			camera.SetPhysical(physical)
+		}
+
+		if camera.LensRadius > 0 && focalDistance == 0 && autofocus == nil {
+			camera.AutoFocus = &AutoFocus{X: 0.5, Y: 0.5} // Focus on the center of the image by default
+		}
+		camera.SetTransform(EyeViewpoint(pos, pos.Add(dir), upd))
+
+		if scene.FindCamera(camera.Name()) != nil {
+			panic(fmt.Errorf("duplicate camera '%s'", camera.Name()))
+		}
+
+		scene.AddCamera(camera)
 	}
 
 	parseAmbientLight := func() {
@@ -239,44 +374,64 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 		scene.World.Ambient = scene.World.Ambient.Add(col)
 	}
 
+	// parseLightBlock parses the attributes shared by all lights, the colour and the light links which restrict
+	// the light to (or keep it away from) some named objects, while checkAttribute parses those of the kind of light
+	parseLightBlock := func(checkAttribute func() bool) (col Color, links LightLinks) {
+		match('{')
+		for !check("}") {
+			switch {
+			case checkAttribute():
+				// Nothing to do
+			case check("colour"), check("color"):
+				col = RGB(parseTuple())
+			case check("include"):
+				links.Include(parseString())
+			case check("exclude"):
+				links.Exclude(parseString())
+			default:
+				raise()
+			}
+		}
+
+		return
+	}
+
 	parsePointLight := func() {
 		var pos Tuple
-		var col Color
 
-		match('{')
-		for !check("}") {
+		col, links := parseLightBlock(func() bool {
 			switch {
 			case check("position"):
 				pos = Point(parseTuple())
-			case check("colour"), check("color"):
-				col = RGB(parseTuple())
 			case check("constant_attenuation_coeff"), check("linear_attenuation_coeff"), check("quadratic_attenuation_coeff"):
 				parseFloat() // Ignored
 			default:
-				raise()
+				return false
 			}
-		}
 
-		scene.World.AddLights(NewPointLight(pos, col))
+			return true
+		})
+
+		light := NewPointLight(pos, col)
+		light.LightLinks = links
+		scene.World.AddLights(light)
 	}
 
 	parseDirectionalLight := func() {
 		var dir Tuple
-		var col Color
 
-		match('{')
-		for !check("}") {
-			switch {
-			case check("direction"):
+		col, links := parseLightBlock(func() bool {
+			if check("direction") {
 				dir = Vector(parseTuple())
-			case check("colour"), check("color"):
-				col = RGB(parseTuple())
-			default:
-				raise()
+				return true
 			}
-		}
 
-		scene.World.AddLights(NewDirectionalLight(dir, col))
+			return false
+		})
+
+		light := NewDirectionalLight(dir, col)
+		light.LightLinks = links
+		scene.World.AddLights(light)
 	}
 
 	checkTransform := func(t Matrix) (Matrix, int) {
@@ -453,6 +608,14 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 		}
 	}
 
+	setVisibility := func(object Groupable, flag Visibility, f bool) {
+		if f {
+			object.SetVisibility(object.Visibility() | flag)
+		} else {
+			object.SetVisibility(object.Visibility() &^ flag)
+		}
+	}
+
 	checkStandardAttributes := func(object Groupable) bool {
 		f := true
 
@@ -463,6 +626,14 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 			match('=')
 			material, _ := parseMaterial()
 			object.SetMaterial(material)
+		case check("visible_to_camera"):
+			setVisibility(object, VisibleToCamera, parseBool())
+		case check("visible_in_reflections"):
+			setVisibility(object, VisibleInReflections, parseBool())
+		case check("visible_in_refractions"):
+			setVisibility(object, VisibleInRefractions, parseBool())
+		case check("cast_shadows"):
+			setVisibility(object, CastsShadows, parseBool())
 		default:
 			f = false
 		}
@@ -475,8 +646,15 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 		g.SetTransform(transform)
 
 		autosmooth := false
+		compact := false
+		subdivide := 0
 		var info *ObjInfo
 
+		// Meshes can be cached only if they are alone in the group
+		objfiles := 0
+		cacheKey := ""
+		var cachedBvh *Bvh
+
 		match('{')
 		for !check("}") {
 			switch {
@@ -488,32 +666,160 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 					filename = filepath.Join(options.FilenameBase, filename)
 				}
 
-				info = ParseWavefrontObjFromFile(filename)
+				objfiles++
+				cacheKey = ""
+
+				// Compact meshes have their own BVH, so they can be cached even if they are not alone
+				if options != nil && options.CacheDir != "" && (objfiles == 1 || compact) {
+					key, err := MeshCacheKey(filename, autosmooth, compact, subdivide, transform)
+					if err != nil {
+						panic(err)
+					}
+
+					if compact {
+						mesh, err := LoadCompactMeshCache(options.CacheDir, key, filepath.Dir(filename))
+						if err != nil {
+							Debugln("*** Warning: cannot use mesh cache:", err)
+						}
+
+						if mesh != nil {
+							Debugf("%d triangles loaded from cache of %q\n", mesh.Len(), filename)
+
+							g.Add(mesh)
+							break
+						}
+					} else {
+						mesh, bvh, err := LoadMeshCache(options.CacheDir, key, filepath.Dir(filename))
+						if err != nil {
+							Debugln("*** Warning: cannot use mesh cache:", err)
+						}
+
+						if mesh != nil {
+							Debugf("%d triangles loaded from cache of %q\n", len(mesh.T), filename)
+
+							mesh.AddToGroup(g)
+							cachedBvh = bvh
+							break
+						}
+					}
+
+					cacheKey = key
+				}
+
+				info = ParseWavefrontObjFromFileWithOptions(filename, ObjParserOptions{KeepPolygons: subdivide > 0})
 				Debugf("%d triangles loaded from %q\n", len(info.F), filename)
 
+				if subdivide > 0 {
+					info.Subdivide(subdivide)
+					info.P = nil // Only the triangles are needed from now on
+					Debugf("%d triangles after subdivision\n", len(info.F))
+				}
+
 				info.Normalize()
 
 				if autosmooth {
 					info.Autosmooth()
 				}
 
+				if compact {
+					mesh := NewCompactMesh(info, -1)
+					g.Add(mesh)
+
+					if cacheKey != "" {
+						if err := SaveCompactMeshCache(options.CacheDir, cacheKey, info, mesh); err != nil {
+							Debugln("*** Warning: cannot save mesh cache:", err)
+						}
+
+						cacheKey = ""
+					}
+
+					info = nil // The mesh has its own copy of everything, the faces can go
+					break
+				}
+
 				mesh := NewTrimesh(info, -1)
 				mesh.AddToGroup(g)
 			case check("gennormals"):
+				autosmooth = parseBool()
+			case check("compact"):
+				compact = parseBool()
+			case check("subdivide"): // Levels of subdivision, applies to the following objfiles
+				subdivide = int(parseFloat())
+			default:
+				raise()
+			}
+		}
+
+		if cachedBvh != nil && objfiles == 1 {
+			g.SetBvh(cachedBvh)
+		} else {
+			g.BuildBVH() // For now, always build a BVH
+
+			if cacheKey != "" && objfiles == 1 {
+				if err := SaveMeshCache(options.CacheDir, cacheKey, info, g); err != nil {
+					Debugln("*** Warning: cannot save mesh cache:", err)
+				}
+			}
+		}
+
+		add(g)
+	}
+
+	parseHeightfield := func(transform Matrix) {
+		hf := &Heightfield{}
+		object := NewShape("heightfield", hf)
+
+		// Heights come from an image or from noise on a grid of the specified size
+		filename := ""
+		size := 0
+		frequency := 4.0
+
+		match('{')
+		for !check("}") {
+			switch {
+			case checkStandardAttributes(object):
+				// Nothing to do
+			case check("color"):
 				match('=')
-				if check("true") {
-					autosmooth = true
-				} else {
-					check("false")
+				object.Material().SetPattern(NewSolidColorPattern(parseColor()))
+				check(";")
+			case check("image"):
+				filename = parseString()
+				if _, err := os.Stat(filename); os.IsNotExist(err) && options != nil {
+					filename = filepath.Join(options.FilenameBase, filename)
 				}
-				match(';')
+			case check("noise"):
+				size = int(parseFloat())
+			case check("frequency"):
+				frequency = parseFloat()
+			case check("scale"): // The heightfield goes from -1 to +1 along x and z, and from 0 to 1 along y
+				transform = transform.Mul(Scaling(parseTuple()))
 			default:
 				raise()
 			}
 		}
 
-		g.BuildBVH() // For now, always build a BVH
-		add(g)
+		switch {
+		case filename != "":
+			w, h, heights, err := LoadHeightsFromImage(filename)
+			if err != nil {
+				panic(err)
+			}
+			if err := hf.SetHeights(w, h, heights); err != nil {
+				panic(fmt.Errorf("image %q: %v", filename, err))
+			}
+			Debugf("%dx%d heights loaded from %q\n", w, h, filename)
+		case size != 0:
+			if err := hf.SetHeights(size, size, HeightsFromNoise(size, size, frequency)); err != nil {
+				panic(fmt.Errorf("noise: %v", err))
+			}
+		default:
+			panic(errors.New("heightfield needs an image or noise"))
+		}
+
+		object.SetTransform(transform)
+
+		add(object)
 	}
 
 	var parseObject func()
@@ -569,18 +875,63 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 			raise()
 		}
 
-		s := object.Clone()
-
 		match('{')
+
+		// Attributes are collected into an instance of the object, which is cheap to create,
+		// because the kind of clone is known only when the whole block has been parsed
+		attrs := NewInstance(object)
+		attrs.SetVisibility(object.Visibility())
+		defaultName := attrs.Name()
+		instance := false
+
 		for !check("}") {
 			switch {
-			case checkStandardAttributes(s):
+			case checkStandardAttributes(attrs):
 				// Nothing to do
+			case check("instance"):
+				instance = parseBool()
 			default:
 				raise()
 			}
 		}
 
+		var s Groupable
+
+		if instance {
+			// Instances share the geometry of the object, instead of copying it
+			prototype := prototypes[name]
+			if prototype == nil {
+				prototype = object
+
+				// The geometry is seen thru the parents of the object when shading, so only a top-level object can be shared as is
+				if p, ok := object.(interface{ Parent() Container }); ok && p.Parent() != nil {
+					prototype = object.Clone()
+					prototype.SetTransform()
+				}
+
+				if g, ok := prototype.(*Group); ok && g.Bvh() == nil {
+					g.BuildBVH()
+				}
+
+				prototypes[name] = prototype
+			}
+
+			// Like a copy, the instance replaces the transform of the object with its own
+			s = NewInstance(prototype)
+			transform = transform.Mul(prototype.InverseTransform())
+		} else {
+			s = object.Clone()
+		}
+
+		if attrs.Name() != defaultName {
+			s.SetName(attrs.Name())
+		}
+
+		if m := attrs.Material(); m != nil {
+			s.SetMaterial(m)
+		}
+
+		s.SetVisibility(attrs.Visibility())
 		s.SetTransform(transform)
 
 		add(s)
@@ -642,8 +993,56 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 			shape(NewCone(miny, maxy, false), t)
 		case check("plane"):
 			shape(NewPlane(), t)
+		case check("disk"):
+			shape(NewDisk(), t)
+		case check("annulus"):
+			inner := matchFloat()
+			outer := matchFloat()
+			shape(NewAnnulus(inner, outer), t)
+		case check("torus"):
+			major := matchFloat()
+			minor := matchFloat()
+			shape(NewTorus(major, minor), t)
+		case check("paraboloid"):
+			miny := matchFloat()
+			maxy := matchFloat()
+			shape(NewParaboloid(miny, maxy), t)
+		case check("hyperboloid"):
+			miny := matchFloat()
+			maxy := matchFloat()
+			k := matchFloat()
+			shape(NewHyperboloid(miny, maxy, k), t)
+		case check("quadric"):
+			// Coefficients of a x² + b y² + c z² + d xy + e xz + f yz + g x + h y + i z + j = 0, optionally followed
+			// by the min and max corners of the clip box, e.g. (-1, 0, -1) (1, 2, 1), which is the unit cube otherwise
+			k := [10]float64{}
+			for i := range k {
+				k[i] = matchFloat()
+			}
+			q := QuadricMatrix(k[0], k[1], k[2], k[3], k[4], k[5], k[6], k[7], k[8], k[9])
+
+			matchPoint := func() Tuple {
+				match('(')
+				x := matchFloat()
+				y := matchFloat()
+				z := matchFloat()
+				match(')')
+
+				return Point(x, y, z)
+			}
+
+			clip := NewBox(Point(-1, -1, -1), Point(+1, +1, +1))
+			if tokenText == "(" {
+				min := matchPoint()
+				max := matchPoint()
+				clip = NewBox(min, max)
+			}
+
+			shape(NewQuadric(q, clip), t)
 		case check("polymesh"):
 			parsePolymesh(t)
+		case check("heightfield"):
+			parseHeightfield(t)
 		case check("intersect"):
 			parseCsg(CsgIntersection, t)
 		case check("diff"):
@@ -687,6 +1086,13 @@ func ParseSbtScene(reader io.Reader, options *SbtParserOptions) (scene *Scene, e
 		}
 	}
 
+	// Cameras may be declared before the objects they focus on, so they are checked at the end
+	for _, c := range scene.Cameras {
+		if af := c.AutoFocus; af != nil && af.Object != "" && scene.World.Find(af.Object) == nil {
+			panic(fmt.Errorf("cannot find '%s' for autofocus of camera '%s'", af.Object, c.Name()))
+		}
+	}
+
 	return
 }
 
@@ -695,13 +1101,19 @@ func ParseSbtSceneFromString(src string) (*Scene, error) {
 }
 
 func ParseSbtSceneFromFile(filename string) (*Scene, error) {
+	return ParseSbtSceneFromFileWithOptions(filename, SbtParserOptions{})
+}
+
+// ParseSbtSceneFromFileWithOptions parses a scene file, relative filenames in the scene
+// are resolved from the directory of the file unless options specify otherwise
+func ParseSbtSceneFromFileWithOptions(filename string, options SbtParserOptions) (*Scene, error) {
 	f, err := os.Open(filename)
 
 	if err == nil {
 		defer f.Close()
 
-		options := SbtParserOptions{
-			FilenameBase: filepath.Dir(filename),
+		if options.FilenameBase == "" {
+			options.FilenameBase = filepath.Dir(filename)
 		}
 
 		return ParseSbtScene(f, &options)
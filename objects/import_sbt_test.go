@@ -5,8 +5,21 @@
 package objects
 
 import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	. "ascottix/funtracer/engine"
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/options"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
 	. "ascottix/funtracer/utils"
 )
 
@@ -509,3 +522,411 @@ translate(-3, 1.5, -1, rotate_x(1, rotate_z(1,
 		t.Errorf("teapot scene failed: %s", err)
 	}
 }
+
+func TestSbtLightLinks(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+point_light {
+	position = (0, 5, 0);
+	include = "ball";
+	colour = (1, 1, 1);
+}
+
+directional_light {
+	exclude = "ball";
+	direction = (0, -1, 0);
+	colour = (1, 1, 1);
+}
+
+sphere { name = "ball"; }
+translate(3, 0, 0, sphere { name = "other"; })
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil || len(s.World.Lights) != 2 {
+		t.Fatalf("lights not parsed: %v", err)
+	}
+
+	ball := s.World.Find("ball").(Hittable)
+	other := s.World.Find("other").(Hittable)
+
+	// All kinds of lights are linked the same way
+	point := s.World.Lights[0].(*PointLight)
+	directional := s.World.Lights[1].(*DirectionalLight)
+
+	if !point.Illuminates(ball) || point.Illuminates(other) {
+		t.Errorf("point light should light only the ball")
+	}
+
+	if directional.Illuminates(ball) || !directional.Illuminates(other) {
+		t.Errorf("directional light should light all but the ball")
+	}
+}
+
+func TestSbtCameraProjection(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+camera {
+	position = (0, 10, 0);
+	target = (0, 0, 0);
+	updir = (0, 0, 1);
+	projection = "orthographic";
+	orthosize = 8;
+	viewsize = 200, 100;
+}
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil || s.Camera.Projection != ProjectionOrthographic || s.Camera.OrthoSize != 8 {
+		t.Fatalf("orthographic camera not parsed: %v", err)
+	}
+
+	if r := s.Camera.RayForPixel(0, 0); !r.Direction.Equals(Vector(0, -1, 0)) || !FloatEqual(r.Origin.Z, 2) {
+		t.Errorf("bad orthographic ray: %+v", r)
+	}
+
+	for _, p := range []string{"perspective", "fisheye", "fisheye_equisolid", "equirectangular"} {
+		if _, err := ParseSbtSceneFromString("FUN-raytracer 1.0 camera { projection = \"" + p + "\"; }"); err != nil {
+			t.Errorf("projection %s not parsed: %v", p, err)
+		}
+	}
+
+	if _, err := ParseSbtSceneFromString(`FUN-raytracer 1.0 camera { projection = "cubic"; }`); err == nil {
+		t.Errorf("unknown projection should fail")
+	}
+}
+
+func TestSbtCameraStereo(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+camera {
+	stereo = "over_under";
+	interocular = 0.1;
+	convergence = 3;
+	toe_in = true;
+}
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil || s.Camera.Stereo != StereoOverUnder || s.Camera.Interocular != 0.1 || s.Camera.Convergence != 3 || !s.Camera.ToeIn {
+		t.Errorf("stereo camera not parsed: %v %+v", err, s.Camera.StereoParams)
+	}
+}
+
+func TestSbtPhysicalCamera(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+camera {
+	viewsize = 300, 200;
+	focal_length = 50;
+	fstop = 2;
+	shutter = 0.5;
+	iso = 200;
+	aperture_blades = 5;
+	aperture_rotation = 90;
+	focus = "ball";
+}
+
+group {
+	translate(0, 0, 5, sphere { name = "ball"; })
+}
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil {
+		t.Fatalf("physical camera not parsed: %v", err)
+	}
+
+	c := s.Camera
+	if c.Physical == nil || !FloatEqual(c.LensRadius, 0.0125) || !FloatEqual(c.Exposure, 0.25) || c.AutoFocus.Object != "ball" {
+		t.Errorf("bad physical camera: %+v", c)
+	}
+
+	if a, ok := c.Aperture.(*BladedAperture); !ok || a.Blades != 5 || !FloatEqual(a.Rotation, Pi/2) {
+		t.Errorf("bad aperture: %+v", c.Aperture)
+	}
+
+	// A mistyped subject is reported instead of keeping the old focal distance
+	if _, err := ParseSbtSceneFromString(strings.Replace(scene, `focus = "ball"`, `focus = "bal"`, 1)); err == nil {
+		t.Errorf("focus on a missing object should be an error")
+	}
+
+	// Depth of field without focus distance focuses on the center of the image
+	s, _ = ParseSbtSceneFromString("FUN-raytracer 1.0 camera { lens_radius = 0.1; }")
+	if s.Camera.LensRadius != 0.1 || s.Camera.AutoFocus == nil || s.Camera.AutoFocus.X != 0.5 {
+		t.Errorf("bad default focus: %+v", s.Camera)
+	}
+}
+
+func TestSbtMultipleCameras(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+camera {
+	name = "front";
+	viewsize = 300, 200;
+}
+
+camera {
+	viewsize = 100, 100;
+	lens_radius = 0.1;
+	focal_distance = 5;
+}
+
+camera {
+	name = "top";
+	position = (0, 10, 0);
+	viewdir = (0, -1, 0);
+	updir = (0, 0, 1);
+}
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil || len(s.Cameras) != 3 {
+		t.Fatalf("cameras not parsed: %v", err)
+	}
+
+	if s.Camera != s.Cameras[0] || s.Camera.Name() != "front" || s.Cameras[1].Name() != "camera2" || s.Cameras[1].LensRadius != 0.1 {
+		t.Errorf("bad cameras: %+v", s.Cameras)
+	}
+
+	tests := []struct {
+		names    string
+		expected []string
+	}{
+		{"", []string{"front"}},
+		{"all", []string{"front", "camera2", "top"}},
+		{"top, front", []string{"top", "front"}},
+	}
+
+	for _, test := range tests {
+		cameras, err := s.SelectCameras(test.names)
+
+		if err != nil || len(cameras) != len(test.expected) {
+			t.Fatalf("cameras '%s' not selected: %v", test.names, err)
+		}
+
+		for i, c := range cameras {
+			if c.Name() != test.expected[i] {
+				t.Errorf("camera '%s' selected instead of '%s'", c.Name(), test.expected[i])
+			}
+		}
+	}
+
+	if _, err := s.SelectCameras("front,back"); err == nil {
+		t.Errorf("missing camera should be an error")
+	}
+
+	// Each camera keeps its view size, unless it's overridden by the user
+	o := NewOptions()
+	s.SyncOptions(o)
+
+	if s.Cameras[0].HSize != 300 || s.Cameras[1].HSize != 100 || s.Cameras[2].HSize != 400 || s.Cameras[2].VSize != 225 {
+		t.Errorf("bad view sizes after sync")
+	}
+
+	// Names must be unique
+	if _, err := ParseSbtSceneFromString(scene + `camera { name = "top"; }`); err == nil {
+		t.Errorf("duplicate camera should be an error")
+	}
+}
+
+func TestSbtCloneInstance(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+translate(0, 0, 10, group {
+	name = "tree";
+
+	translate(0, 1, 0, scale(0.5, sphere {} ))
+	scale(0.1, 1, 0.1, cyl {} )
+})
+
+translate(2, 0, 0, clone "tree" {
+	instance = true;
+})
+
+translate(4, 0, 0, clone "tree" {
+	name = "green";
+	material = {
+		diffuse = (0, 1, 0);
+	}
+	instance = true;
+})
+
+translate(6, 0, 0, clone "tree" {
+})
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil || len(s.World.Objects) != 4 {
+		t.Fatalf("clones not parsed: %v", err)
+	}
+
+	i1, ok1 := s.World.Objects[1].(*Instance)
+	i2, ok2 := s.World.Objects[2].(*Instance)
+
+	if !ok1 || !ok2 {
+		t.Fatalf("instances not created")
+	}
+
+	if i1.Geometry() != i2.Geometry() || i1.Geometry() != s.World.Objects[0] {
+		t.Errorf("instances do not share the geometry of the object")
+	}
+
+	if i1.Material() != nil || i2.Material() == nil || i2.Name() != "green" {
+		t.Errorf("bad instance attributes")
+	}
+
+	if _, ok := s.World.Objects[3].(*Group); !ok {
+		t.Errorf("clone is not a copy")
+	}
+
+	// The instance is hit as if it were a copy
+	for x := 2; x <= 6; x += 2 {
+		r := NewRay(Point(float64(x), 1, -5), Vector(0, 0, 1))
+		xs := NewIntersections()
+		s.World.Objects[x/2].AddIntersections(r, xs)
+
+		hit := xs.Hit()
+		if !hit.Valid() || math.Abs(hit.T-4.5) > Epsilon {
+			t.Errorf("object %d not hit: %+v", x/2, hit)
+			continue
+		}
+
+		if n := NewIntersectionInfo(hit, r, xs).Normalv; !n.Equals(Vector(0, 0, -1)) {
+			t.Errorf("object %d: bad normal %v", x/2, n)
+		}
+	}
+}
+
+func TestSbtQuadrics(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+translate(0, 0, 0, torus 2 0.5 {})
+translate(5, 0, 0, disk {})
+translate(10, 0, 0, annulus 0.5 1 {})
+translate(15, -1, 0, paraboloid 0 2 {})
+translate(20, 0, 0, hyperboloid -1 1 0.25 {})
+translate(25, 0, 0, quadric 1 1 1 0 0 0 0 0 0 -1 {})
+translate(30, 0, 0, quadric 1 1 1 0 0 0 0 0 0 -4 (-2, -2, -2) (2, 1, 2) {})
+`
+	s, err := ParseSbtSceneFromString(scene)
+
+	if err != nil || len(s.World.Objects) != 7 {
+		t.Fatalf("quadrics not parsed: %v", err)
+	}
+
+	kinds := []interface{}{&Torus{}, &Disk{}, &Disk{}, &Quadric{}, &Quadric{}, &Quadric{}, &Quadric{}}
+
+	for i, o := range s.World.Objects {
+		if fmt.Sprintf("%T", o.(*Shape).Shapable()) != fmt.Sprintf("%T", kinds[i]) {
+			t.Errorf("object %d is a %T", i, o.(*Shape).Shapable())
+		}
+	}
+
+	// Each shape is hit by a ray coming from above, at some offset from its center
+	hits := []struct{ dx, t float64 }{
+		{2, 4.5},                 // Top of the tube of the torus
+		{0, 5},                   // Disk
+		{0.75, 5},                // The annulus has a hole
+		{0, 6},                   // Thru the open top of the paraboloid, to its bottom
+		{1, 5 - math.Sqrt(0.75)}, // Upper half of the hyperboloid
+		{0, 4},                   // Top of the quadric sphere
+		{0, 7},                   // The clip box cuts the top of the bigger sphere, so the bottom is hit
+	}
+
+	for i, o := range s.World.Objects {
+		r := NewRay(Point(float64(i)*5+hits[i].dx, 5, 0), Vector(0, -1, 0))
+		xs := NewIntersections()
+		o.AddIntersections(r, xs)
+
+		if hit := xs.Hit(); !hit.Valid() || math.Abs(hit.T-hits[i].t) > Epsilon {
+			t.Errorf("object %d not hit: %+v", i, hit)
+		}
+	}
+}
+
+func TestSbtHeightfield(t *testing.T) {
+	// A 3x3 image with a peak in the middle
+	img := image.NewGray(image.Rect(0, 0, 3, 3))
+	img.SetGray(1, 1, color.Gray{255})
+
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "peak.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, img)
+	f.Close()
+
+	scene := `
+FUN-raytracer 1.0
+
+heightfield {
+	image = "peak.png";
+	scale = (2, 3, 2);
+	color = (1, 0, 0);
+}
+
+translate(10, 0, 0, heightfield {
+	noise = 64;
+	frequency = 2;
+})
+`
+	s, err := ParseSbtScene(strings.NewReader(scene), &SbtParserOptions{FilenameBase: dir})
+
+	if err != nil || len(s.World.Objects) != 2 {
+		t.Fatalf("heightfields not parsed: %v", err)
+	}
+
+	peak := s.World.Objects[0].(*Shape)
+
+	if hf := peak.Shapable().(*Heightfield); hf.W != 3 || hf.H != 3 {
+		t.Errorf("heightfield from image is %dx%d", hf.W, hf.H)
+	}
+
+	// The peak is scaled to a height of 3, halfway to the border the height is half of it
+	for _, hit := range []struct{ x, z, t float64 }{{0, 0, 2}, {0, 1, 3.5}, {-1, 0, 3.5}, {-1.5, 0, 4.25}} {
+		xs := NewIntersections()
+		peak.AddIntersections(NewRay(Point(hit.x, 5, hit.z), Vector(0, -1, 0)), xs)
+
+		if h := xs.Hit(); !h.Valid() || math.Abs(h.T-hit.t) > Epsilon {
+			t.Errorf("heightfield at %v,%v not hit at %v: %+v", hit.x, hit.z, hit.t, h)
+		}
+	}
+
+	if hf := s.World.Objects[1].(*Shape).Shapable().(*Heightfield); hf.W != 64 || hf.H != 64 {
+		t.Errorf("heightfield from noise is %dx%d", hf.W, hf.H)
+	}
+
+	if _, err := ParseSbtSceneFromString("FUN-raytracer 1.0 heightfield { scale = (1, 1, 1); }"); err == nil {
+		t.Errorf("heightfield without heights should not be parsed")
+	}
+
+	// Sizes are checked as by NewHeightfield
+	for _, size := range []string{"1", "-4"} {
+		if _, err := ParseSbtSceneFromString("FUN-raytracer 1.0 heightfield { noise = " + size + "; }"); err == nil {
+			t.Errorf("heightfield from noise of size %s should not be parsed", size)
+		}
+	}
+
+	// An image with a single row is not enough
+	f, err = os.Create(filepath.Join(dir, "row.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewGray(image.Rect(0, 0, 8, 1)))
+	f.Close()
+
+	scene = "FUN-raytracer 1.0 heightfield { image = \"row.png\"; }"
+
+	if _, err := ParseSbtScene(strings.NewReader(scene), &SbtParserOptions{FilenameBase: dir}); err == nil {
+		t.Errorf("heightfield from a 8x1 image should not be parsed")
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+)
+
+// A mesh cache file stores a mesh ready for rendering: vertices after normalization and smoothing,
+// triangles with their edges and normals in the order of the BVH leaves and the BVH nodes. Values are
+// little endian and arrays are flat and aligned, so that they can be used in place (see ReadArray)
+const meshCacheMagic = "FUNMESH2"
+
+// Compact meshes are stored with their own buffers and BVH nodes, so they don't need to be converted
+const compactMeshCacheMagic = "FUNCMSH1"
+
+// MeshCacheKey returns the key that identifies a mesh in the cache: it changes with the contents of the file
+// and with all the parameters used to process the mesh and build its BVH. The BVH of a group is built in the
+// space of its parent, so the transform matters, but not for compact meshes which have the BVH in their own space
+func MeshCacheKey(filename string, autosmooth, compact bool, subdivide int, transform Matrix) (string, error) {
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(data)
+	if compact {
+		fmt.Fprintf(h, "|%s|autosmooth=%v|subdivide=%d|%s", compactMeshCacheMagic, autosmooth, subdivide, BvhBuildParameters())
+	} else {
+		fmt.Fprintf(h, "|%s|autosmooth=%v|subdivide=%d|transform=%v|%s", meshCacheMagic, autosmooth, subdivide, transform, BvhBuildParameters())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func meshCacheFilename(dir, key string) string {
+	return filepath.Join(dir, key[:32]+".funmesh")
+}
+
+// createMeshCache returns a writer for a new cache file, which gets its name only when done succeeds
+func createMeshCache(dir, key string) (w *BinaryWriter, done func() error, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(dir, "funmesh")
+
+	if err != nil {
+		return
+	}
+
+	f.Chmod(0644) // Temporary files are private
+
+	w = NewBinaryWriter(f)
+
+	done = func() error {
+		defer os.Remove(f.Name()) // Fails harmlessly after the rename
+
+		err := w.Flush()
+
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		if err == nil {
+			err = os.Rename(f.Name(), meshCacheFilename(dir, key))
+		}
+
+		return err
+	}
+
+	return
+}
+
+// openMeshCache reads a cache file, it returns nil if the file is not in the cache
+func openMeshCache(dir, key, magic string) (*BinaryReader, error) {
+	data, err := os.ReadFile(meshCacheFilename(dir, key))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewBinaryReader(data)
+
+	if string(r.Bytes(len(magic))) != magic || r.String() != key {
+		return nil, errors.New("mesh cache file does not match")
+	}
+
+	return r, nil
+}
+
+// meshTriangleRecord is how a triangle is stored, with the data computed when the mesh was built
+type meshTriangleRecord struct {
+	V, VN, VT       [3]int32
+	M               int32 // Index of the name of the material, -1 if the triangle uses the material of the mesh
+	E1, E2, N, T, B Tuple
+}
+
+// SaveMeshCache writes a group holding a single mesh and its BVH into the cache directory
+func SaveMeshCache(dir, key string, info *ObjInfo, g *Group) error {
+	bvh := g.Bvh()
+
+	if bvh == nil {
+		return errors.New("mesh without BVH cannot be cached")
+	}
+
+	// Faces refer to materials by name
+	names := map[*Material]int32{}
+	matNames := []string{}
+
+	for name, m := range info.Materials {
+		names[m] = int32(len(matNames))
+		matNames = append(matNames, name)
+	}
+
+	triangles := make([]meshTriangleRecord, g.Len())
+
+	for i := range triangles {
+		t, ok := g.Members(i).(*MeshTriangle)
+
+		if !ok {
+			return errors.New("only groups made of mesh triangles can be cached")
+		}
+
+		rec := &triangles[i]
+
+		for k := 0; k < 3; k++ {
+			rec.V[k], rec.VN[k], rec.VT[k] = int32(t.V[k]), int32(t.VN[k]), int32(t.VT[k])
+		}
+
+		rec.M = -1
+		if t.Mat != nil {
+			rec.M = names[t.Mat]
+		}
+
+		rec.E1, rec.E2, rec.N, rec.T, rec.B = t.E1, t.E2, t.N, t.T, t.B
+	}
+
+	w, done, err := createMeshCache(dir, key)
+
+	if err != nil {
+		return err
+	}
+
+	w.Bytes([]byte(meshCacheMagic))
+	w.String(key)
+
+	w.Uint32(uint32(len(info.Mtllibs)))
+	for _, s := range info.Mtllibs {
+		w.String(s)
+	}
+
+	w.Uint32(uint32(len(matNames)))
+	for _, s := range matNames {
+		w.String(s)
+	}
+
+	WriteArray(w, info.V)
+	WriteArray(w, info.VN)
+	WriteArray(w, info.VT)
+	WriteArray(w, triangles)
+
+	bvh.Encode(w)
+
+	return done()
+}
+
+// LoadMeshCache reads a mesh and its BVH from the cache directory, it returns nil if the mesh is not in the cache.
+// Vertices are used in place and triangles are not computed again. Material libraries are loaded from objDir,
+// like when parsing the original file
+func LoadMeshCache(dir, key, objDir string) (*Trimesh, *Bvh, error) {
+	r, err := openMeshCache(dir, key, meshCacheMagic)
+
+	if r == nil {
+		return nil, nil, err
+	}
+
+	info := &ObjInfo{Materials: make(map[string]*Material)}
+
+	info.Mtllibs = make([]string, r.Count(4))
+	for i := range info.Mtllibs {
+		info.Mtllibs[i] = r.String()
+	}
+
+	matNames := make([]string, r.Count(4))
+	for i := range matNames {
+		matNames[i] = r.String()
+	}
+
+	mesh := &Trimesh{material: NewMaterial()}
+
+	mesh.SetNameForKind("mesh")
+	mesh.SetTransform()
+
+	mesh.V = ReadArray[Tuple](r)
+	mesh.VN = ReadArray[Tuple](r)
+	mesh.VT = ReadArray[Tuple](r)
+	triangles := ReadArray[meshTriangleRecord](r)
+
+	if r.Err() != nil {
+		return nil, nil, r.Err()
+	}
+
+	for _, filename := range info.Mtllibs {
+		if f := openObjDependency(filename, objDir); f != nil {
+			ParseWavefrontMtllib(f, info, objDir)
+			f.Close()
+		}
+	}
+
+	// Check indices, so that a corrupted file cannot crash the renderer later
+	valid := func(i int32, ts []Tuple) bool {
+		return len(ts) == 0 || (i >= -1 && int(i) < len(ts)) // Missing indices are -1, as in the original file
+	}
+
+	mesh.T = make([]MeshTriangle, len(triangles))
+	objects := make([]Groupable, len(triangles))
+
+	for i := range triangles {
+		rec := &triangles[i]
+		t := &mesh.T[i]
+
+		for k := 0; k < 3; k++ {
+			if rec.V[k] < 0 || int(rec.V[k]) >= len(mesh.V) || !valid(rec.VN[k], mesh.VN) || !valid(rec.VT[k], mesh.VT) {
+				return nil, nil, errors.New("mesh cache file is corrupted")
+			}
+
+			t.V[k], t.VN[k], t.VT[k] = int(rec.V[k]), int(rec.VN[k]), int(rec.VT[k])
+		}
+
+		if rec.M >= 0 && int(rec.M) < len(matNames) {
+			t.Mat = info.Materials[matNames[rec.M]]
+		}
+
+		t.mesh = mesh
+		t.E1, t.E2, t.N, t.T, t.B = rec.E1, rec.E2, rec.N, rec.T, rec.B
+
+		objects[i] = t
+	}
+
+	bvh, err := DecodeBvh(r, objects)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mesh, bvh, nil
+}
+
+// SaveCompactMeshCache writes a compact mesh into the cache directory, info is the object it was built from
+func SaveCompactMeshCache(dir, key string, info *ObjInfo, mesh *CompactMesh) error {
+	names := map[*Material]string{}
+	for name, m := range info.Materials {
+		names[m] = name
+	}
+
+	w, done, err := createMeshCache(dir, key)
+
+	if err != nil {
+		return err
+	}
+
+	w.Bytes([]byte(compactMeshCacheMagic))
+	w.String(key)
+
+	w.Uint32(uint32(len(info.Mtllibs)))
+	for _, s := range info.Mtllibs {
+		w.String(s)
+	}
+
+	// Parts refer to materials by name, the first one uses the material of the mesh
+	w.Uint32(uint32(len(mesh.parts)))
+	for _, p := range mesh.parts {
+		w.String(names[p.material])
+	}
+
+	for _, v := range []float64{mesh.bounds.Min.X, mesh.bounds.Min.Y, mesh.bounds.Min.Z, mesh.bounds.Max.X, mesh.bounds.Max.Y, mesh.bounds.Max.Z} {
+		w.Float64(v)
+	}
+
+	WriteArray(w, mesh.P)
+	WriteArray(w, mesh.N)
+	WriteArray(w, mesh.UV)
+	WriteArray(w, mesh.VI)
+	WriteArray(w, mesh.NI)
+	WriteArray(w, mesh.TI)
+	WriteArray(w, mesh.FM)
+	WriteArray(w, mesh.nodes)
+
+	return done()
+}
+
+// LoadCompactMeshCache reads a compact mesh from the cache directory, it returns nil if the mesh is not in the cache.
+// The buffers of the mesh are used in place, they are not decoded
+func LoadCompactMeshCache(dir, key, objDir string) (*CompactMesh, error) {
+	r, err := openMeshCache(dir, key, compactMeshCacheMagic)
+
+	if r == nil {
+		return nil, err
+	}
+
+	info := &ObjInfo{Materials: make(map[string]*Material)}
+
+	info.Mtllibs = make([]string, r.Count(4))
+	for i := range info.Mtllibs {
+		info.Mtllibs[i] = r.String()
+	}
+
+	matNames := make([]string, r.Count(4))
+	for i := range matNames {
+		matNames[i] = r.String()
+	}
+
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+
+	for _, filename := range info.Mtllibs {
+		if f := openObjDependency(filename, objDir); f != nil {
+			ParseWavefrontMtllib(f, info, objDir)
+			f.Close()
+		}
+	}
+
+	mesh := &CompactMesh{material: NewMaterial()}
+
+	mesh.SetNameForKind("cmesh")
+	mesh.SetTransform()
+
+	for i, name := range matNames {
+		p := &CompactMeshPart{mesh: mesh}
+		if i > 0 {
+			p.material = info.Materials[name]
+		}
+		mesh.parts = append(mesh.parts, p)
+	}
+
+	mesh.bounds.Min = Point(r.Float64(), r.Float64(), r.Float64())
+	mesh.bounds.Max = Point(r.Float64(), r.Float64(), r.Float64())
+
+	mesh.P = ReadArray[float32](r)
+	mesh.N = ReadArray[float32](r)
+	mesh.UV = ReadArray[float32](r)
+	mesh.VI = ReadArray[uint32](r)
+	mesh.NI = ReadArray[uint32](r)
+	mesh.TI = ReadArray[uint32](r)
+	mesh.FM = ReadArray[uint16](r)
+	mesh.nodes = ReadArray[CompactBvhNode](r)
+
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+
+	if err := mesh.validate(); err != nil {
+		return nil, err
+	}
+
+	return mesh, nil
+}
+
+// validate checks the indices of a mesh, so that a corrupted cache file cannot crash the renderer later
+func (mesh *CompactMesh) validate() error {
+	triangles := len(mesh.FM)
+
+	valid := func(indices []uint32, values []float32, n int) bool {
+		if len(values) == 0 {
+			return len(indices) == 0
+		}
+
+		for _, i := range indices {
+			if int(i) >= len(values)/n {
+				return false
+			}
+		}
+
+		return len(indices) == triangles*3
+	}
+
+	if len(mesh.parts) == 0 || !valid(mesh.VI, mesh.P, 3) || !valid(mesh.NI, mesh.N, 3) || !valid(mesh.TI, mesh.UV, 2) {
+		return errors.New("mesh cache file is corrupted")
+	}
+
+	for _, m := range mesh.FM {
+		if int(m) >= len(mesh.parts) {
+			return errors.New("mesh cache file is corrupted")
+		}
+	}
+
+	for i, n := range mesh.nodes {
+		if n.Count > 0 && int(n.Index)+int(n.Count) > triangles || n.Count == 0 && (int(n.Index) <= i || int(n.Index) >= len(mesh.nodes)) {
+			return errors.New("BVH node is corrupted")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+)
+
+func TestMeshCache(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+camera {
+	position = (0, 0, -3);
+	viewdir = (0, 0, 1);
+	viewsize = 40, 30;
+}
+
+point_light {
+	position = (-5, 5, -5);
+	colour = (1, 1, 1);
+}
+
+translate(0.1, 0.2, 0.3,
+	polymesh {
+		gennormals = true;
+		objfile = "../objects_testdata/cow.obj";
+	})
+`
+	dir := t.TempDir()
+
+	parseScene := func(scene, cacheDir string) *Group {
+		s, err := ParseSbtScene(strings.NewReader(scene), &SbtParserOptions{CacheDir: cacheDir})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, ok := s.World.Objects[0].(*Group); ok {
+			return g
+		}
+
+		t.Fatalf("polymesh not found")
+		return nil
+	}
+
+	parse := func() *Group {
+		return parseScene(scene, dir)
+	}
+
+	// Rays thru the mesh must hit the same triangles, offset moves the rays with the mesh
+	sameHits := func(g1, g2 *Group, offset Tuple) {
+		t.Helper()
+
+		hits := 0
+
+		for i := 0; i < 100; i++ {
+			r := NewRay(Point(float64(i%10)/5-1, float64(i/10)/5-1, -3).Add(offset), Vector(0, 0, 1))
+
+			xs1 := NewIntersections()
+			g1.AddIntersections(r, xs1)
+
+			xs2 := NewIntersections()
+			g2.AddIntersections(r, xs2)
+
+			h1, h2 := xs1.Hit(), xs2.Hit()
+
+			if xs1.Len() != xs2.Len() || h1.Valid() != h2.Valid() || h1.T != h2.T {
+				t.Fatalf("cached mesh intersections differ: %+v %+v", h1, h2)
+			}
+
+			if h1.Valid() {
+				hits++
+
+				n1 := NewIntersectionInfo(h1, r, xs1).Normalv
+				n2 := NewIntersectionInfo(h2, r, xs2).Normalv
+
+				if !n1.Equals(n2) {
+					t.Fatalf("cached mesh normals differ: %v %v", n1, n2)
+				}
+			}
+		}
+
+		if hits == 0 {
+			t.Fatalf("no hits, test is not meaningful")
+		}
+	}
+
+	g1 := parse()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.funmesh"))
+	if len(files) != 1 {
+		t.Fatalf("mesh not cached: %v", files)
+	}
+
+	g2 := parse()
+
+	if g2.Len() != g1.Len() || g2.Bvh().Stats().Nodes != g1.Bvh().Stats().Nodes {
+		t.Fatalf("cached mesh differs: %d vs %d triangles", g2.Len(), g1.Len())
+	}
+
+	sameHits(g1, g2, Vector(0, 0, 0))
+
+	// The BVH of the group is in the space of its parent, so another transform needs another cache file
+	moved := strings.Replace(scene, "translate(0.1, 0.2, 0.3,", "translate(1, 2, 3,", 1)
+	parseScene(moved, dir)
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.funmesh")); len(files) != 2 {
+		t.Errorf("mesh with another transform not cached: %v", files)
+	}
+
+	sameHits(parseScene(moved, ""), parseScene(moved, dir), Vector(0.9, 1.8, 2.7))
+
+	// A corrupted cache is ignored and rebuilt
+	data, _ := os.ReadFile(files[0])
+	os.WriteFile(files[0], data[:len(data)/2], 0644)
+
+	if g3 := parse(); g3.Len() != g1.Len() {
+		t.Errorf("corrupted cache not rebuilt")
+	}
+
+	if data2, _ := os.ReadFile(files[0]); len(data2) != len(data) {
+		t.Errorf("corrupted cache not replaced")
+	}
+}
+
+func TestCompactMeshCache(t *testing.T) {
+	scene := `
+FUN-raytracer 1.0
+
+camera {
+	position = (0, 0, -3);
+	viewdir = (0, 0, 1);
+	viewsize = 40, 30;
+}
+
+polymesh {
+	compact = true;
+	gennormals = true;
+	objfile = "../objects_testdata/cow.obj";
+	objfile = "../objects_testdata/teapot.obj";
+}
+`
+	dir := t.TempDir()
+
+	parse := func() *Group {
+		s, err := ParseSbtScene(strings.NewReader(scene), &SbtParserOptions{CacheDir: dir})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, ok := s.World.Objects[0].(*Group); ok && g.Len() == 2 {
+			return g
+		}
+
+		t.Fatalf("polymesh not found")
+		return nil
+	}
+
+	g1 := parse()
+
+	// Each compact mesh has its own BVH, so both are cached
+	files, _ := filepath.Glob(filepath.Join(dir, "*.funmesh"))
+	if len(files) != 2 {
+		t.Fatalf("meshes not cached: %v", files)
+	}
+
+	g2 := parse()
+
+	for m := 0; m < 2; m++ {
+		mesh1, mesh2 := g1.Members(m).(*CompactMesh), g2.Members(m).(*CompactMesh)
+
+		if mesh2.Len() != mesh1.Len() || len(mesh2.nodes) != len(mesh1.nodes) || mesh2.Bounds() != mesh1.Bounds() {
+			t.Fatalf("cached mesh differs: %d vs %d triangles", mesh2.Len(), mesh1.Len())
+		}
+	}
+
+	for i := 0; i < 400; i++ {
+		r := NewRay(Point(float64(i%20)/10-1, float64(i/20)/10-1, -3), Vector(0.01, 0.02, 1))
+
+		xs1 := NewIntersections()
+		g1.AddIntersections(r, xs1)
+
+		xs2 := NewIntersections()
+		g2.AddIntersections(r, xs2)
+
+		h1, h2 := xs1.Hit(), xs2.Hit()
+
+		if xs1.Len() != xs2.Len() || h1.Valid() != h2.Valid() || h1.T != h2.T {
+			t.Fatalf("cached mesh intersections differ: %+v %+v", h1, h2)
+		}
+
+		if h1.Valid() {
+			n1 := NewIntersectionInfo(h1, r, xs1).Normalv
+			n2 := NewIntersectionInfo(h2, r, xs2).Normalv
+
+			if !n1.Equals(n2) {
+				t.Fatalf("cached mesh normals differ: %v %v", n1, n2)
+			}
+		}
+	}
+
+	// A corrupted cache is ignored and rebuilt
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		os.WriteFile(file, data[:len(data)/2], 0644)
+	}
+
+	if g3 := parse(); g3.Members(0).(*CompactMesh).Len() != g1.Members(0).(*CompactMesh).Len() {
+		t.Errorf("corrupted cache not rebuilt")
+	}
+}
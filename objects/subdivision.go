@@ -0,0 +1,373 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+)
+
+// Subdivision surfaces split each polygon into smaller ones and move the vertices, so that the mesh gets closer
+// to a smooth surface at each level, see:
+// Edwin Catmull, Jim Clark "Recursively generated B-spline surfaces on arbitrary topological meshes" (1978)
+// Charles Loop "Smooth Subdivision Surfaces Based on Triangles" (1987)
+// Tony DeRose, Michael Kass, Tien Truong "Subdivision Surfaces in Character Animation" (1998) for the creases
+
+// Subdivide applies the specified number of levels of subdivision to the polygons of the mesh: Loop if they are all
+// triangles, Catmull-Clark otherwise, which turns them into quads. Borders and creases stay sharp and texture
+// coordinates follow the surface, keeping their seams. Vertex normals are lost, Autosmooth can compute them again.
+// The mesh must have been parsed keeping its polygons, see ObjParserOptions
+func (o *ObjInfo) Subdivide(levels int) {
+	if levels <= 0 || len(o.P) == 0 {
+		return
+	}
+
+	// Texture coordinates have their own topology, split by the seams
+	pos := subdivMesh{values: o.V}
+	tex := subdivMesh{values: o.VT}
+	sharpness := [][]float64{}
+
+	loop := true
+	uv := len(o.VT) > 0
+
+	creases := map[[2]int]float64{}
+	for _, c := range o.Creases {
+		creases[edgeKey(c.V[0], c.V[1])] = c.Sharpness
+	}
+
+	for _, p := range o.P {
+		n := len(p.V)
+		s := make([]float64, n)
+
+		for i := range p.V {
+			s[i] = creases[edgeKey(p.V[i], p.V[(i+1)%n])]
+			uv = uv && p.VT[i] >= 0
+		}
+
+		pos.faces = append(pos.faces, p.V)
+		tex.faces = append(tex.faces, p.VT)
+		sharpness = append(sharpness, s)
+		loop = loop && n == 3
+	}
+
+	polygons := o.P
+
+	for level := 0; level < levels; level++ {
+		// Each polygon is split into 4 triangles by Loop, or as many quads as its vertices by Catmull-Clark
+		children := []ObjInfoPolygon{}
+
+		for f, p := range polygons {
+			n := 4
+			if !loop {
+				n = len(pos.faces[f])
+			}
+
+			for i := 0; i < n; i++ {
+				children = append(children, ObjInfoPolygon{G: p.G, M: p.M})
+			}
+		}
+
+		polygons = children
+
+		var next [][]float64
+
+		pos, next = pos.subdivide(sharpness, loop)
+		if uv {
+			tex, _ = tex.subdivide(sharpness, loop)
+		}
+
+		sharpness = next
+	}
+
+	// Rebuild the mesh
+	o.V = pos.values
+	o.VN = nil
+	o.VT = nil
+	o.P = nil
+	o.F = nil
+	o.Creases = nil
+
+	if uv {
+		o.VT = tex.values
+	}
+
+	creases = map[[2]int]float64{}
+
+	for f, p := range polygons {
+		n := len(pos.faces[f])
+
+		p.V = pos.faces[f]
+		p.VN = make([]int, n)
+		p.VT = make([]int, n)
+
+		for i := 0; i < n; i++ {
+			p.VN[i] = -1
+			p.VT[i] = -1
+
+			if uv {
+				p.VT[i] = tex.faces[f][i]
+			}
+
+			// Creases that are still sharp at the next level
+			if s := sharpness[f][i]; s > 0 {
+				key := edgeKey(p.V[i], p.V[(i+1)%n])
+
+				if _, ok := creases[key]; !ok {
+					creases[key] = s
+					o.Creases = append(o.Creases, ObjInfoCrease{V: key, Sharpness: s})
+				}
+			}
+		}
+
+		o.AddPolygon(p)
+	}
+}
+
+// subdivMesh is the topology of a mesh and the values at its vertices, which may be positions or texture coordinates
+type subdivMesh struct {
+	faces  [][]int
+	values []Tuple
+}
+
+type subdivEdge struct {
+	a, b      int     // Vertices
+	faces     []int   // Faces that share the edge, there are two unless it's on the border
+	opposite  []int   // Vertex opposite to the edge in each face, for the Loop rules
+	sharpness float64 // Sharpness of the crease
+}
+
+func edgeKey(a, b int) [2]int {
+	if a > b {
+		return [2]int{b, a}
+	}
+
+	return [2]int{a, b}
+}
+
+// sharp returns the sharpness of an edge, borders are always sharp
+func (e *subdivEdge) sharp() float64 {
+	if len(e.faces) != 2 {
+		return math.Inf(+1)
+	}
+
+	return e.sharpness
+}
+
+func (e *subdivEdge) other(v int) int {
+	if e.a == v {
+		return e.b
+	}
+
+	return e.a
+}
+
+func lerp(a, b Tuple, t float64) Tuple {
+	return a.Mul(1 - t).Add(b.Mul(t))
+}
+
+// subdivide applies one level of subdivision: the new values are those of the vertices, followed by those
+// of the edges and (for Catmull-Clark) of the faces. Sharpness is that of each edge of each face, the one
+// of the new faces is returned
+func (m *subdivMesh) subdivide(sharpness [][]float64, loop bool) (subdivMesh, [][]float64) {
+	// Find the edges and what's around each vertex
+	index := map[[2]int]int{}
+	edges := []subdivEdge{}
+	faceEdges := make([][]int, len(m.faces))
+
+	for f, face := range m.faces {
+		n := len(face)
+		faceEdges[f] = make([]int, n)
+
+		for i, a := range face {
+			b := face[(i+1)%n]
+			key := edgeKey(a, b)
+
+			e, ok := index[key]
+			if !ok {
+				e = len(edges)
+				index[key] = e
+				edges = append(edges, subdivEdge{a: a, b: b})
+			}
+
+			edges[e].faces = append(edges[e].faces, f)
+			edges[e].opposite = append(edges[e].opposite, face[(i+2)%n])
+			edges[e].sharpness = math.Max(edges[e].sharpness, sharpness[f][i])
+			faceEdges[f][i] = e
+		}
+	}
+
+	vertexEdges := make([][]int, len(m.values))
+	vertexFaces := make([][]int, len(m.values))
+
+	for e := range edges {
+		vertexEdges[edges[e].a] = append(vertexEdges[edges[e].a], e)
+		vertexEdges[edges[e].b] = append(vertexEdges[edges[e].b], e)
+	}
+
+	for f, face := range m.faces {
+		for _, v := range face {
+			vertexFaces[v] = append(vertexFaces[v], f)
+		}
+	}
+
+	nv, ne := len(m.values), len(edges)
+	next := subdivMesh{}
+	nextSharpness := [][]float64{}
+
+	childSharpness := func(e int) float64 {
+		return math.Max(edges[e].sharpness-1, 0)
+	}
+
+	if loop {
+		next.values = make([]Tuple, nv+ne)
+
+		for e := range edges {
+			edge := &edges[e]
+			next.values[nv+e] = m.edgePoint(edge, func() Tuple {
+				a := m.values[edge.a].Add(m.values[edge.b])
+				b := m.values[edge.opposite[0]].Add(m.values[edge.opposite[1]])
+
+				return a.Mul(3.0 / 8).Add(b.Mul(1.0 / 8))
+			})
+		}
+
+		for v := range m.values {
+			next.values[v] = m.vertexPoint(v, edges, vertexEdges[v], vertexFaces[v], func() Tuple {
+				n := float64(len(vertexEdges[v]))
+				beta := (5.0/8 - Square(3.0/8+math.Cos(2*Pi/n)/4)) / n
+				p := m.values[v].Mul(1 - n*beta)
+
+				for _, e := range vertexEdges[v] {
+					p = p.Add(m.values[edges[e].other(v)].Mul(beta))
+				}
+
+				return p
+			})
+		}
+
+		// A triangle at each corner, and one in the middle
+		for f, face := range m.faces {
+			fe := faceEdges[f]
+
+			for i := range face {
+				prev := (i + 2) % 3
+				next.faces = append(next.faces, []int{face[i], nv + fe[i], nv + fe[prev]})
+				nextSharpness = append(nextSharpness, []float64{childSharpness(fe[i]), 0, childSharpness(fe[prev])})
+			}
+
+			next.faces = append(next.faces, []int{nv + fe[0], nv + fe[1], nv + fe[2]})
+			nextSharpness = append(nextSharpness, []float64{0, 0, 0})
+		}
+
+		return next, nextSharpness
+	}
+
+	next.values = make([]Tuple, nv+ne+len(m.faces))
+
+	for f, face := range m.faces {
+		p := Tuple{}
+		for _, v := range face {
+			p = p.Add(m.values[v])
+		}
+
+		next.values[nv+ne+f] = p.Mul(1 / float64(len(face)))
+	}
+
+	for e := range edges {
+		edge := &edges[e]
+		next.values[nv+e] = m.edgePoint(edge, func() Tuple {
+			p := m.values[edge.a].Add(m.values[edge.b])
+			p = p.Add(next.values[nv+ne+edge.faces[0]]).Add(next.values[nv+ne+edge.faces[1]])
+
+			return p.Mul(0.25)
+		})
+	}
+
+	for v := range m.values {
+		next.values[v] = m.vertexPoint(v, edges, vertexEdges[v], vertexFaces[v], func() Tuple {
+			n := float64(len(vertexEdges[v]))
+			q, r := Tuple{}, Tuple{}
+
+			for _, f := range vertexFaces[v] {
+				q = q.Add(next.values[nv+ne+f])
+			}
+
+			for _, e := range vertexEdges[v] {
+				r = r.Add(m.values[edges[e].a].Add(m.values[edges[e].b]).Mul(0.5))
+			}
+
+			q = q.Mul(1 / float64(len(vertexFaces[v])))
+			r = r.Mul(1 / n)
+
+			return q.Add(r.Mul(2)).Add(m.values[v].Mul(n - 3)).Mul(1 / n)
+		})
+	}
+
+	// A quad at each corner
+	for f, face := range m.faces {
+		fe := faceEdges[f]
+		n := len(face)
+
+		for i := range face {
+			prev := (i + n - 1) % n
+			next.faces = append(next.faces, []int{face[i], nv + fe[i], nv + ne + f, nv + fe[prev]})
+			nextSharpness = append(nextSharpness, []float64{childSharpness(fe[i]), 0, 0, childSharpness(fe[prev])})
+		}
+	}
+
+	return next, nextSharpness
+}
+
+// edgePoint returns the new point on an edge: in the middle if it's sharp, otherwise as computed by smooth
+func (m *subdivMesh) edgePoint(e *subdivEdge, smooth func() Tuple) Tuple {
+	mid := m.values[e.a].Add(m.values[e.b]).Mul(0.5)
+
+	switch s := e.sharp(); {
+	case s >= 1:
+		return mid
+	case s > 0:
+		return lerp(smooth(), mid, s) // Semi-sharp creases blend the rules
+	}
+
+	return smooth()
+}
+
+// vertexPoint returns the new position of a vertex: it slides along a crease or a border, stays put at a corner
+// where more of them meet, otherwise is as computed by smooth
+func (m *subdivMesh) vertexPoint(v int, edges []subdivEdge, around []int, faces []int, smooth func() Tuple) Tuple {
+	if len(around) == 0 {
+		return m.values[v] // Unused
+	}
+
+	var ends []int
+	border := false
+	sharpness := 0.0
+
+	for _, e := range around {
+		if s := edges[e].sharp(); s > 0 {
+			ends = append(ends, edges[e].other(v))
+			sharpness += math.Min(s, 1)
+			border = border || len(edges[e].faces) != 2
+		}
+	}
+
+	if len(ends) < 2 {
+		return smooth()
+	}
+
+	// A vertex with a single face, like the corner of a quad on the border, is a corner too
+	p := m.values[v]
+
+	if len(ends) == 2 && len(faces) > 1 {
+		p = m.values[ends[0]].Add(p.Mul(6)).Add(m.values[ends[1]]).Mul(1.0 / 8)
+	}
+
+	if sharpness /= float64(len(ends)); sharpness < 1 && !border {
+		return lerp(smooth(), p, sharpness)
+	}
+
+	return p
+}
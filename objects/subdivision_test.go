@@ -0,0 +1,277 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+)
+
+const subdivCube = `
+v -1 -1 -1
+v +1 -1 -1
+v +1 +1 -1
+v -1 +1 -1
+v -1 -1 +1
+v +1 -1 +1
+v +1 +1 +1
+v -1 +1 +1
+f 1 4 3 2
+f 5 6 7 8
+f 1 2 6 5
+f 2 3 7 6
+f 3 4 8 7
+f 4 1 5 8
+`
+
+// parseSubdiv parses a mesh that can be subdivided
+func parseSubdiv(src string) *ObjInfo {
+	return ParseWavefrontObjWithOptions(strings.NewReader(src), "", ObjParserOptions{KeepPolygons: true})
+}
+
+func hasPoint(points []Tuple, p Tuple) bool {
+	for _, q := range points {
+		if q.Equals(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestObjKeepsPolygons(t *testing.T) {
+	// Polygons are kept only if asked for
+	if obj := ParseWavefrontObjFromString(subdivCube); len(obj.P) != 0 || len(obj.F) != 12 {
+		t.Errorf("cube has %d polygons and %d triangles", len(obj.P), len(obj.F))
+	}
+
+	obj := parseSubdiv(subdivCube + "t crease 2/1 0 1 2.5\nt crease 3/0 2 3 7\n")
+
+	if len(obj.P) != 6 || len(obj.F) != 12 {
+		t.Fatalf("cube has %d polygons and %d triangles", len(obj.P), len(obj.F))
+	}
+
+	if p := obj.P[2]; len(p.V) != 4 || p.V[0] != 0 || p.V[1] != 1 || p.V[2] != 5 || p.V[3] != 4 {
+		t.Errorf("polygon vertices mismatch: %v", p.V)
+	}
+
+	creases := []ObjInfoCrease{{[2]int{0, 1}, 2.5}, {[2]int{2, 3}, math.Inf(+1)}, {[2]int{3, 7}, math.Inf(+1)}}
+
+	if len(obj.Creases) != len(creases) {
+		t.Fatalf("creases are %v", obj.Creases)
+	}
+
+	for i, c := range creases {
+		if obj.Creases[i] != c {
+			t.Errorf("crease %d is %v, should be %v", i, obj.Creases[i], c)
+		}
+	}
+}
+
+func TestCatmullClark(t *testing.T) {
+	obj := parseSubdiv(subdivCube)
+	obj.Subdivide(1)
+
+	// Each quad is split in 4, there is a new vertex for each edge and face
+	if len(obj.P) != 24 || len(obj.F) != 48 || len(obj.V) != 8+12+6 {
+		t.Fatalf("subdivided cube has %d polygons, %d triangles, %d vertices", len(obj.P), len(obj.F), len(obj.V))
+	}
+
+	for _, p := range []Tuple{Point(5.0/9, 5.0/9, 5.0/9), Point(0.75, 0.75, 0), Point(1, 0, 0), Point(0, 0, -1)} {
+		if !hasPoint(obj.V, p) {
+			t.Errorf("subdivided cube should have vertex %v", p)
+		}
+	}
+
+	// The cube becomes round
+	obj.Subdivide(3)
+
+	min, max := math.Inf(+1), 0.0
+	for _, v := range obj.V {
+		min, max = math.Min(min, v.Length()), math.Max(max, v.Length())
+	}
+
+	if max/min > 1.1 {
+		t.Errorf("subdivided cube is not round, radius goes from %v to %v", min, max)
+	}
+
+	// Unless all its edges are creases
+	var creases strings.Builder
+	for _, e := range [][2]int{{0, 1}, {1, 2}, {2, 3}, {3, 0}, {4, 5}, {5, 6}, {6, 7}, {7, 4}, {0, 4}, {1, 5}, {2, 6}, {3, 7}} {
+		creases.WriteString("t crease 2/0 " + string(rune('0'+e[0])) + " " + string(rune('0'+e[1])) + "\n")
+	}
+
+	obj = parseSubdiv(subdivCube + creases.String())
+	obj.Subdivide(3)
+
+	for _, v := range obj.V {
+		if m := Max3(math.Abs(v.X), math.Abs(v.Y), math.Abs(v.Z)); !FloatEqual(m, 1) {
+			t.Errorf("vertex %v is not on the creased cube", v)
+		}
+	}
+
+	for _, p := range []Tuple{Point(1, 1, 1), Point(-1, 1, -1), Point(1, 0.5, 1)} {
+		if !hasPoint(obj.V, p) {
+			t.Errorf("creased cube should have vertex %v", p)
+		}
+	}
+}
+
+func TestSemiSharpCrease(t *testing.T) {
+	// A crease with sharpness 2 is sharp for two levels, then it's gone
+	obj := parseSubdiv(subdivCube + "t crease 2/1 0 1 2\n")
+	obj.Subdivide(1)
+
+	if len(obj.Creases) != 2 || obj.Creases[0].Sharpness != 1 || obj.Creases[1].Sharpness != 1 {
+		t.Errorf("creases after one level are %v", obj.Creases)
+	}
+
+	// The middle of the creased edge does not move
+	if !hasPoint(obj.V, Point(0, -1, -1)) {
+		t.Errorf("crease should keep vertex %v", Point(0, -1, -1))
+	}
+
+	obj.Subdivide(1)
+
+	if len(obj.Creases) != 0 {
+		t.Errorf("creases after two levels are %v", obj.Creases)
+	}
+
+	// A fractional sharpness is between smooth (-0.75) and sharp (-1)
+	obj = parseSubdiv(subdivCube + "t crease 2/1 0 1 0.5\n")
+	obj.Subdivide(1)
+
+	if !hasPoint(obj.V, Point(0, -0.875, -0.875)) {
+		t.Errorf("semi-sharp crease should have vertex %v", Point(0, -0.875, -0.875))
+	}
+}
+
+func TestLoop(t *testing.T) {
+	data := `
+v +1 0 0
+v -1 0 0
+v 0 +1 0
+v 0 -1 0
+v 0 0 +1
+v 0 0 -1
+f 1 3 5
+f 3 2 5
+f 2 4 5
+f 4 1 5
+f 3 1 6
+f 2 3 6
+f 4 2 6
+f 1 4 6
+`
+	obj := parseSubdiv(data)
+	obj.Subdivide(1)
+
+	if len(obj.P) != 32 || len(obj.F) != 32 || len(obj.V) != 6+12 {
+		t.Fatalf("subdivided octahedron has %d polygons, %d triangles, %d vertices", len(obj.P), len(obj.F), len(obj.V))
+	}
+
+	// Vertices of valence 4 have beta = 31/256, edge points are 3/8 of their ends and 1/8 of the opposite vertices
+	if !obj.V[0].Equals(Point(1-4*31.0/256, 0, 0)) {
+		t.Errorf("vertex is %v", obj.V[0])
+	}
+
+	if !hasPoint(obj.V, Point(0.375, 0.375, 0)) {
+		t.Errorf("subdivided octahedron should have vertex %v", Point(0.375, 0.375, 0))
+	}
+
+	// Triangles keep their orientation
+	for _, f := range obj.F {
+		p0, p1, p2 := obj.V[f.V[0]], obj.V[f.V[1]], obj.V[f.V[2]]
+
+		if n := p1.Sub(p0).CrossProduct(p2.Sub(p0)); n.DotProduct(p0) <= 0 {
+			t.Errorf("triangle %v is flipped", f.V)
+		}
+	}
+}
+
+func TestSubdivisionUV(t *testing.T) {
+	// Two quads with a seam between them: the second is at u+10
+	data := `
+v 0 0 0
+v 1 0 0
+v 2 0 0
+v 0 0 1
+v 1 0 1
+v 2 0 1
+vt 0 0
+vt 1 0
+vt 0 1
+vt 1 1
+vt 11 0
+vt 12 0
+vt 11 1
+vt 12 1
+f 1/1 2/2 5/4 4/3
+f 2/5 3/6 6/8 5/7
+`
+	obj := parseSubdiv(data)
+	obj.Subdivide(2)
+
+	if len(obj.VT) == 0 || len(obj.P) != 32 {
+		t.Fatalf("subdivided quads have %d polygons and %d texture vertices", len(obj.P), len(obj.VT))
+	}
+
+	for _, p := range obj.P {
+		for i := range p.V {
+			v, vt := obj.V[p.V[i]], obj.VT[p.VT[i]]
+
+			u := v.X
+			if vt.X > 5 {
+				u += 10
+			}
+
+			if !FloatEqual(vt.X, u) || !FloatEqual(vt.Y, v.Z) {
+				t.Errorf("texture coordinates %v don't match vertex %v", vt, v)
+			}
+		}
+	}
+
+	// The border is still a square
+	for _, p := range []Tuple{Point(0, 0, 0), Point(2, 0, 1), Point(0.25, 0, 0)} {
+		if !hasPoint(obj.V, p) {
+			t.Errorf("subdivided quads should have vertex %v", p)
+		}
+	}
+}
+
+func TestSbtSubdivide(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "cube.obj")
+
+	if err := os.WriteFile(filename, []byte(subdivCube), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scene := `
+FUN-raytracer 1.0
+
+polymesh {
+	subdivide = 2;
+	gennormals = true;
+	objfile = "cube.obj";
+}
+`
+	s, err := ParseSbtScene(strings.NewReader(scene), &SbtParserOptions{FilenameBase: dir})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 96 quads, split in triangles
+	if n := s.World.Objects[0].(*Group).Len(); n != 192 {
+		t.Errorf("subdivided cube has %d triangles", n)
+	}
+}
@@ -179,42 +179,40 @@ func (t *MeshTriangle) SetParent(p Container) {
 	t.mesh.SetParent(p)
 }
 
-func (t *MeshTriangle) AddIntersections(ray Ray, xs *Intersections) {
-	dirCrossE2 := ray.Direction.CrossProduct(t.E2)
-	det := t.E1.DotProduct(dirCrossE2)
+func (t *MeshTriangle) Visibility() Visibility {
+	return t.mesh.Visibility()
+}
 
-	const E = 1e-9 // We need higher precision than usual here for models with many small triangles
+func (t *MeshTriangle) SetVisibility(v Visibility) {
+	t.mesh.SetVisibility(v)
+}
 
-	// Check if ray is parallel to triangle plane
-	if det > -E && det < +E {
+func (t *MeshTriangle) AddIntersections(ray Ray, xs *Intersections) {
+	if t.mesh.HiddenFrom(xs) {
 		return
 	}
 
-	f := 1.0 / det
-	p1 := t.mesh.V[t.V[0]]
-	p1ToOrigin := ray.Origin.Sub(p1)
-	u := f * p1ToOrigin.DotProduct(dirCrossE2)
+	if h, u, v, ok := t.intersect(ray); ok {
+		id := xs.AddWithData(t, h)
 
-	// Ray misses by the p1-p3 edge
-	if u < 0 || u > 1 {
-		return
+		id.TU = u
+		id.TV = v
 	}
+}
 
-	originCrossE1 := p1ToOrigin.CrossProduct(t.E1)
-	v := f * ray.Direction.DotProduct(originCrossE1)
-
-	// Ray misses by the p1-p2 or p2-p3 edge
-	if v < 0 || (u+v) > 1 {
-		return
+func (t *MeshTriangle) Occludes(ray Ray, xs *Intersections) bool {
+	if t.mesh.HiddenFrom(xs) {
+		return false
 	}
 
-	// Ray hits
-	h := f * t.E2.DotProduct(originCrossE1)
+	h, _, _, ok := t.intersect(ray)
 
-	id := xs.AddWithData(t, h)
+	return ok && ray.InExtent(h)
+}
 
-	id.TU = u
-	id.TV = v
+// intersect returns the distance of the hit and its barycentric coordinates, if the ray hits the triangle
+func (t *MeshTriangle) intersect(ray Ray) (h, u, v float64, ok bool) {
+	return IntersectTriangle(ray, t.mesh.V[t.V[0]], t.mesh.V[t.V[1]], t.mesh.V[t.V[2]])
 }
 
 func (t *MeshTriangle) NormalAtHit(ii *IntersectionInfo, xs *Intersections) Tuple {
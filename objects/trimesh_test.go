@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package objects
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/shapes"
+	. "ascottix/funtracer/textures"
+)
+
+func TestMeshWatertight(t *testing.T) {
+	rand := NewRandomGenerator(2)
+
+	// A bumpy grid of quads split into triangles, coordinates are exact as float32 too;
+	// it's not too bumpy so that rays don't see it folding over itself, as they could miss at the fold
+	const n = 8
+
+	height := func(x, y int) float64 {
+		return float64((x*7+y*5)%11) / 256
+	}
+
+	var src strings.Builder
+
+	for y := 0; y <= n; y++ {
+		for x := 0; x <= n; x++ {
+			fmt.Fprintf(&src, "v %v %v %v\n", float64(x)/8, float64(y)/8, height(x, y))
+		}
+	}
+
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			i := y*(n+1) + x + 1
+			fmt.Fprintf(&src, "f %d %d %d %d\n", i, i+1, i+n+2, i+n+1)
+		}
+	}
+
+	info := ParseWavefrontObjFromString(src.String())
+
+	g := NewGroup()
+	NewTrimesh(info, -1).AddToGroup(g)
+	g.BuildBVH()
+
+	meshes := []Groupable{g, NewCompactMesh(info, -1)}
+
+	vertex := func(x, y int) Tuple {
+		return Point(float64(x)/8, float64(y)/8, height(x, y))
+	}
+
+	for i := 0; i < 2000; i++ {
+		// Pick an inner vertex and one of its neighbors, the edge between them is shared by two triangles
+		x, y := 1+i%(n-1), 1+(i/(n-1))%(n-1)
+		p := vertex(x, y)
+		q := [...]Tuple{vertex(x+1, y), vertex(x, y+1), vertex(x+1, y+1), vertex(x-1, y)}[i%4]
+
+		targets := []Tuple{p, p.Add(q.Sub(p).Mul(rand()))}
+
+		for _, target := range targets {
+			origin := Point(rand()*2-0.5, rand()*2-0.5, -4-rand()*2)
+
+			if i%2 == 1 {
+				origin.Z = -origin.Z // From above too
+			}
+
+			r := NewRay(origin, target.Sub(origin))
+
+			for j, mesh := range meshes {
+				xs := NewIntersections()
+				mesh.AddIntersections(r, xs)
+
+				if !xs.Hit().Valid() {
+					t.Fatalf("mesh %d: ray %d at %v slipped through", j, i, target)
+				}
+
+				if !mesh.Occludes(r, NewIntersections()) {
+					t.Fatalf("mesh %d: ray %d at %v is not occluded", j, i, target)
+				}
+			}
+		}
+	}
+}
@@ -16,18 +16,54 @@ const (
 	DefaultSceneFileName = "have" + DefaultSceneFileExt
 )
 
+// Integrators, i.e. how the color seen by a ray is computed
+const (
+	IntegratorWhitted          = "whitted" // Standard raytracing with recursive reflections and refractions
+	IntegratorAmbientOcclusion = "ao"      // Ambient occlusion only, useful for clay renders
+)
+
+// Samplers, i.e. how the samples inside a pixel are distributed
+const (
+	SamplerStratified = "stratified" // Jittered grid, with random numbers for the other dimensions
+	SamplerHalton     = "halton"
+	SamplerSobol      = "sobol"
+	SamplerPMJ02      = "pmj02" // Progressive multi-jittered (0,2) sequences
+)
+
+// BVH layouts, i.e. how the nodes of bounding volume hierarchies are stored and traversed
+const (
+	BvhBinary = "binary" // Two children per node
+	BvhWide4  = "wide4"  // Four children per node with compact bounds
+)
+
 type Options struct {
 	OutFilename               string `json:"o"`
 	OutWidth                  int    `json:"ow"`
 	OutHeight                 int    `json:"oh"`
+	Cameras                   string `json:"cam"`
+	Crop                      string `json:"crop"`
+	CropMerge                 bool   `json:"cropmerge"`
 	NumThreads                int    `json:"nt"`
 	Supersampling             int    `json:"ss"`
+	Sampler                   string `json:"sampler"`
+	Seed                      int64  `json:"seed"`
 	ReflectionDepth           int    `json:"rd"`
 	LensRadius                float64
 	FocalDistance             float64
-	AreaLightSamples          int `json:"aljs"`
-	AreaLightAdaptiveMinDepth int `json:"almind"`
-	AreaLightAdaptiveMaxDepth int `json:"almaxd"`
+	AreaLightSamples          int     `json:"aljs"`
+	AreaLightAdaptiveMinDepth int     `json:"almind"`
+	AreaLightAdaptiveMaxDepth int     `json:"almaxd"`
+	TransmissiveShadows       bool    `json:"ts"`
+	Photons                   int     `json:"ph"`
+	PhotonRadius              float64 `json:"phr"`
+	AmbientOcclusionSamples   int     `json:"aos"`
+	AmbientOcclusionDistance  float64 `json:"aod"`
+	Integrator                string  `json:"integrator"`
+	IrradianceSamples         int     `json:"irs"`
+	IrradianceAccuracy        float64 `json:"ira"`
+	Verbose                   bool    `json:"v"`
+	Bvh                       string  `json:"bvh"`
+	MeshCacheDir              string  `json:"cache"`
 }
 
 func NewOptions() *Options {
@@ -38,6 +74,8 @@ func NewOptions() *Options {
 		OutHeight:       0,
 		NumThreads:      runtime.GOMAXPROCS(0),
 		Supersampling:   1,
+		Sampler:         SamplerStratified,
+		Seed:            1,
 		ReflectionDepth: 4,
 		// Camera parameters
 		LensRadius:    0,
@@ -46,6 +84,19 @@ func NewOptions() *Options {
 		AreaLightSamples:          0, // Samples per axis, 0 switches to the adaptive sampler
 		AreaLightAdaptiveMinDepth: 5, // Bump if hard shadows or incorrect specular
 		AreaLightAdaptiveMaxDepth: 9, // Bump if banding shows up in shadows
+		// Shadow parameters
+		TransmissiveShadows: false, // If enabled transparent objects cast lighter, colored shadows
+		// Caustics parameters
+		Photons:      0,   // Photons emitted by each light, 0 disables caustics
+		PhotonRadius: 0.1, // Radius used to gather photons, bigger is smoother but blurrier
+		// Ambient occlusion parameters
+		AmbientOcclusionSamples:  0, // Samples per axis, 0 disables ambient occlusion
+		AmbientOcclusionDistance: 1, // Objects farther than this do not occlude
+		Integrator:               IntegratorWhitted,
+		Bvh:                      BvhBinary,
+		// Indirect illumination parameters
+		IrradianceSamples:  0,   // Hemisphere subdivisions in theta (phi gets three times as many), 0 disables indirect illumination
+		IrradianceAccuracy: 0.2, // Maximum interpolation error of the irradiance cache, smaller is more accurate but slower
 	}
 
 	return &options
@@ -55,11 +106,27 @@ func (options *Options) InitFlags() {
 	flag.StringVar(&options.OutFilename, "o", options.OutFilename, "name of output image file")
 	flag.IntVar(&options.OutWidth, "ow", options.OutWidth, "output image width")
 	flag.IntVar(&options.OutHeight, "oh", options.OutHeight, "output image height")
+	flag.StringVar(&options.Cameras, "cam", options.Cameras, "comma separated names of the cameras to render, or \"all\" (default is the first camera)")
+	flag.StringVar(&options.Crop, "crop", options.Crop, "render only the region x0,y0,x1,y1 of the image, in pixels or in percent of the image size if followed by %")
+	flag.BoolVar(&options.CropMerge, "cropmerge", options.CropMerge, "merge the cropped region into the existing output image, instead of saving it alone")
 	flag.IntVar(&options.NumThreads, "nt", options.NumThreads, "how many threads can be used for processing")
 	flag.IntVar(&options.Supersampling, "ss", options.Supersampling, "supersampling level: each pixel is sampled n*n times")
+	flag.StringVar(&options.Sampler, "sampler", options.Sampler, "how pixels are sampled: stratified, halton, sobol or pmj02")
+	flag.Int64Var(&options.Seed, "seed", options.Seed, "seed for random numbers: the same seed always renders the same image")
 	flag.IntVar(&options.ReflectionDepth, "rd", options.ReflectionDepth, "maximum depth of secondary rays")
 	flag.Float64Var(&options.LensRadius, "lr", options.LensRadius, "radius of camera lens (controls depth of field)")
 	flag.Float64Var(&options.FocalDistance, "fd", options.FocalDistance, "camera focal distance (enabled if lens radius is positive)")
+	flag.BoolVar(&options.TransmissiveShadows, "ts", options.TransmissiveShadows, "let light pass thru transparent objects when computing shadows")
+	flag.IntVar(&options.Photons, "ph", options.Photons, "photons emitted by each light to render caustics (0 disables caustics)")
+	flag.Float64Var(&options.PhotonRadius, "phr", options.PhotonRadius, "radius used to gather photons when rendering caustics")
+	flag.IntVar(&options.AmbientOcclusionSamples, "aos", options.AmbientOcclusionSamples, "ambient occlusion samples: n*n rays are shot at each hit (0 disables ambient occlusion)")
+	flag.Float64Var(&options.AmbientOcclusionDistance, "aod", options.AmbientOcclusionDistance, "maximum distance of objects that occlude ambient light")
+	flag.IntVar(&options.IrradianceSamples, "irs", options.IrradianceSamples, "hemisphere subdivisions used to compute indirect illumination (0 disables indirect illumination)")
+	flag.Float64Var(&options.IrradianceAccuracy, "ira", options.IrradianceAccuracy, "accuracy of indirect illumination: smaller is better but slower")
+	flag.StringVar(&options.Bvh, "bvh", options.Bvh, "layout of bounding volume hierarchies: binary or wide4")
+	flag.StringVar(&options.MeshCacheDir, "cache", options.MeshCacheDir, "directory where meshes and their BVH are cached, to load them faster next time (empty disables the cache)")
+	flag.BoolVar(&options.Verbose, "v", options.Verbose, "print more information, like statistics about the BVH")
+	flag.StringVar(&options.Integrator, "integrator", options.Integrator, "how to render the scene: whitted (standard) or ao (ambient occlusion only)")
 }
 
 func (options *Options) LoadFromJSON(filename string) {
@@ -0,0 +1,202 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"unsafe"
+)
+
+// Arrays start at a multiple of 8 bytes from the beginning of the data, so that when the data is aligned
+// (like a file read in memory or mapped) and the machine is little endian they can be used in place
+const binaryArrayAlignment = 8
+
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// BinaryWriter writes little endian values, used to store data structures into cache files.
+// The first error is remembered and all the following writes are ignored
+type BinaryWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+	off int
+	err error
+}
+
+func NewBinaryWriter(w io.Writer) *BinaryWriter {
+	return &BinaryWriter{w: bufio.NewWriterSize(w, 1<<16)}
+}
+
+func (bw *BinaryWriter) write(b []byte) {
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(b)
+		bw.off += len(b)
+	}
+}
+
+func (bw *BinaryWriter) align() {
+	var zero [binaryArrayAlignment]byte
+	bw.write(zero[:(binaryArrayAlignment-bw.off%binaryArrayAlignment)%binaryArrayAlignment])
+}
+
+// WriteArray writes the number of values followed by the values, which must have a fixed size
+// (numbers or structs of numbers, see encoding/binary)
+func WriteArray[T any](bw *BinaryWriter, values []T) {
+	bw.Uint32(uint32(len(values)))
+	bw.align()
+
+	if littleEndian {
+		size := len(values) * binary.Size(*new(T))
+		bw.write(unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(values))), size))
+	} else if bw.err == nil {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, values)
+		bw.write(b.Bytes())
+	}
+}
+
+func (bw *BinaryWriter) Uint32(v uint32) {
+	binary.LittleEndian.PutUint32(bw.buf[:4], v)
+	bw.write(bw.buf[:4])
+}
+
+func (bw *BinaryWriter) Int32(v int32) {
+	bw.Uint32(uint32(v))
+}
+
+func (bw *BinaryWriter) Float64(v float64) {
+	binary.LittleEndian.PutUint64(bw.buf[:8], math.Float64bits(v))
+	bw.write(bw.buf[:8])
+}
+
+func (bw *BinaryWriter) Float32(v float32) {
+	bw.Uint32(math.Float32bits(v))
+}
+
+func (bw *BinaryWriter) Bytes(b []byte) {
+	bw.write(b)
+}
+
+func (bw *BinaryWriter) String(s string) {
+	bw.Uint32(uint32(len(s)))
+	bw.write([]byte(s))
+}
+
+// Flush writes any buffered data and returns the first error
+func (bw *BinaryWriter) Flush() error {
+	if bw.err == nil {
+		bw.err = bw.w.Flush()
+	}
+
+	return bw.err
+}
+
+var ErrBinaryTruncated = errors.New("binary data is truncated")
+
+// BinaryReader reads the values written by a BinaryWriter from a buffer, which is usually a whole file
+// read at once. After the first error all values read are zero
+type BinaryReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func NewBinaryReader(data []byte) *BinaryReader {
+	return &BinaryReader{data: data}
+}
+
+func (br *BinaryReader) next(n int) []byte {
+	if br.err != nil || n < 0 || br.off+n > len(br.data) {
+		br.err = ErrBinaryTruncated
+		return nil
+	}
+
+	b := br.data[br.off : br.off+n]
+	br.off += n
+
+	return b
+}
+
+func (br *BinaryReader) Uint32() uint32 {
+	if b := br.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (br *BinaryReader) Int32() int32 {
+	return int32(br.Uint32())
+}
+
+func (br *BinaryReader) Float64() float64 {
+	if b := br.next(8); b != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+
+	return 0
+}
+
+func (br *BinaryReader) Float32() float32 {
+	return math.Float32frombits(br.Uint32())
+}
+
+func (br *BinaryReader) Bytes(n int) []byte {
+	return br.next(n)
+}
+
+func (br *BinaryReader) String() string {
+	return string(br.next(int(br.Uint32())))
+}
+
+// Count reads a number of elements, failing if there's not enough data left for them
+// (each element takes at least size bytes), so that corrupted data does not cause huge allocations
+func (br *BinaryReader) Count(size int) int {
+	n := int(br.Uint32())
+
+	if br.err == nil && n*size > len(br.data)-br.off {
+		br.err = ErrBinaryTruncated
+		return 0
+	}
+
+	return n
+}
+
+// ReadArray reads the values written by WriteArray: if possible they are not copied, but they share the memory
+// of the data, so they must not be modified
+func ReadArray[T any](br *BinaryReader) []T {
+	size := binary.Size(*new(T))
+	n := br.Count(size)
+
+	if pad := (binaryArrayAlignment - br.off%binaryArrayAlignment) % binaryArrayAlignment; br.err == nil {
+		br.next(pad)
+	}
+
+	b := br.next(n * size)
+
+	if b == nil || n == 0 {
+		return nil
+	}
+
+	if littleEndian && uintptr(unsafe.Pointer(&b[0]))%uintptr(unsafe.Alignof(*new(T))) == 0 {
+		return unsafe.Slice((*T)(unsafe.Pointer(&b[0])), n)
+	}
+
+	values := make([]T, n)
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, values)
+
+	return values
+}
+
+func (br *BinaryReader) Err() error {
+	return br.err
+}
@@ -28,6 +28,13 @@ func (b Box) Union(a Box) Box {
 	}
 }
 
+// IsFinite returns false if the box is infinite (or undefined) along any axis, as for planes
+func (b Box) IsFinite() bool {
+	sum := b.Min.X + b.Min.Y + b.Min.Z + b.Max.X + b.Max.Y + b.Max.Z
+
+	return !math.IsInf(sum, 0) && !math.IsNaN(sum)
+}
+
 func (b Box) Transform(m Matrix) Box {
 	// Get the box vertices
 	vs := []Tuple{
@@ -55,6 +62,12 @@ func (b Box) Transform(m Matrix) Box {
 	return a
 }
 
+// slabErrorScale enlarges the far distance of a slab to cover the rounding errors of its computation, so that rays
+// that graze a box, e.g. aimed exactly at a vertex of a mesh, are not missed (see PBRT 3rd ed. section 3.9.2)
+var slabErrorScale = 1 + 2*3*epsilon64/(1-3*epsilon64)
+
+const epsilon64 = 0x1p-53 // Machine epsilon for float64 as used by PBRT, i.e. half the distance from 1 to the next float
+
 func (b Box) Intersects(ray Ray) bool {
 	ray.Direction.X = 1 / ray.Direction.X
 	ray.Direction.Y = 1 / ray.Direction.Y
@@ -64,6 +77,20 @@ func (b Box) Intersects(ray Ray) bool {
 }
 
 func (b Box) IntersectsInvDir(ray Ray) bool {
+	tmin, tmax := b.rangeInvDir(ray)
+
+	return tmin <= tmax
+}
+
+// IntersectsInvDirRange checks if a ray hits the box between distances tmin and tmax, the ray direction must have been inverted
+func (b Box) IntersectsInvDirRange(ray Ray, tmin, tmax float64) bool {
+	bmin, bmax := b.rangeInvDir(ray)
+
+	return bmin <= bmax && bmin <= tmax && bmax >= tmin
+}
+
+// rangeInvDir returns the range of distances where the ray is inside the box, it's empty if tmin > tmax
+func (b Box) rangeInvDir(ray Ray) (float64, float64) {
 	checkAxis := func(origin, invdir, min, max float64) (tmin, tmax float64) {
 		if invdir >= 0 {
 			tmin = (min - origin) * invdir
@@ -73,7 +100,7 @@ func (b Box) IntersectsInvDir(ray Ray) bool {
 			tmin = (max - origin) * invdir
 		}
 
-		return tmin, tmax
+		return tmin, tmax * slabErrorScale
 	}
 
 	xtmin, xtmax := checkAxis(ray.Origin.X, ray.Direction.X, b.Min.X, b.Max.X)
@@ -107,7 +134,7 @@ func (b Box) IntersectsInvDir(ray Ray) bool {
 		tmax = ztmax
 	}
 
-	return tmin <= tmax
+	return tmin, tmax
 }
 
 func (b Box) ToCube() *Shape {
@@ -5,7 +5,14 @@
 package shapes
 
 import (
+	"fmt"
+	"math"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	. "ascottix/funtracer/maths"
 	. "ascottix/funtracer/textures"
@@ -54,21 +61,51 @@ const BvhMaxObjectsPerNode = 16
 
 const BvhNumBuckets = 8
 
+const BvhParallelBuildThreshold = 4096 // Nodes with at least this many objects build their children in parallel
+
+const BvhParallelBinningThreshold = 65536 // Nodes with at least this many objects are binned in parallel
+
 const BvhBboxIntersectionCost = 0.3 // Relative to the cost of intersecting a primitive shape, which is set to 1 as a reference
 
-// BuildBVH build a Bounding Volume Hierarchy for the group,
-// using the algorithms described in Physically Based Rendering
+// Bvh is a Bounding Volume Hierarchy over a list of objects. Objects with infinite bounds (like planes)
+// cannot be partitioned, so they are kept apart and always tested
+type Bvh struct {
+	objects   []Groupable // Objects ordered so that each leaf references consecutive elements
+	nodes     []BvhLinearNode
+	unbounded []Groupable
+	buildTime time.Duration
+	wide      []Bvh4Node // Nodes of the 4-wide layout, if built
+	layout    BvhLayout
+}
+
+// BuildBVH build a Bounding Volume Hierarchy for the group
 func (g *Group) BuildBVH() {
-	objInfo := make([]BvhObjectInfo, len(g.members))
-	orderedObjects := make([]Groupable, 0, len(g.members))
+	g.bvh = NewBvh(g.members, g.Transform())
+	g.members = g.bvh.Objects()
+}
+
+// NewBvh builds a Bounding Volume Hierarchy for a list of objects, using the algorithms described
+// in Physically Based Rendering. The bounds of the objects are transformed by m, which is the
+// transform of their container (if any) so that the BVH can be tested with rays in its space
+func NewBvh(members []Groupable, m Matrix) *Bvh {
+	bvh := &Bvh{}
+	buildStart := time.Now()
+
+	objInfo := make([]BvhObjectInfo, 0, len(members))
+	orderedObjects := make([]Groupable, 0, len(members))
 
 	// Phase 1: collect info about all objects and build bounds
-	for i, s := range g.members {
+	for i, s := range members {
 		bbox := s.Bounds(). // Bounds in object local space
-					Transform(s.Transform()). // Bounds in group local space
-					Transform(g.Transform())  // Bounds in world space
+					Transform(s.Transform()). // Bounds in container local space
+					Transform(m)              // Bounds in world space
+
+		if !bbox.IsFinite() {
+			bvh.unbounded = append(bvh.unbounded, s)
+			continue
+		}
 
-		objInfo[i] = BvhObjectInfo{
+		objInfo = append(objInfo, BvhObjectInfo{
 			i,
 			bbox,
 			Point(
@@ -76,19 +113,38 @@ func (g *Group) BuildBVH() {
 				(bbox.Min.Y+bbox.Max.Y)/2,
 				(bbox.Min.Z+bbox.Max.Z)/2,
 			),
-		}
+		})
+	}
+
+	if len(objInfo) == 0 {
+		return bvh
 	}
 
+	bvh.nodes = buildBvhNodes(objInfo)
+
+	for _, info := range objInfo {
+		orderedObjects = append(orderedObjects, members[info.idx])
+	}
+
+	bvh.objects = orderedObjects
+	bvh.buildTime = time.Since(buildStart)
+
+	return bvh
+}
+
+// buildBvhNodes builds the nodes of a BVH, objInfo is reordered so that the objects of each leaf are consecutive
+func buildBvhNodes(objInfo []BvhObjectInfo) []BvhLinearNode {
 	// Phase 2: build tree
 	method := BvhSplitSAH
 
-	totalNodes := 0
+	var totalNodes int64
 
 	var bvhRecursiveBuild func(int, int, int) *BvhBuildNode
 
+	// Nodes partition disjoint ranges of objInfo, so subtrees can be built in parallel
 	bvhRecursiveBuild = func(start, end, level int) *BvhBuildNode {
 		node := BvhBuildNode{}
-		totalNodes++
+		atomic.AddInt64(&totalNodes, 1)
 
 		if start < end {
 			objInfo[start], objInfo[end-1] = objInfo[end-1], objInfo[start]
@@ -162,26 +218,8 @@ func (g *Group) BuildBVH() {
 					mid = (start + end) / 2
 				case BvhSplitSAH:
 					if numObjects > 2 {
-						// Allocate buckets
-						buckets := [BvhNumBuckets]BvhBucketInfo{}
-
-						for i := range buckets {
-							buckets[i].bounds = NewBox(PointAtInfinity(+1), PointAtInfinity(-1))
-						}
-
 						// Initialize bucket info
-						for i := start; i < end; i++ {
-							b := int(BvhNumBuckets * centroidBounds.Offset(objInfo[i].centroid).CompByIdx(dim))
-
-							if b == BvhNumBuckets {
-								b--
-							}
-
-							// Note: if we get an "index out of bounds" panic here, then probably b is NaN
-							// because the group contains planes, which have infinite bounds
-							buckets[b].count++
-							buckets[b].bounds = buckets[b].bounds.Union(objInfo[i].bounds)
-						}
+						buckets := binBvhObjects(objInfo[start:end], centroidBounds, dim)
 
 						// Compute splitting cost
 						for i := 0; i < BvhNumBuckets-1; i++ {
@@ -249,8 +287,22 @@ func (g *Group) BuildBVH() {
 				// Build an interior node
 				if mid != end {
 					node.splitAxis = dim
-					node.child[0] = bvhRecursiveBuild(start, mid, level+1)
-					node.child[1] = bvhRecursiveBuild(mid, end, level+1)
+					if numObjects >= BvhParallelBuildThreshold {
+						var wg sync.WaitGroup
+
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							node.child[0] = bvhRecursiveBuild(start, mid, level+1)
+						}()
+
+						node.child[1] = bvhRecursiveBuild(mid, end, level+1)
+
+						wg.Wait()
+					} else {
+						node.child[0] = bvhRecursiveBuild(start, mid, level+1)
+						node.child[1] = bvhRecursiveBuild(mid, end, level+1)
+					}
 					node.bounds = node.child[0].bounds.Union(node.child[1].bounds)
 
 					return &node
@@ -264,19 +316,14 @@ func (g *Group) BuildBVH() {
 		// Leaf
 		// Debugln("LEAF")
 		node.bounds = bounds
-		node.objIdx = len(orderedObjects)
+		node.objIdx = start // Objects will be ordered like objInfo once the tree is complete
 		node.objCount = numObjects
-		for i := start; i < end; i++ {
-			orderedObjects = append(orderedObjects, g.members[objInfo[i].idx])
-		}
 
 		return &node
 	}
 
 	root := bvhRecursiveBuild(0, len(objInfo), 0)
 
-	g.members = orderedObjects
-
 	// Phase 3: flatten tree
 	nodes := make([]BvhLinearNode, totalNodes)
 	offset := 0
@@ -303,13 +350,191 @@ func (g *Group) BuildBVH() {
 
 	flattenBvhTree(root)
 
-	g.bvhNodes = nodes
+	return nodes
+}
+
+// binBvhObjects distributes objects into buckets along an axis, according to their centroids,
+// large lists are split into chunks which are binned in parallel and then merged
+func binBvhObjects(objInfo []BvhObjectInfo, centroidBounds Box, dim int) [BvhNumBuckets]BvhBucketInfo {
+	bin := func(objInfo []BvhObjectInfo) (buckets [BvhNumBuckets]BvhBucketInfo) {
+		for i := range buckets {
+			buckets[i].bounds = NewBox(PointAtInfinity(+1), PointAtInfinity(-1))
+		}
+
+		for _, info := range objInfo {
+			b := int(BvhNumBuckets * centroidBounds.Offset(info.centroid).CompByIdx(dim))
+
+			if b == BvhNumBuckets {
+				b--
+			}
+
+			buckets[b].count++
+			buckets[b].bounds = buckets[b].bounds.Union(info.bounds)
+		}
+
+		return
+	}
+
+	chunks := runtime.GOMAXPROCS(0)
+
+	if len(objInfo) < BvhParallelBinningThreshold || chunks == 1 {
+		return bin(objInfo)
+	}
+
+	var wg sync.WaitGroup
+
+	partial := make([][BvhNumBuckets]BvhBucketInfo, chunks)
+	size := (len(objInfo) + chunks - 1) / chunks
+
+	for c := 0; c < chunks; c++ {
+		start := c * size
+		end := start + size
+		if end > len(objInfo) {
+			end = len(objInfo)
+		}
+
+		wg.Add(1)
+		go func(c, start, end int) {
+			defer wg.Done()
+			partial[c] = bin(objInfo[start:end])
+		}(c, start, end)
+	}
+
+	wg.Wait()
+
+	buckets := partial[0]
+
+	for _, p := range partial[1:] {
+		for i := range buckets {
+			buckets[i].count += p[i].count
+			buckets[i].bounds = buckets[i].bounds.Union(p[i].bounds)
+		}
+	}
+
+	return buckets
+}
+
+// BvhStats describes the shape of a BVH, to evaluate its quality and the cost of building it
+type BvhStats struct {
+	Objects   int           // Objects in the tree, not counting the unbounded ones
+	Unbounded int           // Objects that are always tested because they have infinite bounds
+	Nodes     int           // Total number of nodes, interior and leaves
+	Leaves    int           // Number of leaves
+	MaxDepth  int           // Depth of the deepest leaf, the root has depth zero
+	LeafSizes []int         // Histogram of the number of objects in leaves: LeafSizes[n] leaves have n objects
+	SAHCost   float64       // Expected cost of intersecting a ray with the tree, according to the Surface Area Heuristic
+	BuildTime time.Duration // Time spent building the tree
+	WideNodes int           // Number of nodes of the 4-wide layout, zero if not built
+}
+
+// Stats returns the statistics of the BVH
+func (bvh *Bvh) Stats() BvhStats {
+	stats := BvhStats{
+		Objects:   len(bvh.objects),
+		Unbounded: len(bvh.unbounded),
+		Nodes:     len(bvh.nodes),
+		BuildTime: bvh.buildTime,
+		WideNodes: bvh.Wide4Nodes(),
+	}
+
+	if len(bvh.nodes) == 0 {
+		return stats
+	}
+
+	rootArea := bvh.nodes[0].bounds.SurfaceArea()
+
+	var visit func(int, int)
+
+	visit = func(index, depth int) {
+		node := &bvh.nodes[index]
+		area := 1.0
+		if rootArea > 0 {
+			area = node.bounds.SurfaceArea() / rootArea // Probability that a ray hitting the root also hits the node
+		}
+
+		if node.objCount > 0 {
+			stats.Leaves++
+			stats.SAHCost += area * float64(node.objCount)
+
+			if depth > stats.MaxDepth {
+				stats.MaxDepth = depth
+			}
+
+			for len(stats.LeafSizes) <= node.objCount {
+				stats.LeafSizes = append(stats.LeafSizes, 0)
+			}
+			stats.LeafSizes[node.objCount]++
+		} else {
+			stats.SAHCost += area * BvhBboxIntersectionCost
+			visit(index+1, depth+1)
+			visit(node.index, depth+1)
+		}
+	}
+
+	visit(0, 0)
+
+	return stats
+}
+
+func (s BvhStats) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "objects=%d unbounded=%d nodes=%d leaves=%d depth=%d sah=%.2f time=%s leaf sizes=[",
+		s.Objects, s.Unbounded, s.Nodes, s.Leaves, s.MaxDepth, s.SAHCost, s.BuildTime.Round(time.Microsecond))
+
+	sep := ""
+	for n, count := range s.LeafSizes {
+		if count > 0 {
+			fmt.Fprintf(&sb, "%s%d:%d", sep, n, count)
+			sep = " "
+		}
+	}
+
+	sb.WriteString("]")
+
+	if s.WideNodes > 0 {
+		fmt.Fprintf(&sb, " wide4 nodes=%d", s.WideNodes)
+	}
+
+	return sb.String()
+}
+
+// Objects returns all the objects in the BVH, in the order used by the leaves followed by the unbounded ones
+func (bvh *Bvh) Objects() []Groupable {
+	return append(bvh.objects[:len(bvh.objects):len(bvh.objects)], bvh.unbounded...)
+}
+
+// Bvh returns the BVH of the group, nil if not built
+func (g *Group) Bvh() *Bvh {
+	return g.bvh
+}
+
+// Len returns how many objects are in the BVH
+func (bvh *Bvh) Len() int {
+	return len(bvh.objects) + len(bvh.unbounded)
 }
 
 // AddIntersectionsBvh checks for intersections between a ray and all objects
 // in the group, using a BVH for performance
 func (g *Group) AddIntersectionsBvh(ray Ray, xs *Intersections) {
-	rayInObjectSpace := ray.Transform(g.Tinverse)
+	g.bvh.AddIntersections(ray, ray.Transform(g.Tinverse), xs)
+}
+
+// AddIntersections checks for intersections between a ray and all objects in the BVH:
+// ray is used to test the nodes, while objects are tested with the ray in their container space
+func (bvh *Bvh) AddIntersections(ray, rayInObjectSpace Ray, xs *Intersections) {
+	for _, s := range bvh.unbounded {
+		s.AddIntersections(rayInObjectSpace, xs)
+	}
+
+	if len(bvh.nodes) == 0 {
+		return
+	}
+
+	if bvh.layout == BvhLayoutWide4 {
+		bvh.addIntersectionsWide4(ray, rayInObjectSpace, xs)
+		return
+	}
 
 	toVisitOffset := 0
 	currentNodeIndex := 0
@@ -320,13 +545,14 @@ func (g *Group) AddIntersectionsBvh(ray Ray, xs *Intersections) {
 	ray.Direction.Z = 1 / ray.Direction.Z
 
 	for {
-		node := &(g.bvhNodes[currentNodeIndex])
+		node := &(bvh.nodes[currentNodeIndex])
 
-		if node.bounds.IntersectsInvDir(ray) {
+		// Nodes farther than the closest hit found so far can be skipped, if pruning is enabled
+		if node.bounds.IntersectsInvDirRange(ray, math.Inf(-1), xs.PruneDistance()) {
 			if node.objCount > 0 {
 				// Leaf: test all objects
 				for i := 0; i < node.objCount; i++ {
-					s := g.members[node.index+i]
+					s := bvh.objects[node.index+i]
 					s.AddIntersections(rayInObjectSpace, xs)
 				}
 
@@ -352,3 +578,59 @@ func (g *Group) AddIntersectionsBvh(ray Ray, xs *Intersections) {
 		}
 	}
 }
+
+// Occludes returns true as soon as an object in the BVH is found within the extent of the ray,
+// it always uses the binary layout as the order of traversal does not matter
+func (bvh *Bvh) Occludes(ray, rayInObjectSpace Ray, xs *Intersections) bool {
+	for _, s := range bvh.unbounded {
+		if s.Occludes(rayInObjectSpace, xs) {
+			return true
+		}
+	}
+
+	if len(bvh.nodes) == 0 {
+		return false
+	}
+
+	toVisitOffset := 0
+	currentNodeIndex := 0
+	nodesToVisit := [64]int{}
+
+	ray.Direction.X = 1 / ray.Direction.X // Precompute inverse direction
+	ray.Direction.Y = 1 / ray.Direction.Y
+	ray.Direction.Z = 1 / ray.Direction.Z
+
+	for {
+		node := &(bvh.nodes[currentNodeIndex])
+
+		if node.bounds.IntersectsInvDirRange(ray, ray.TMin, ray.TMax) {
+			if node.objCount > 0 {
+				for i := 0; i < node.objCount; i++ {
+					if bvh.objects[node.index+i].Occludes(rayInObjectSpace, xs) {
+						return true
+					}
+				}
+
+				if toVisitOffset == 0 {
+					break
+				}
+
+				toVisitOffset--
+				currentNodeIndex = nodesToVisit[toVisitOffset]
+			} else {
+				currentNodeIndex = currentNodeIndex + 1
+				nodesToVisit[toVisitOffset] = node.index
+				toVisitOffset++
+			}
+		} else {
+			if toVisitOffset == 0 {
+				break
+			}
+
+			toVisitOffset--
+			currentNodeIndex = nodesToVisit[toVisitOffset]
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/textures"
+)
+
+// BvhLayout selects how the nodes of a BVH are stored and traversed
+type BvhLayout int
+
+const (
+	BvhLayoutBinary BvhLayout = iota // Two children per node, with float64 bounds
+	BvhLayoutWide4                   // Four children per node, with float32 bounds tested together
+)
+
+// Bvh4Node is a node of a 4-wide BVH: the bounds of the children are stored as float32
+// in a structure of arrays, so that the whole node fits into two cache lines
+type Bvh4Node struct {
+	minX, minY, minZ [4]float32
+	maxX, maxY, maxZ [4]float32
+	child            [4]int32 // Index of the node if interior, or of the first object if leaf
+	count            [4]int32 // How many objects in the leaf, 0 for interior nodes and -1 for empty slots
+}
+
+// bvh4Entry is an element of the traversal stack, either a node or the objects of a leaf
+type bvh4Entry struct {
+	index int32
+	count int32
+	tnear float64 // Distance where the ray enters the node
+}
+
+// SetLayout selects the layout used to traverse the BVH, the 4-wide layout is built the first time it's needed
+func (bvh *Bvh) SetLayout(layout BvhLayout) {
+	if layout == BvhLayoutWide4 && bvh.wide == nil && len(bvh.nodes) > 0 {
+		bvh.buildWide4()
+	}
+
+	bvh.layout = layout
+}
+
+// SetBvhLayout selects the layout of the BVH of the group and of all groups inside it
+func (g *Group) SetBvhLayout(layout BvhLayout) {
+	if g.bvh != nil {
+		g.bvh.SetLayout(layout)
+	}
+
+	for _, s := range g.members {
+		switch t := s.(type) {
+		case *Group:
+			t.SetBvhLayout(layout)
+		case *Instance:
+			t.SetBvhLayout(layout)
+		}
+	}
+}
+
+// float32Down converts a value to float32, rounding down so that bounds stay conservative
+func float32Down(x float64) float32 {
+	f := float32(x)
+
+	if float64(f) > x {
+		f = math.Nextafter32(f, float32(math.Inf(-1)))
+	}
+
+	return f
+}
+
+// float32Up converts a value to float32, rounding up so that bounds stay conservative
+func float32Up(x float64) float32 {
+	f := float32(x)
+
+	if float64(f) < x {
+		f = math.Nextafter32(f, float32(math.Inf(+1)))
+	}
+
+	return f
+}
+
+// buildWide4 collapses the binary tree into a 4-wide tree: each wide node takes the place of a binary node
+// and its grandchildren, interior children with the largest surface area are opened first
+func (bvh *Bvh) buildWide4() {
+	wide := []Bvh4Node{}
+
+	var collapse func(int) int32
+
+	collapse = func(n int) int32 {
+		children := []int{n}
+
+		if bvh.nodes[n].objCount == 0 {
+			children = []int{n + 1, bvh.nodes[n].index}
+
+			for len(children) < 4 {
+				best := -1
+				bestArea := 0.0
+
+				for i, c := range children {
+					if bvh.nodes[c].objCount == 0 {
+						if area := bvh.nodes[c].bounds.SurfaceArea(); best < 0 || area > bestArea {
+							best = i
+							bestArea = area
+						}
+					}
+				}
+
+				if best < 0 {
+					break // Only leaves left
+				}
+
+				c := children[best]
+				children[best] = c + 1
+				children = append(children, bvh.nodes[c].index)
+			}
+		}
+
+		index := int32(len(wide))
+		wide = append(wide, Bvh4Node{})
+
+		node := Bvh4Node{}
+
+		for i := 0; i < 4; i++ {
+			if i >= len(children) {
+				node.count[i] = -1
+				continue
+			}
+
+			c := &bvh.nodes[children[i]]
+			b := c.bounds
+
+			node.minX[i], node.minY[i], node.minZ[i] = float32Down(b.Min.X), float32Down(b.Min.Y), float32Down(b.Min.Z)
+			node.maxX[i], node.maxY[i], node.maxZ[i] = float32Up(b.Max.X), float32Up(b.Max.Y), float32Up(b.Max.Z)
+
+			if c.objCount > 0 {
+				node.child[i] = int32(c.index)
+				node.count[i] = int32(c.objCount)
+			} else {
+				node.child[i] = collapse(children[i])
+			}
+		}
+
+		wide[index] = node // The slice may have grown while building the children
+
+		return index
+	}
+
+	collapse(0)
+
+	bvh.wide = wide
+}
+
+// addIntersectionsWide4 traverses the 4-wide tree: all children of a node are tested at once,
+// then they are visited from the nearest to the farthest
+func (bvh *Bvh) addIntersectionsWide4(ray, rayInObjectSpace Ray, xs *Intersections) {
+	ox, oy, oz := ray.Origin.X, ray.Origin.Y, ray.Origin.Z
+	ix, iy, iz := 1/ray.Direction.X, 1/ray.Direction.Y, 1/ray.Direction.Z
+
+	stack := [256]bvh4Entry{}
+	stack[0].tnear = math.Inf(-1)
+	sp := 1 // The root is at the bottom of the stack
+
+	for sp > 0 {
+		sp--
+		entry := stack[sp]
+
+		// Entries farther than the closest hit found so far can be skipped, if pruning is enabled
+		if entry.tnear > xs.PruneDistance() {
+			continue
+		}
+
+		if entry.count > 0 {
+			// Leaf: test all objects
+			for i := entry.index; i < entry.index+entry.count; i++ {
+				bvh.objects[i].AddIntersections(rayInObjectSpace, xs)
+			}
+
+			continue
+		}
+
+		node := &bvh.wide[entry.index]
+
+		var hit [4]int
+		var tnear [4]float64
+		hits := 0
+
+		for i := 0; i < 4; i++ {
+			if node.count[i] < 0 {
+				continue
+			}
+
+			tmin, tmax := slab(ox, ix, node.minX[i], node.maxX[i], math.Inf(-1), math.Inf(+1))
+			tmin, tmax = slab(oy, iy, node.minY[i], node.maxY[i], tmin, tmax)
+			tmin, tmax = slab(oz, iz, node.minZ[i], node.maxZ[i], tmin, tmax)
+
+			if tmin <= tmax {
+				// Insert sorted by distance
+				j := hits
+				for j > 0 && tnear[j-1] > tmin {
+					hit[j], tnear[j] = hit[j-1], tnear[j-1]
+					j--
+				}
+				hit[j], tnear[j] = i, tmin
+				hits++
+			}
+		}
+
+		// Push the farthest first, so that the nearest is visited next
+		for j := hits - 1; j >= 0; j-- {
+			i := hit[j]
+			stack[sp] = bvh4Entry{node.child[i], node.count[i], tnear[j]}
+			sp++
+		}
+	}
+}
+
+// slab clips the range [tmin,tmax] to the slab between min and max along one axis,
+// with the same handling of NaN values as Box.IntersectsInvDir
+func slab(origin, invdir float64, min, max float32, tmin, tmax float64) (float64, float64) {
+	t0 := (float64(min) - origin) * invdir
+	t1 := (float64(max) - origin) * invdir
+
+	if invdir < 0 {
+		t0, t1 = t1, t0
+	}
+
+	t1 *= slabErrorScale
+
+	if t0 > tmin {
+		tmin = t0
+	}
+	if t1 < tmax {
+		tmax = t1
+	}
+
+	return tmin, tmax
+}
+
+// Wide4Nodes returns the number of nodes of the 4-wide layout, zero if it has not been built
+func (bvh *Bvh) Wide4Nodes() int {
+	return len(bvh.wide)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BvhBuildParameters describes the parameters that affect the shape of a BVH,
+// a cached BVH can be reused only if they have not changed
+func BvhBuildParameters() string {
+	return fmt.Sprintf("sah buckets=%d leaf=%d cost=%g", BvhNumBuckets, BvhMaxObjectsPerNode, BvhBboxIntersectionCost)
+}
+
+// bvhNodeRecord is how a node is stored, with fixed size fields
+type bvhNodeRecord struct {
+	Bounds             Box
+	Index, Count, Axis int32
+	_                  int32
+}
+
+// Encode writes the nodes of the BVH as an array, the objects are not written and must be stored
+// separately in the same order as returned by Objects
+func (bvh *Bvh) Encode(w *BinaryWriter) {
+	w.Uint32(uint32(len(bvh.objects)))
+	w.Uint32(uint32(len(bvh.unbounded)))
+
+	records := make([]bvhNodeRecord, len(bvh.nodes))
+	for i, n := range bvh.nodes {
+		records[i] = bvhNodeRecord{Bounds: n.bounds, Index: int32(n.index), Count: int32(n.objCount), Axis: int32(n.axis)}
+	}
+
+	WriteArray(w, records)
+}
+
+// DecodeBvh reads the nodes written by Encode, objects must be in the same order they had when the BVH was encoded
+func DecodeBvh(r *BinaryReader, objects []Groupable) (*Bvh, error) {
+	bounded := int(r.Uint32())
+	unbounded := int(r.Uint32())
+	records := ReadArray[bvhNodeRecord](r)
+
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+
+	if bounded+unbounded != len(objects) {
+		return nil, errors.New("BVH does not match its objects")
+	}
+
+	bvh := &Bvh{
+		objects:   objects[:bounded:bounded],
+		unbounded: objects[bounded:],
+		nodes:     make([]BvhLinearNode, len(records)),
+	}
+
+	for i, rec := range records {
+		n := &bvh.nodes[i]
+
+		n.bounds = rec.Bounds
+		n.index = int(rec.Index)
+		n.objCount = int(rec.Count)
+		n.axis = int(rec.Axis)
+
+		// Check indices, so that a corrupted file cannot crash the renderer later
+		if n.objCount > 0 && (n.index < 0 || n.index+n.objCount > bounded) || n.objCount == 0 && (n.index <= i || n.index >= len(records)) {
+			return nil, errors.New("BVH node is corrupted")
+		}
+	}
+
+	return bvh, nil
+}
+
+// SetBvh sets a BVH built in advance, like a BVH read from a cache, its objects become the members of the group
+func (g *Group) SetBvh(bvh *Bvh) {
+	g.bvh = bvh
+	g.members = bvh.Objects()
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// CompactBvhNode is a node of a BVH with float32 bounds, used by very large models where memory matters:
+// leaves reference ranges of primitives by index, so that primitives don't need to be objects
+type CompactBvhNode struct {
+	Min, Max [3]float32
+	Index    uint32 // Index of the first primitive if leaf, index of the second child if interior
+	Count    uint32 // How many primitives in the leaf, zero for interior nodes
+}
+
+// NewCompactBvh builds a BVH over count primitives, bounds returns the bounds of each of them: it returns the nodes
+// and the order of the primitives, leaves refer to the primitives as if they were sorted in that order
+func NewCompactBvh(count int, bounds func(i int) Box) ([]CompactBvhNode, []int) {
+	objInfo := make([]BvhObjectInfo, count)
+
+	for i := range objInfo {
+		b := bounds(i)
+		objInfo[i] = BvhObjectInfo{i, b, Point((b.Min.X+b.Max.X)/2, (b.Min.Y+b.Max.Y)/2, (b.Min.Z+b.Max.Z)/2)}
+	}
+
+	if len(objInfo) == 0 {
+		return nil, nil
+	}
+
+	nodes := buildBvhNodes(objInfo)
+
+	order := make([]int, len(objInfo))
+	for i, info := range objInfo {
+		order[i] = info.idx
+	}
+
+	compact := make([]CompactBvhNode, len(nodes))
+
+	for i, n := range nodes {
+		c := &compact[i]
+
+		c.Min = [3]float32{float32Down(n.bounds.Min.X), float32Down(n.bounds.Min.Y), float32Down(n.bounds.Min.Z)}
+		c.Max = [3]float32{float32Up(n.bounds.Max.X), float32Up(n.bounds.Max.Y), float32Up(n.bounds.Max.Z)}
+		c.Index = uint32(n.index)
+		c.Count = uint32(n.objCount)
+	}
+
+	return compact, order
+}
+
+// IntersectsInvDir checks if a ray hits the node, the ray direction must have been inverted
+func (n *CompactBvhNode) IntersectsInvDir(ray Ray) bool {
+	return n.IntersectsInvDirRange(ray, math.Inf(-1), math.Inf(+1))
+}
+
+// IntersectsInvDirRange checks if a ray hits the node between distances tmin and tmax, the ray direction must have been inverted
+func (n *CompactBvhNode) IntersectsInvDirRange(ray Ray, tmin, tmax float64) bool {
+	tmin, tmax = slab(ray.Origin.X, ray.Direction.X, n.Min[0], n.Max[0], tmin, tmax)
+	tmin, tmax = slab(ray.Origin.Y, ray.Direction.Y, n.Min[1], n.Max[1], tmin, tmax)
+	tmin, tmax = slab(ray.Origin.Z, ray.Direction.Z, n.Min[2], n.Max[2], tmin, tmax)
+
+	return tmin <= tmax
+}
@@ -83,6 +83,7 @@ func (g *Csg) Clone() Groupable {
 
 	o.SetName("csgfrom_" + g.Name())
 	o.SetTransform(g.Transform())
+	o.SetVisibility(g.Visibility())
 
 	return o
 }
@@ -109,8 +110,16 @@ func opTestIntersection(lhit, inL, inR bool) bool {
 }
 
 func (g *Csg) AddIntersections(ray Ray, xs *Intersections) {
+	if g.HiddenFrom(xs) {
+		return
+	}
+
 	ray = ray.Transform(g.Tinverse)
 
+	// All intersections are needed to know if the ray is inside the shapes
+	prune := xs.Prune
+	xs.Prune = false
+
 	sIdx := xs.Len()
 
 	// Add intersections for the left shape
@@ -128,6 +137,8 @@ func (g *Csg) AddIntersections(ray Ray, xs *Intersections) {
 		xs.DataAt(i).Lhit = false
 	}
 
+	xs.Prune = prune
+
 	// Sort our intersections
 	xs.SortRange(sIdx)
 
@@ -160,6 +171,25 @@ func (g *Csg) AddIntersections(ray Ray, xs *Intersections) {
 	xs.UpdateHit()
 }
 
+// Occludes needs all intersections of the shapes anyway, then removes them from the list
+func (g *Csg) Occludes(ray Ray, xs *Intersections) bool {
+	start := xs.Len()
+
+	g.AddIntersections(ray, xs)
+
+	found := false
+	for _, x := range xs.L[start:] {
+		if ray.InExtent(x.T) {
+			found = true
+			break
+		}
+	}
+
+	xs.Truncate(start)
+
+	return found
+}
+
 func (g *Csg) SetMaterial(m *Material) {
 	m = m.ProxifyPatterns(g)
 
@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// Disk is a flat disk on the x and z axis (i.e. y=0) centered in the origin,
+// it's an annulus (a disk with a hole) if InnerRadius is greater than zero
+type Disk struct {
+	InnerRadius float64
+	OuterRadius float64
+}
+
+// NewDisk returns a Shape based on a disk with radius=1
+func NewDisk() *Shape {
+	return NewAnnulus(0, 1)
+}
+
+func NewAnnulus(inner, outer float64) *Shape {
+	return NewShape("disk", &Disk{inner, outer})
+}
+
+func (p *Disk) Bounds() Box {
+	r := p.OuterRadius
+
+	return Box{Point(-r, 0, -r), Point(+r, 0, +r)}
+}
+
+func (p *Disk) LocalIntersect(ray Ray) []float64 {
+	// Same as the plane, then check that the hit is within the radii
+	if ray.Direction.Y <= -Epsilon || ray.Direction.Y >= Epsilon {
+		t := -ray.Origin.Y / ray.Direction.Y
+
+		x := ray.Origin.X + t*ray.Direction.X
+		z := ray.Origin.Z + t*ray.Direction.Z
+		d := x*x + z*z
+
+		if d <= Square(p.OuterRadius) && d >= Square(p.InnerRadius) {
+			return []float64{t}
+		}
+	}
+
+	return nil
+}
+
+func (p *Disk) LocalNormalAt(point Tuple) Tuple {
+	return Vector(0, 1, 0)
+}
+
+func (p *Disk) NormalAtHit(point Tuple, ii *IntersectionInfo) Tuple {
+	// u goes around the y axis, v from the outer edge to the inner edge
+	r := math.Sqrt(point.X*point.X + point.Z*point.Z)
+
+	ii.U = (math.Atan2(point.Z, point.X) + Pi) / (2 * Pi)
+	ii.V = (p.OuterRadius - r) / (p.OuterRadius - p.InnerRadius)
+
+	return p.LocalNormalAt(point)
+}
@@ -19,8 +19,11 @@ type Groupable interface {
 	Namable
 	Transformable
 	AddIntersections(Ray, *Intersections)
+	Occludes(Ray, *Intersections) bool // Returns true as soon as any intersection is found within the extent of the ray
 	SetMaterial(*Material)
 	SetParent(Container)
+	Visibility() Visibility
+	SetVisibility(Visibility)
 	Bounds() Box
 	Clone() Groupable
 }
@@ -28,14 +31,15 @@ type Groupable interface {
 type Grouper struct {
 	Transformer
 	parent Container
+	hidden Visibility // Kinds of rays the object is hidden from, so that the zero value means visible to all
 }
 
 type Group struct {
 	Namer
 	Grouper
-	members  []Groupable
-	bbox     Box // Bounding box
-	bvhNodes []BvhLinearNode
+	members []Groupable
+	bbox    Box // Bounding box
+	bvh     *Bvh
 }
 
 func (g *Grouper) Parent() Container {
@@ -46,6 +50,19 @@ func (g *Grouper) SetParent(p Container) {
 	g.parent = p
 }
 
+func (g *Grouper) Visibility() Visibility {
+	return VisibleToAll &^ g.hidden
+}
+
+func (g *Grouper) SetVisibility(v Visibility) {
+	g.hidden = VisibleToAll &^ v
+}
+
+// HiddenFrom returns true if the object must be skipped by the kind of rays the intersection list is collecting
+func (g *Grouper) HiddenFrom(xs *Intersections) bool {
+	return xs.Visibility&g.hidden != 0
+}
+
 func (g *Grouper) WorldToObject(point Tuple) Tuple {
 	if g.parent != nil {
 		point = g.parent.WorldToObject(point)
@@ -82,6 +99,7 @@ func (g *Group) Clone() Groupable {
 
 	o.SetName("groupfrom_" + g.Name())
 	o.SetTransform(g.Transform())
+	o.SetVisibility(g.Visibility())
 
 	for _, s := range g.members {
 		o.Add(s.Clone())
@@ -119,7 +137,11 @@ func (g *Group) LocalIntersect(ray Ray) *Intersections { // Used only for testin
 }
 
 func (g *Group) AddIntersections(ray Ray, xs *Intersections) {
-	if len(g.bvhNodes) > 0 {
+	if g.HiddenFrom(xs) {
+		return
+	}
+
+	if g.bvh != nil {
 		// Intersect using the BVH
 		g.AddIntersectionsBvh(ray, xs)
 	} else {
@@ -138,6 +160,30 @@ func (g *Group) AddIntersections(ray Ray, xs *Intersections) {
 	}
 }
 
+func (g *Group) Occludes(ray Ray, xs *Intersections) bool {
+	if g.HiddenFrom(xs) {
+		return false
+	}
+
+	if g.bvh != nil {
+		return g.bvh.Occludes(ray, ray.Transform(g.Tinverse), xs)
+	}
+
+	ray = ray.Transform(g.Tinverse)
+
+	if !g.bbox.Intersects(ray) {
+		return false
+	}
+
+	for _, s := range g.members {
+		if s.Occludes(ray, xs) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (g *Group) Bounds() Box {
 	return g.bbox
 }
@@ -153,6 +199,11 @@ func (g *Group) BoundingBox() *Shape {
 	return bb
 }
 
+// Len returns the number of members of the group
+func (g *Group) Len() int {
+	return len(g.members)
+}
+
 func (g *Group) Members(index int) Groupable {
 	return g.members[index]
 }
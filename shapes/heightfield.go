@@ -0,0 +1,304 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// Heightfield is a terrain defined by a grid of W x H heights between 0 and 1, which spans x and z from -1 to +1:
+// the first row of the grid is at z=+1 (far from a default camera, as in a map), the last at z=-1.
+// Each cell of the grid is split into two triangles, with normals interpolated for a smooth look
+type Heightfield struct {
+	W, H    int
+	Heights []float64
+	normals []Tuple
+	cells   []heightRange // Range of heights of each cell, to quickly skip cells the ray passes over or under
+	bounds  Box
+}
+
+type heightRange struct {
+	min, max float64
+}
+
+// NewHeightfield returns a Shape based on a heightfield, heights are stored by rows.
+// It returns an error if the heights are not valid, see SetHeights
+func NewHeightfield(w, h int, heights []float64) (*Shape, error) {
+	hf := &Heightfield{}
+
+	if err := hf.SetHeights(w, h, heights); err != nil {
+		return nil, err
+	}
+
+	return NewShape("heightfield", hf), nil
+}
+
+// HeightsFromImage converts an image into heights, from black (0) to white (1)
+func HeightsFromImage(img image.Image) (w, h int, heights []float64) {
+	b := img.Bounds()
+	w, h = b.Dx(), b.Dy()
+	heights = make([]float64, w*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gray := color.Gray16Model.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray16)
+			heights[x+y*w] = float64(gray.Y) / 0xFFFF
+		}
+	}
+
+	return
+}
+
+// LoadHeightsFromImage reads heights from a grayscale image file, see HeightsFromImage
+func LoadHeightsFromImage(filename string) (w, h int, heights []float64, err error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+
+	if err != nil {
+		return
+	}
+
+	w, h, heights = HeightsFromImage(img)
+
+	return
+}
+
+// HeightsFromNoise returns w x h heights from a few octaves of Perlin noise, with the base frequency specified
+// as the number of noise cells across the grid: heights are stretched to go from 0 to 1. It returns nil if w or h are not positive
+func HeightsFromNoise(w, h int, frequency float64) []float64 {
+	if w <= 0 || h <= 0 {
+		return nil
+	}
+
+	noise := NewPerlinNoise()
+	heights := make([]float64, w*h)
+
+	min, max := math.Inf(+1), math.Inf(-1)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			u, v := float64(x)/float64(w)*frequency, float64(y)/float64(h)*frequency
+			f := 0.0
+
+			for octave, amplitude := 0.0, 1.0; octave < 5; octave, amplitude = octave+1, amplitude/2 {
+				scale := math.Pow(2, octave)
+				f += noise.At(u*scale, v*scale, 0.5+octave) * amplitude
+			}
+
+			heights[x+y*w] = f
+			min, max = math.Min(min, f), math.Max(max, f)
+		}
+	}
+
+	for i, f := range heights {
+		if max > min {
+			heights[i] = (f - min) / (max - min)
+		} else {
+			heights[i] = 0
+		}
+	}
+
+	return heights
+}
+
+// SetHeights changes the heights of the heightfield, there must be w x h of them and at least 2 x 2.
+// If they are not valid, the heightfield is not changed
+func (hf *Heightfield) SetHeights(w, h int, heights []float64) error {
+	if w < 2 || h < 2 {
+		return errors.New("heightfield needs at least 2x2 heights")
+	}
+
+	if len(heights) != w*h {
+		return fmt.Errorf("heightfield of %dx%d needs %d heights, not %d", w, h, w*h, len(heights))
+	}
+
+	hf.W, hf.H, hf.Heights = w, h, heights
+	hf.normals = make([]Tuple, w*h)
+	hf.cells = make([]heightRange, (w-1)*(h-1))
+
+	// Normals from the slope of the heights along x and z, the y axis goes against the rows
+	dx, dz := 2/float64(w-1), 2/float64(h-1)
+
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			i0, i1 := maxInt(i-1, 0), minInt(i+1, w-1)
+			j0, j1 := maxInt(j-1, 0), minInt(j+1, h-1)
+
+			sx := (hf.height(i1, j) - hf.height(i0, j)) / (float64(i1-i0) * dx)
+			sz := (hf.height(i, j0) - hf.height(i, j1)) / (float64(j1-j0) * dz)
+
+			hf.normals[i+j*w] = Vector(-sx, 1, -sz).Normalize()
+		}
+	}
+
+	min, max := math.Inf(+1), math.Inf(-1)
+
+	for j := 0; j < h-1; j++ {
+		for i := 0; i < w-1; i++ {
+			r := heightRange{
+				Min3(hf.height(i, j), hf.height(i+1, j), math.Min(hf.height(i, j+1), hf.height(i+1, j+1))),
+				Max3(hf.height(i, j), hf.height(i+1, j), math.Max(hf.height(i, j+1), hf.height(i+1, j+1))),
+			}
+
+			hf.cells[i+j*(w-1)] = r
+			min, max = math.Min(min, r.min), math.Max(max, r.max)
+		}
+	}
+
+	hf.bounds = Box{Point(-1, min, -1), Point(+1, max, +1)}
+
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func (hf *Heightfield) height(i, j int) float64 {
+	return hf.Heights[i+j*hf.W]
+}
+
+// vertex returns the point of the grid at column i and row j
+func (hf *Heightfield) vertex(i, j int) Tuple {
+	return Point(-1+2*float64(i)/float64(hf.W-1), hf.height(i, j), 1-2*float64(j)/float64(hf.H-1))
+}
+
+func (hf *Heightfield) Bounds() Box {
+	return hf.bounds
+}
+
+// LocalIntersect walks the cells of the grid crossed by the ray and checks their triangles,
+// see John Amanatides, Andrew Woo "A Fast Voxel Traversal Algorithm for Ray Tracing" (1987)
+func (hf *Heightfield) LocalIntersect(ray Ray) (xs []float64) {
+	if len(hf.cells) == 0 {
+		return nil
+	}
+
+	invdir := Vector(1/ray.Direction.X, 1/ray.Direction.Y, 1/ray.Direction.Z)
+	t0, t1 := hf.bounds.rangeInvDir(Ray{Origin: ray.Origin, Direction: invdir})
+
+	if t0 > t1 || math.IsInf(t0, 0) || math.IsInf(t1, 0) {
+		return nil
+	}
+
+	nx, nz := hf.W-1, hf.H-1
+	dx, dz := 2/float64(nx), 2/float64(nz)
+
+	// Cell where the ray enters the bounds
+	p := ray.Position(t0)
+	i := minInt(maxInt(int(math.Floor((p.X+1)/dx)), 0), nx-1)
+	j := minInt(maxInt(int(math.Floor((1-p.Z)/dz)), 0), nz-1)
+
+	// Distances along the ray to the next column and row, and between columns and rows
+	stepI, stepJ := 0, 0
+	nextI, nextJ := math.Inf(+1), math.Inf(+1)
+	deltaI, deltaJ := math.Inf(+1), math.Inf(+1)
+
+	if ray.Direction.X > 0 {
+		stepI, nextI, deltaI = 1, (-1+float64(i+1)*dx-ray.Origin.X)*invdir.X, dx*invdir.X
+	} else if ray.Direction.X < 0 {
+		stepI, nextI, deltaI = -1, (-1+float64(i)*dx-ray.Origin.X)*invdir.X, -dx*invdir.X
+	}
+
+	// Rows go against the z axis
+	if ray.Direction.Z < 0 {
+		stepJ, nextJ, deltaJ = 1, (1-float64(j+1)*dz-ray.Origin.Z)*invdir.Z, -dz*invdir.Z
+	} else if ray.Direction.Z > 0 {
+		stepJ, nextJ, deltaJ = -1, (1-float64(j)*dz-ray.Origin.Z)*invdir.Z, dz*invdir.Z
+	}
+
+	for t := t0; t <= t1; {
+		exit := math.Min(math.Min(nextI, nextJ), t1)
+
+		// Check the triangles only if the ray goes thru the heights of the cell
+		y0 := ray.Origin.Y + t*ray.Direction.Y
+		y1 := ray.Origin.Y + exit*ray.Direction.Y
+		r := hf.cells[i+j*nx]
+
+		if math.Max(y0, y1) >= r.min-Epsilon && math.Min(y0, y1) <= r.max+Epsilon {
+			p00, p10 := hf.vertex(i, j), hf.vertex(i+1, j)
+			p01, p11 := hf.vertex(i, j+1), hf.vertex(i+1, j+1)
+
+			if h, _, _, ok := IntersectTriangle(ray, p00, p10, p11); ok {
+				xs = append(xs, h)
+			}
+
+			if h, _, _, ok := IntersectTriangle(ray, p00, p11, p01); ok {
+				xs = append(xs, h)
+			}
+		}
+
+		// Move to the next cell
+		if nextI < nextJ {
+			i += stepI
+			t, nextI = nextI, nextI+deltaI
+		} else {
+			j += stepJ
+			t, nextJ = nextJ, nextJ+deltaJ
+		}
+
+		if i < 0 || i >= nx || j < 0 || j >= nz || math.IsInf(t, 0) {
+			break
+		}
+	}
+
+	return xs
+}
+
+func (hf *Heightfield) LocalNormalAt(point Tuple) Tuple {
+	nx, nz := hf.W-1, hf.H-1
+
+	// Position in the grid
+	fi := Clamp((point.X+1)/2) * float64(nx)
+	fj := Clamp((1-point.Z)/2) * float64(nz)
+	i := minInt(int(fi), nx-1)
+	j := minInt(int(fj), nz-1)
+	fx, fz := fi-float64(i), fj-float64(j)
+
+	n00, n10 := hf.normals[i+j*hf.W], hf.normals[i+1+j*hf.W]
+	n01, n11 := hf.normals[i+(j+1)*hf.W], hf.normals[i+1+(j+1)*hf.W]
+
+	// Interpolate the normals of the triangle that contains the point
+	if fx >= fz {
+		return n00.Mul(1 - fx).Add(n10.Mul(fx - fz)).Add(n11.Mul(fz))
+	}
+
+	return n00.Mul(1 - fz).Add(n11.Mul(fx)).Add(n01.Mul(fz - fx))
+}
+
+func (hf *Heightfield) NormalAtHit(point Tuple, ii *IntersectionInfo) Tuple {
+	// Same orientation as the heights, so that an image can be applied as a texture
+	ii.U = (point.X + 1) / 2
+	ii.V = (1 - point.Z) / 2
+
+	return hf.LocalNormalAt(point)
+}
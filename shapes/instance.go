@@ -0,0 +1,153 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+	. "ascottix/funtracer/traits"
+)
+
+// Instance places some shared geometry into the scene with its own transform and optionally its own material:
+// the geometry, e.g. a mesh with its BVH, is stored only once regardless of how many instances use it.
+// The geometry must not be part of the scene itself, as its transform is relative to the instance
+type Instance struct {
+	Namer
+	Grouper
+	geometry Groupable
+	material *Material // If not nil, overrides the materials of the geometry
+}
+
+// instanceHit is an object hit inside an instance, seen from the world
+type instanceHit struct {
+	Hittable
+	instance *Instance
+}
+
+func NewInstance(geometry Groupable) *Instance {
+	in := &Instance{geometry: geometry}
+
+	in.SetNameForKind("instance")
+	in.SetTransform()
+
+	return in
+}
+
+// Geometry returns the geometry shared by the instance
+func (in *Instance) Geometry() Groupable {
+	return in.geometry
+}
+
+func (in *Instance) Clone() Groupable {
+	o := NewInstance(in.geometry)
+
+	o.SetName("instancefrom_" + in.Name())
+	o.SetTransform(in.Transform())
+	o.SetVisibility(in.Visibility())
+	o.material = in.material
+
+	return o
+}
+
+func (in *Instance) Bounds() Box {
+	return in.geometry.Bounds().Transform(in.geometry.Transform())
+}
+
+// Material returns the material that overrides the materials of the geometry, nil if none
+func (in *Instance) Material() *Material {
+	return in.material
+}
+
+// SetMaterial overrides the materials of the geometry, without changing the geometry itself
+func (in *Instance) SetMaterial(m *Material) {
+	in.material = m
+}
+
+func (in *Instance) AddIntersections(ray Ray, xs *Intersections) {
+	if in.HiddenFrom(xs) {
+		return
+	}
+
+	start := xs.Len()
+
+	in.geometry.AddIntersections(ray.Transform(in.Tinverse), xs)
+
+	for i := start; i < xs.Len(); i++ {
+		o := xs.L[i].O
+
+		if in.material != nil {
+			o = in
+		}
+
+		xs.Wrap(i, o, in)
+	}
+}
+
+func (in *Instance) Occludes(ray Ray, xs *Intersections) bool {
+	if in.HiddenFrom(xs) {
+		return false
+	}
+
+	return in.geometry.Occludes(ray.Transform(in.Tinverse), xs)
+}
+
+// NormalAtHit computes the normal of the object that was hit inside the instance, in the space of the geometry
+func (in *Instance) NormalAtHit(ii *IntersectionInfo, xs *Intersections) Tuple {
+	outer := ii.Intersection
+	point := ii.Point
+	d := xs.Data(&outer)
+
+	ii.Intersection = Intersection{T: outer.T, O: d.Object, D: d.Next}
+	ii.Point = in.WorldToObject(point)
+
+	normal := xs.Intersectable(&ii.Intersection).NormalAtHit(ii, xs)
+
+	ii.Point = point
+
+	if ii.HasSurfNormalv {
+		ii.SurfNormalv = in.NormalToWorld(ii.SurfNormalv)
+	}
+
+	// The object that was hit is replaced by one that maps world points into its space,
+	// or by the instance itself if it has a material of its own
+	var o Hittable = in
+
+	if in.material == nil {
+		o = &instanceHit{Hittable: ii.O, instance: in}
+	}
+
+	ii.Intersection = Intersection{T: outer.T, O: o, D: outer.D}
+
+	return in.NormalToWorld(normal)
+}
+
+// SetBvhLayout selects the layout of the BVH of the geometry, if it's a group:
+// as geometry is shared by many instances, it's skipped if already done
+func (in *Instance) SetBvhLayout(layout BvhLayout) {
+	if g, ok := in.geometry.(*Group); ok {
+		if g.bvh != nil && g.bvh.layout == layout {
+			return
+		}
+
+		g.SetBvhLayout(layout)
+	}
+}
+
+func (h *instanceHit) WorldToObject(point Tuple) Tuple {
+	return h.Hittable.WorldToObject(h.instance.WorldToObject(point))
+}
+
+// Name and Parent let light links find the object as well as the instance
+func (h *instanceHit) Name() string {
+	if n, ok := h.Hittable.(Namable); ok {
+		return n.Name()
+	}
+
+	return ""
+}
+
+func (h *instanceHit) Parent() Container {
+	return h.instance
+}
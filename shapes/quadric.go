@@ -0,0 +1,123 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// Quadric is a general second degree surface, made of the points p = (x, y, z, 1) where pᵀ Q p = 0
+// for a symmetric 4x4 matrix Q: only the part of the surface inside the clip box is kept,
+// so e.g. paraboloids and hyperboloids are open at the ends like uncapped cylinders
+type Quadric struct {
+	Q    Matrix
+	Clip Box
+}
+
+// NewQuadric returns a Shape based on a quadric with coefficient matrix q, clipped to a box (which may be infinite)
+func NewQuadric(q Matrix, clip Box) *Shape {
+	return NewShape("quadric", &Quadric{q, clip})
+}
+
+// QuadricMatrix returns the coefficient matrix of the quadric a x² + b y² + c z² + d xy + e xz + f yz + g x + h y + i z + j = 0
+func QuadricMatrix(a, b, c, d, e, f, g, h, i, j float64) Matrix {
+	return NewMatrix(4, 4,
+		a, d/2, e/2, g/2,
+		d/2, b, f/2, h/2,
+		e/2, f/2, c, i/2,
+		g/2, h/2, i/2, j)
+}
+
+// NewParaboloid returns a Shape based on the paraboloid y = x² + z², between miny and maxy
+func NewParaboloid(miny, maxy float64) *Shape {
+	r := math.Sqrt(math.Max(0, maxy))
+
+	return NewShape("paraboloid", &Quadric{
+		QuadricMatrix(1, 0, 1, 0, 0, 0, 0, -1, 0, 0),
+		Box{Point(-r, miny, -r), Point(+r, maxy, +r)},
+	})
+}
+
+// NewHyperboloid returns a Shape based on the hyperboloid x² + z² - y² = k, between miny and maxy:
+// it has one sheet if k > 0 (with radius sqrt(k) at y = 0), two sheets if k < 0 and it's a cone if k = 0
+func NewHyperboloid(miny, maxy, k float64) *Shape {
+	r := math.Sqrt(math.Max(0, k+math.Max(miny*miny, maxy*maxy)))
+
+	return NewShape("hyperboloid", &Quadric{
+		QuadricMatrix(1, -1, 1, 0, 0, 0, 0, 0, 0, -k),
+		Box{Point(-r, miny, -r), Point(+r, maxy, +r)},
+	})
+}
+
+func (p *Quadric) Bounds() Box {
+	return p.Clip
+}
+
+// form returns aᵀ Q b
+func (p *Quadric) form(a, b Tuple) float64 {
+	qb := [4]float64{}
+
+	for row := 0; row < 4; row++ {
+		qb[row] = p.Q.At(row, 0)*b.X + p.Q.At(row, 1)*b.Y + p.Q.At(row, 2)*b.Z + p.Q.At(row, 3)*b.W
+	}
+
+	return a.X*qb[0] + a.Y*qb[1] + a.Z*qb[2] + a.W*qb[3]
+}
+
+func (p *Quadric) LocalIntersect(ray Ray) (xs []float64) {
+	// Substitute the ray o + t*d into the equation, which becomes a quadratic in t
+	a := p.form(ray.Direction, ray.Direction)
+	b := 2 * p.form(ray.Direction, ray.Origin)
+	c := p.form(ray.Origin, ray.Origin)
+
+	for _, t := range SolveQuadratic(a, b, c) {
+		if point := ray.Position(t); p.inside(point) {
+			xs = append(xs, t)
+		}
+	}
+
+	return
+}
+
+// inside checks if a point is within the clip box
+func (p *Quadric) inside(point Tuple) bool {
+	min, max := p.Clip.Min, p.Clip.Max
+
+	return min.X-Epsilon <= point.X && point.X <= max.X+Epsilon &&
+		min.Y-Epsilon <= point.Y && point.Y <= max.Y+Epsilon &&
+		min.Z-Epsilon <= point.Z && point.Z <= max.Z+Epsilon
+}
+
+func (p *Quadric) LocalNormalAt(point Tuple) Tuple {
+	// The normal is the gradient of pᵀ Q p, i.e. 2 Q p (the factor 2 is irrelevant)
+	n := Vector(0, 0, 0)
+
+	n.X = p.Q.At(0, 0)*point.X + p.Q.At(0, 1)*point.Y + p.Q.At(0, 2)*point.Z + p.Q.At(0, 3)
+	n.Y = p.Q.At(1, 0)*point.X + p.Q.At(1, 1)*point.Y + p.Q.At(1, 2)*point.Z + p.Q.At(1, 3)
+	n.Z = p.Q.At(2, 0)*point.X + p.Q.At(2, 1)*point.Y + p.Q.At(2, 2)*point.Z + p.Q.At(2, 3)
+
+	// At singular points, like the apex of a cone, the gradient vanishes and no normal is better than another:
+	// use the y axis, which is the axis of paraboloids and hyperboloids
+	if n.DotProduct(n) < Epsilon*Epsilon {
+		return Vector(0, 1, 0)
+	}
+
+	return n
+}
+
+func (p *Quadric) NormalAtHit(point Tuple, ii *IntersectionInfo) Tuple {
+	// u goes around the y axis, v along the y axis from the bottom of the clip box if finite
+	ii.U = (math.Atan2(point.Z, point.X) + Pi) / (2 * Pi)
+	ii.V = point.Y
+
+	if miny, maxy := p.Clip.Min.Y, p.Clip.Max.Y; !math.IsInf(miny, 0) && !math.IsInf(maxy, 0) && maxy > miny {
+		ii.V = (point.Y - miny) / (maxy - miny)
+	}
+
+	return p.LocalNormalAt(point)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// SdfShape is a shape defined by a signed distance function, intersected by sphere tracing:
+// see John C. Hart "Sphere Tracing: A Geometric Method for the Antialiased Ray Tracing of Implicit Surfaces" (1996)
+type SdfShape struct {
+	Distance    Sdf
+	Box         Box     // Surface is clipped by the box, which may be infinite on some axes (e.g. for repeated shapes)
+	Lipschitz   float64 // How much the function may overestimate the distance, e.g. it's more than 1 for twisted shapes
+	Precision   float64 // Minimum step along a ray and accuracy of the hits
+	MaxSteps    int     // Maximum number of steps along a ray
+	MaxDistance float64 // Maximum distance along a ray, if the box does not limit it
+	FirstHit    bool    // Find only the first hit ahead of the ray origin, see below
+}
+
+// With FirstHit, a hit is simply a point closer than Precision to the surface, as in classic sphere tracing:
+// it is faster and works with distance estimators that are not signed (e.g. fractals),
+// but the shape can't be used in CSG or refractions as the ray does not go thru it
+
+// NewSdfShape returns a Shape based on a signed distance function, which is inside the specified bounds:
+// the other parameters of the SdfShape get default values, they can be changed thru Shape.Shapable()
+func NewSdfShape(distance Sdf, bounds Box) *Shape {
+	return NewShape("sdf", &SdfShape{
+		Distance:    distance,
+		Box:         bounds,
+		Lipschitz:   1,
+		Precision:   1e-5,
+		MaxSteps:    5000,
+		MaxDistance: 1000,
+	})
+}
+
+func (p *SdfShape) Bounds() Box {
+	return p.Box
+}
+
+// LocalIntersect marches along the ray inside the bounds and returns all the points where it crosses the surface,
+// so that shapes can be used in CSG and refractions. Each step is as long as the distance from the surface,
+// which can't be crossed this way: when the ray gets close enough, it's crossed by a small step and the exact
+// point is found by bisection
+func (p *SdfShape) LocalIntersect(ray Ray) (xs []float64) {
+	// March in units of distance, converted back at the end
+	length := ray.Direction.Length()
+	dir := ray.Direction.Mul(1 / length)
+
+	t0, t1 := p.Box.rangeInvDir(Ray{Origin: ray.Origin, Direction: Vector(1/dir.X, 1/dir.Y, 1/dir.Z)})
+
+	if t0 > t1 {
+		return nil
+	}
+
+	// The surface is clipped by the box: if the ray enters or leaves it inside the surface, it's a crossing too,
+	// but if the box does not limit the ray, look only ahead of the origin and not too far
+	clipStart, clipEnd := true, true
+
+	if math.IsInf(t0, -1) {
+		t0, clipStart = 0, false
+	}
+
+	if t1 > t0+p.MaxDistance {
+		t1, clipEnd = t0+p.MaxDistance, false
+	}
+
+	distance := func(t float64) float64 {
+		return p.Distance(ray.Origin.Add(dir.Mul(t)))
+	}
+
+	if p.FirstHit && t0 < 0 {
+		t0, clipStart = 0, false
+	}
+
+	t := t0
+	d := distance(t)
+
+	if d < 0 && clipStart {
+		xs = append(xs, t0/length)
+	}
+
+	// A ray that starts on the surface, e.g. a shadow ray, must leave it before looking for a hit
+	leaving := t == 0 && d < p.Precision
+
+	for step := 0; step < p.MaxSteps && t < t1; step++ {
+		if p.FirstHit {
+			if d >= p.Precision {
+				leaving = false
+			} else if !leaving {
+				return []float64{t / length}
+			}
+		}
+
+		next := math.Min(t+math.Max(math.Abs(d)/p.Lipschitz, p.Precision), t1)
+		dnext := distance(next)
+
+		if (d < 0) != (dnext < 0) {
+			// Surface crossed: find it by bisection
+			a, b := t, next
+
+			for i := 0; i < 30 && b-a > p.Precision*1e-3; i++ {
+				m := (a + b) / 2
+
+				if (distance(m) < 0) == (d < 0) {
+					a = m
+				} else {
+					b = m
+				}
+			}
+
+			xs = append(xs, (a+b)/2/length)
+		}
+
+		t, d = next, dnext
+	}
+
+	if d < 0 && t == t1 && clipEnd {
+		xs = append(xs, t1/length)
+	}
+
+	return xs
+}
+
+func (p *SdfShape) LocalNormalAt(point Tuple) Tuple {
+	// Gradient of the distance, estimated with the tetrahedron technique by Inigo Quilez
+	// (see https://iquilezles.org/articles/normalsSDF/)
+	h := p.Precision
+
+	k1 := p.Distance(Point(point.X+h, point.Y-h, point.Z-h))
+	k2 := p.Distance(Point(point.X-h, point.Y-h, point.Z+h))
+	k3 := p.Distance(Point(point.X-h, point.Y+h, point.Z-h))
+	k4 := p.Distance(Point(point.X+h, point.Y+h, point.Z+h))
+
+	return Vector(k1-k2-k3+k4, -k1-k2+k3+k4, -k1+k2-k3+k4).Normalize()
+}
+
+func (p *SdfShape) NormalAtHit(point Tuple, ii *IntersectionInfo) Tuple {
+	// Spherical mapping around the origin, as for the sphere
+	if r := point.Length(); r > 0 {
+		ii.U = (math.Atan2(point.Z, point.X) + Pi) / (2 * Pi)
+		ii.V = math.Acos(math.Max(-1, math.Min(1, point.Y/r))) / Pi
+	}
+
+	return p.LocalNormalAt(point)
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+)
+
+// Sdf is a signed distance function: it returns the distance of a point from a surface,
+// negative if the point is inside. It may underestimate the distance but not overestimate it,
+// or sphere tracing could go thru the surface (see SdfShape.Lipschitz for functions that do).
+// Many of the functions and operators below come from the articles of Inigo Quilez,
+// see https://iquilezles.org/articles/distfunctions/
+type Sdf func(p Tuple) float64
+
+// SdfSphere is a sphere centered in the origin
+func SdfSphere(radius float64) Sdf {
+	return func(p Tuple) float64 {
+		return p.Length() - radius
+	}
+}
+
+// SdfBox is a box centered in the origin, with the specified half sizes and the edges rounded by radius
+func SdfBox(size Tuple, radius float64) Sdf {
+	return func(p Tuple) float64 {
+		qx := math.Abs(p.X) - size.X + radius
+		qy := math.Abs(p.Y) - size.Y + radius
+		qz := math.Abs(p.Z) - size.Z + radius
+
+		outside := Vector(math.Max(qx, 0), math.Max(qy, 0), math.Max(qz, 0)).Length()
+		inside := math.Min(Max3(qx, qy, qz), 0)
+
+		return outside + inside - radius
+	}
+}
+
+// SdfTorus is a torus around the y axis, like Torus
+func SdfTorus(major, minor float64) Sdf {
+	return func(p Tuple) float64 {
+		q := math.Hypot(p.X, p.Z) - major
+
+		return math.Hypot(q, p.Y) - minor
+	}
+}
+
+// SdfCylinder is a capped cylinder around the y axis, from -height to +height
+func SdfCylinder(radius, height float64) Sdf {
+	return func(p Tuple) float64 {
+		dx := math.Hypot(p.X, p.Z) - radius
+		dy := math.Abs(p.Y) - height
+
+		return math.Min(math.Max(dx, dy), 0) + math.Hypot(math.Max(dx, 0), math.Max(dy, 0))
+	}
+}
+
+// SdfPlane is the plane y=0, with the inside below
+func SdfPlane() Sdf {
+	return func(p Tuple) float64 {
+		return p.Y
+	}
+}
+
+// SdfMandelbulb is the distance estimator of the Mandelbulb fractal, which fits in a sphere of radius about 1.2:
+// it's not signed, so it must be used with SdfShape.FirstHit
+func SdfMandelbulb(power float64, iterations int) Sdf {
+	return func(p Tuple) float64 {
+		z := p
+		dr := 1.0
+		r := z.Length()
+
+		for i := 0; i < iterations && r <= 2; i++ {
+			if r == 0 {
+				break
+			}
+
+			// Raise to the power in spherical coordinates
+			theta := math.Acos(z.Y/r) * power
+			phi := math.Atan2(z.Z, z.X) * power
+			dr = math.Pow(r, power-1)*power*dr + 1
+			zr := math.Pow(r, power)
+
+			z = Point(zr*math.Sin(theta)*math.Cos(phi)+p.X, zr*math.Cos(theta)+p.Y, zr*math.Sin(theta)*math.Sin(phi)+p.Z)
+			r = z.Length()
+		}
+
+		if r == 0 {
+			return 0
+		}
+
+		return 0.5 * math.Log(r) * r / dr
+	}
+}
+
+// SdfUnion joins some shapes
+func SdfUnion(sdfs ...Sdf) Sdf {
+	return func(p Tuple) float64 {
+		d := math.Inf(+1)
+
+		for _, f := range sdfs {
+			d = math.Min(d, f(p))
+		}
+
+		return d
+	}
+}
+
+// SdfIntersection keeps what is inside all shapes
+func SdfIntersection(sdfs ...Sdf) Sdf {
+	return func(p Tuple) float64 {
+		d := math.Inf(-1)
+
+		for _, f := range sdfs {
+			d = math.Max(d, f(p))
+		}
+
+		return d
+	}
+}
+
+// SdfSubtraction carves b out of a
+func SdfSubtraction(a, b Sdf) Sdf {
+	return func(p Tuple) float64 {
+		return math.Max(a(p), -b(p))
+	}
+}
+
+// smoothMix returns the blending factor of the smooth operators, for a blending radius k
+func smoothMix(a, b, k float64) float64 {
+	return Clamp(0.5 + 0.5*(b-a)/k)
+}
+
+// SdfSmoothUnion joins two shapes with a smooth blend of radius k
+func SdfSmoothUnion(a, b Sdf, k float64) Sdf {
+	return func(p Tuple) float64 {
+		da, db := a(p), b(p)
+		h := smoothMix(da, db, k)
+
+		return db + (da-db)*h - k*h*(1-h)
+	}
+}
+
+// SdfSmoothIntersection keeps what is inside both shapes, with a smooth blend of radius k
+func SdfSmoothIntersection(a, b Sdf, k float64) Sdf {
+	return func(p Tuple) float64 {
+		da, db := a(p), b(p)
+		h := smoothMix(-da, -db, k)
+
+		return db + (da-db)*h + k*h*(1-h)
+	}
+}
+
+// SdfSmoothSubtraction carves b out of a, with a smooth blend of radius k
+func SdfSmoothSubtraction(a, b Sdf, k float64) Sdf {
+	return func(p Tuple) float64 {
+		da, db := a(p), -b(p)
+		h := smoothMix(-da, -db, k)
+
+		return db + (da-db)*h + k*h*(1-h)
+	}
+}
+
+// SdfTransform moves a shape: transforms must be rigid (translations and rotations) or the distance is wrong,
+// use SdfScale for scaling
+func SdfTransform(f Sdf, transforms ...Matrix) Sdf {
+	inverse := Identity()
+
+	for _, m := range transforms {
+		inverse = inverse.Mul(m)
+	}
+
+	inverse = inverse.Inverse()
+
+	return func(p Tuple) float64 {
+		return f(inverse.MulT(p))
+	}
+}
+
+// SdfScale scales a shape uniformly
+func SdfScale(f Sdf, s float64) Sdf {
+	return func(p Tuple) float64 {
+		return f(Point(p.X/s, p.Y/s, p.Z/s)) * s
+	}
+}
+
+// SdfRound inflates a shape by radius, rounding its edges
+func SdfRound(f Sdf, radius float64) Sdf {
+	return func(p Tuple) float64 {
+		return f(p) - radius
+	}
+}
+
+// SdfRepeat repeats a shape infinitely in space with the specified period along each axis,
+// a zero period means the shape is not repeated along that axis. The shape must fit in its cell
+func SdfRepeat(f Sdf, period Tuple) Sdf {
+	repeat := func(x, period float64) float64 {
+		if period == 0 {
+			return x
+		}
+
+		return x - period*math.Round(x/period)
+	}
+
+	return func(p Tuple) float64 {
+		return f(Point(repeat(p.X, period.X), repeat(p.Y, period.Y), repeat(p.Z, period.Z)))
+	}
+}
+
+// SdfTwist twists a shape around the y axis by k radians per unit of height:
+// the result is not a true distance, see SdfShape.Lipschitz
+func SdfTwist(f Sdf, k float64) Sdf {
+	return func(p Tuple) float64 {
+		s, c := math.Sincos(k * p.Y)
+
+		return f(Point(c*p.X-s*p.Z, p.Y, s*p.X+c*p.Z))
+	}
+}
+
+// SdfBend bends a shape around the z axis by k radians per unit along x:
+// the result is not a true distance, see SdfShape.Lipschitz
+func SdfBend(f Sdf, k float64) Sdf {
+	return func(p Tuple) float64 {
+		s, c := math.Sincos(k * p.X)
+
+		return f(Point(c*p.X-s*p.Y, s*p.X+c*p.Y, p.Z))
+	}
+}
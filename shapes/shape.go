@@ -25,7 +25,6 @@ type Shape struct {
 	Grouper
 	material *Material
 	shapable Shapable
-	shadow   bool
 	Locked   bool
 }
 
@@ -34,7 +33,6 @@ func NewShape(kind string, shapable Shapable) *Shape {
 
 	s.material = NewMaterial()
 	s.shapable = shapable
-	s.shadow = true
 	s.SetNameForKind(kind)
 	s.SetTransform()
 
@@ -45,7 +43,7 @@ func (s *Shape) Clone() Groupable {
 	o := NewShape("", s.shapable)
 
 	o.material = s.material
-	o.shadow = s.shadow
+	o.SetVisibility(s.Visibility())
 
 	o.SetName("shape_from_" + s.Name())
 	o.SetTransform(s.Transform())
@@ -68,7 +66,11 @@ func (s *Shape) SetLocked(f bool) {
 }
 
 func (s *Shape) SetShadow(f bool) {
-	s.shadow = f
+	if f {
+		s.SetVisibility(s.Visibility() | CastsShadows)
+	} else {
+		s.SetVisibility(s.Visibility() &^ CastsShadows)
+	}
 }
 
 func (s *Shape) Parent() Container {
@@ -88,8 +90,8 @@ func (s *Shape) Intersect(ray Ray) *Intersections { // Self-contained but slow:
 }
 
 func (s *Shape) AddIntersections(ray Ray, xs *Intersections) {
-	// If looking for shadows and this shape does not cast one, exit now
-	if xs.Shadows && !s.shadow {
+	// If this shape is not visible to the kind of ray being traced (e.g. it does not cast shadows), exit now
+	if s.HiddenFrom(xs) {
 		return
 	}
 
@@ -100,6 +102,20 @@ func (s *Shape) AddIntersections(ray Ray, xs *Intersections) {
 	xs.Add(s, localxs...)
 }
 
+func (s *Shape) Occludes(ray Ray, xs *Intersections) bool {
+	if s.HiddenFrom(xs) {
+		return false
+	}
+
+	for _, t := range s.shapable.LocalIntersect(ray.Transform(s.Tinverse)) {
+		if ray.InExtent(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // NormalAt returns the normal at the specified point on this shape,
 // it has been replaced by NormalAtHit() and now used only for tests.
 func (s *Shape) NormalAt(point Tuple) Tuple {
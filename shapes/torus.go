@@ -0,0 +1,88 @@
+// Copyright (c) 2019 Alessandro Scotti
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package shapes
+
+import (
+	"math"
+
+	. "ascottix/funtracer/maths"
+	. "ascottix/funtracer/textures"
+)
+
+// Torus is a ring around the y axis, centered in the origin: the center of the tube is
+// at distance MajorRadius from the axis and the tube has radius MinorRadius
+type Torus struct {
+	MajorRadius float64
+	MinorRadius float64
+}
+
+func NewTorus(major, minor float64) *Shape {
+	return NewShape("torus", &Torus{major, minor})
+}
+
+func (p *Torus) Bounds() Box {
+	r := p.MajorRadius + p.MinorRadius
+
+	return Box{Point(-r, -p.MinorRadius, -r), Point(+r, +p.MinorRadius, +r)}
+}
+
+// LocalIntersect solves the quartic equation of the torus (x²+y²+z² + R² - r²)² = 4R²(x²+z²),
+// see Kevin Suffern "Ray Tracing from the Ground Up" (2007)
+func (p *Torus) LocalIntersect(ray Ray) []float64 {
+	// Quartic roots are very sensitive to the magnitude of the coefficients, so the ray is normalized
+	// and starts from where it enters the bounds, then distances are converted back
+	length := ray.Direction.Length()
+	invdir := Vector(length/ray.Direction.X, length/ray.Direction.Y, length/ray.Direction.Z)
+
+	t0, t1 := p.Bounds().rangeInvDir(Ray{Origin: ray.Origin, Direction: invdir})
+
+	if t0 > t1 {
+		return nil
+	}
+
+	dir := ray.Direction.Mul(1 / length)
+	o := ray.Origin.Add(dir.Mul(t0))
+
+	R2 := 4 * Square(p.MajorRadius)
+	f := o.DotProduct(dir)
+	e := o.DotProduct(o) - Square(p.MajorRadius) - Square(p.MinorRadius)
+
+	roots := SolveQuartic(
+		1,
+		4*f,
+		2*e+4*f*f+R2*dir.Y*dir.Y,
+		4*f*e+2*R2*o.Y*dir.Y,
+		e*e-R2*(Square(p.MinorRadius)-o.Y*o.Y),
+	)
+
+	for i, t := range roots {
+		roots[i] = (t + t0) / length
+	}
+
+	return roots
+}
+
+func (p *Torus) LocalNormalAt(point Tuple) Tuple {
+	// The normal points away from the closest point on the circle at the center of the tube
+	d := math.Sqrt(point.X*point.X + point.Z*point.Z)
+
+	if d == 0 {
+		return Vector(0, point.Y, 0)
+	}
+
+	k := 1 - p.MajorRadius/d
+
+	return Vector(point.X*k, point.Y, point.Z*k)
+}
+
+func (p *Torus) NormalAtHit(point Tuple, ii *IntersectionInfo) Tuple {
+	// u goes around the y axis, v around the tube starting from the outer equator
+	d := math.Sqrt(point.X*point.X + point.Z*point.Z)
+
+	ii.U = (math.Atan2(point.Z, point.X) + Pi) / (2 * Pi)
+	ii.V = (math.Atan2(point.Y, d-p.MajorRadius) + Pi) / (2 * Pi)
+
+	return p.LocalNormalAt(point)
+}
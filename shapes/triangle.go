@@ -5,6 +5,8 @@
 package shapes
 
 import (
+	"math"
+
 	. "ascottix/funtracer/maths"
 	. "ascottix/funtracer/textures"
 )
@@ -36,37 +38,76 @@ func (t *Triangle) Bounds() Box {
 	}
 }
 
-// LocalIntersect uses the Möller–Trumbore algorithm to find the intersection with a ray
+// LocalIntersect uses a watertight algorithm to find the intersection with a ray
 func (t *Triangle) LocalIntersect(ray Ray) []float64 {
-	dirCrossE2 := ray.Direction.CrossProduct(t.E2)
-	det := t.E1.DotProduct(dirCrossE2)
+	if h, _, _, ok := IntersectTriangle(ray, t.P1, t.P2, t.P3); ok {
+		return []float64{h}
+	}
+
+	return nil
+}
 
-	// Check if ray is parallel to triangle plane
-	if det > -Epsilon && det < +Epsilon {
-		return nil
+// IntersectTriangle finds the intersection between a ray and a triangle, returning the distance
+// and the barycentric coordinates u, v of the hit (the weights of p2 and p3).
+// It uses the watertight algorithm by Sven Woop, Carsten Benthin, Ingo Wald:
+// "Watertight Ray/Triangle Intersection", Journal of Computer Graphics Techniques, 2013.
+// Rays can't slip between triangles that share an edge or a vertex, because the edge functions of the shared
+// edges are computed in the same way for both triangles, so that they have exactly opposite values
+func IntersectTriangle(ray Ray, p1, p2, p3 Tuple) (h, u, v float64, ok bool) {
+	d := [3]float64{ray.Direction.X, ray.Direction.Y, ray.Direction.Z}
+
+	// Use the dimension where the ray direction is maximal as z, keeping the winding of the triangle
+	kz := 0
+	if math.Abs(d[1]) > math.Abs(d[kz]) {
+		kz = 1
 	}
+	if math.Abs(d[2]) > math.Abs(d[kz]) {
+		kz = 2
+	}
+
+	kx := (kz + 1) % 3
+	ky := (kx + 1) % 3
+
+	if d[kz] < 0 {
+		kx, ky = ky, kx
+	}
+
+	// Shear and scale so that the ray goes along z from the origin
+	sx := d[kx] / d[kz]
+	sy := d[ky] / d[kz]
+	sz := 1 / d[kz]
+
+	vertex := func(p Tuple) (x, y, z float64) {
+		a := [3]float64{p.X - ray.Origin.X, p.Y - ray.Origin.Y, p.Z - ray.Origin.Z}
+
+		return a[kx] - sx*a[kz], a[ky] - sy*a[kz], sz * a[kz]
+	}
+
+	ax, ay, az := vertex(p1)
+	bx, by, bz := vertex(p2)
+	cx, cy, cz := vertex(p3)
 
-	f := 1.0 / det
-	p1ToOrigin := ray.Origin.Sub(t.P1)
-	u := f * p1ToOrigin.DotProduct(dirCrossE2)
+	// Edge functions, the ray misses if they don't all have the same sign (zero means the ray is on the edge)
+	e1 := cx*by - cy*bx
+	e2 := ax*cy - ay*cx
+	e3 := bx*ay - by*ax
 
-	// Ray misses by the p1-p3 edge
-	if u < 0 || u > 1 {
-		return nil
+	if (e1 < 0 || e2 < 0 || e3 < 0) && (e1 > 0 || e2 > 0 || e3 > 0) {
+		return
 	}
 
-	originCrossE1 := p1ToOrigin.CrossProduct(t.E1)
-	v := f * ray.Direction.DotProduct(originCrossE1)
+	det := e1 + e2 + e3
 
-	// Ray misses by the p1-p2 or p2-p3 edge
-	if v < 0 || (u+v) > 1 {
-		return nil
+	// Ray is parallel to the triangle plane
+	if det == 0 {
+		return
 	}
 
-	// Ray hits
-	h := f * t.E2.DotProduct(originCrossE1)
+	h = (e1*az + e2*bz + e3*cz) / det
+	u = e2 / det
+	v = e3 / det
 
-	return []float64{h}
+	return h, u, v, true
 }
 
 func (t *Triangle) LocalNormalAt(point Tuple) Tuple {
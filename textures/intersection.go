@@ -5,6 +5,7 @@
 package textures
 
 import (
+	"math"
 	"sort"
 
 	. "ascottix/funtracer/maths"
@@ -24,6 +25,17 @@ type Hittable interface {
 	Material() *Material
 }
 
+// Visibility is a set of flags that controls which kind of rays can hit an object
+type Visibility int
+
+const (
+	VisibleToCamera      Visibility = 1 << iota // Object is seen by primary (camera) rays
+	VisibleInReflections                        // Object is seen by reflected rays
+	VisibleInRefractions                        // Object is seen by refracted rays
+	CastsShadows                                // Object blocks shadow rays
+	VisibleToAll         = VisibleToCamera | VisibleInReflections | VisibleInRefractions | CastsShadows
+)
+
 type Intersection struct {
 	T float64
 	O Hittable
@@ -36,6 +48,12 @@ type IntersectionData struct {
 	// Used by Trimesh
 	TU float64
 	TV float64
+	// Used by CompactMesh
+	Index int // Triangle hit
+	// Used by Instance
+	Instance Intersectable // Instance that computes the normal, if the object was hit inside an instance
+	Object   Hittable      // Object hit inside the instance
+	Next     int           // 1-based index of data associated to the intersection inside the instance
 }
 
 type Intersections struct {
@@ -43,7 +61,8 @@ type Intersections struct {
 	hit  Intersection
 	data []IntersectionData
 	// The following attributes are used to pass information from the renderer to the objects
-	Shadows bool // If true, only shadowing objects should add to the intersections
+	Visibility Visibility // If not zero, only objects visible to this kind of ray should add to the intersections
+	Prune      bool       // If true, objects farther than the current hit may be skipped
 }
 
 func NewIntersection(t float64, o Hittable) Intersection {
@@ -83,6 +102,25 @@ func (x *Intersections) UpdateHit() {
 	}
 }
 
+// PruneDistance returns the distance beyond which objects may be skipped while looking for intersections
+func (x *Intersections) PruneDistance() float64 {
+	if !x.Prune {
+		return math.Inf(+1)
+	}
+
+	if x.hit.O != nil {
+		return x.hit.T
+	}
+
+	return math.Inf(+1)
+}
+
+// Truncate removes all intersections starting from the specified index
+func (x *Intersections) Truncate(n int) {
+	x.L = x.L[:n]
+	x.UpdateHit()
+}
+
 // Remove removes an intersection from the list, note this may invalidate the hit
 // so it's often a good idea to call UpdateHit() when done with the list manipulations
 func (x *Intersections) Remove(i int) {
@@ -155,6 +193,32 @@ func (x *Intersections) DataAt(i int) *IntersectionData {
 	return &x.data[x.L[i].D-1]
 }
 
+// Wrap marks an intersection as found inside an instance: the intersection will report object o,
+// while the instance becomes responsible for computing the normal from the original intersection
+func (x *Intersections) Wrap(i int, o Hittable, instance Intersectable) {
+	in := x.L[i]
+
+	x.data = append(x.data, IntersectionData{Instance: instance, Object: in.O, Next: in.D})
+	out := Intersection{T: in.T, O: o, D: len(x.data)}
+	x.L[i] = out
+
+	if x.hit == in {
+		x.hit = out
+	}
+}
+
+// Intersectable returns the object that computes the normal at an intersection,
+// that is the object itself unless it was hit inside an instance
+func (x *Intersections) Intersectable(i *Intersection) Intersectable {
+	if x != nil {
+		if d := x.Data(i); d != nil && d.Instance != nil {
+			return d.Instance
+		}
+	}
+
+	return i.O
+}
+
 func (x *Intersections) At(i int) Intersection {
 	return x.L[i]
 }
@@ -8,14 +8,13 @@ import (
 	. "ascottix/funtracer/maths"
 )
 
-const OverpointEpsilon = 1e-5
-
 type IntersectionInfo struct {
 	Intersection
 	U, V           float64        // Surface coordinates of intersection point
 	Point          Tuple          // Intersection point
-	OverPoint      Tuple          // Intersection point adjusted a bit in the normal direction (over the surface), used for shadows
-	UnderPoint     Tuple          // Intersection point adjusted a bit in the opposide normal direction (under the surface), used for refractions
+	PointError     Tuple          // Bound of the floating point error of the intersection point, for each coordinate
+	OverPoint      Tuple          // Intersection point moved just beyond its error in the normal direction (over the surface), used for shadows and reflections
+	UnderPoint     Tuple          // Intersection point moved just beyond its error in the opposite normal direction (under the surface), used for refractions
 	Eyev           Tuple          // Eye vector
 	Normalv        Tuple          // Normal vector at intersection point
 	SurfNormalv    Tuple          // Surface normal used by light (it's the normal vector possibly perturbed e.g. by a normal map)
@@ -44,7 +43,7 @@ func (ii *IntersectionInfo) Update(i Intersection, r Ray, xs *Intersections) {
 	ii.Eyev = r.Direction.Neg()
 	ii.HasSurfNormalv = false
 
-	n := i.O.NormalAtHit(ii, xs) // Get the normal at the intersection, necessary for all code that follows
+	n := xs.Intersectable(&i).NormalAtHit(ii, xs) // Get the normal at the intersection, necessary for all code that follows
 
 	ii.Inside = n.DotProduct(ii.Eyev) < 0 // If the normal points away from the eye direction, it means the eye is inside the object
 
@@ -54,8 +53,9 @@ func (ii *IntersectionInfo) Update(i Intersection, r Ray, xs *Intersections) {
 	}
 
 	ii.Normalv = n
-	ii.OverPoint = ii.Point.Add(n.Mul(OverpointEpsilon)) // Used to avoid objects casting shadows on themselves
-	ii.UnderPoint = ii.Point.Sub(n.Mul(OverpointEpsilon))
+	ii.PointError = HitPointError(r, i.T)
+	ii.OverPoint = OffsetRayOrigin(ii.Point, ii.PointError, n) // Used to avoid objects casting shadows on themselves
+	ii.UnderPoint = OffsetRayOrigin(ii.Point, ii.PointError, n.Neg())
 	ii.Reflectv = r.Direction.Reflect(n)
 	ii.N1 = 1
 	ii.N2 = 1
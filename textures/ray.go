@@ -5,20 +5,78 @@
 package textures
 
 import (
+	"math"
+
 	. "ascottix/funtracer/maths"
 )
 
+// Ray has an extent, occlusion queries look only for objects in the range [TMin,TMax)
 type Ray struct {
 	Origin    Tuple
 	Direction Tuple
+	TMin      float64
+	TMax      float64
 }
 
 func NewRay(p, v Tuple) Ray {
-	r := Ray{p, v}
+	r := Ray{p, v, 0, math.Inf(+1)}
 
 	return r
 }
 
+// InExtent returns true if the distance t is within the extent of the ray
+func (r Ray) InExtent(t float64) bool {
+	return t >= r.TMin && t < r.TMax
+}
+
+// Rays that leave a surface must start a bit away from it, or floating point errors in the computation of the hit
+// could make them hit the same surface again (shadow acne). The offset follows the error bound of the hit point,
+// so that it works at any scale, see:
+// Matt Pharr, Wenzel Jakob, Greg Humphreys, "Physically Based Rendering", 3.9 Managing Rounding Error
+// Carsten Wächter, Nikolaus Binder, "A Fast and Robust Method for Avoiding Self-Intersection", Ray Tracing Gems
+// Shapes do not track the error of their own computations, so the bound is proportional to the magnitude
+// of the values involved with a rather conservative factor
+const (
+	PointRelativeError = 1e-7
+	PointAbsoluteError = 1e-12 // Keeps a minimum offset near the origin
+)
+
+// PointError returns a bound of the floating point error of a point, computed from values up to the specified magnitude
+func PointError(magnitude Tuple) Tuple {
+	return Vector(
+		math.Abs(magnitude.X)*PointRelativeError+PointAbsoluteError,
+		math.Abs(magnitude.Y)*PointRelativeError+PointAbsoluteError,
+		math.Abs(magnitude.Z)*PointRelativeError+PointAbsoluteError,
+	)
+}
+
+// HitPointError returns a bound of the floating point error of the point at distance t along the ray
+func HitPointError(r Ray, t float64) Tuple {
+	return PointError(Vector(
+		math.Abs(r.Origin.X)+math.Abs(r.Direction.X*t),
+		math.Abs(r.Origin.Y)+math.Abs(r.Direction.Y*t),
+		math.Abs(r.Origin.Z)+math.Abs(r.Direction.Z*t),
+	))
+}
+
+// OffsetRayOrigin moves a point along the normal n just beyond its error bound, then rounds it
+// away from the surface so that the result is never on the wrong side because of rounding
+func OffsetRayOrigin(p, pError, n Tuple) Tuple {
+	d := math.Abs(n.X)*pError.X + math.Abs(n.Y)*pError.Y + math.Abs(n.Z)*pError.Z
+	o := p.Add(n.Mul(d))
+
+	away := func(v, n float64) float64 {
+		if n > 0 {
+			return math.Nextafter(v, math.Inf(+1))
+		} else if n < 0 {
+			return math.Nextafter(v, math.Inf(-1))
+		}
+		return v
+	}
+
+	return Point(away(o.X, n.X), away(o.Y, n.Y), away(o.Z, n.Z))
+}
+
 func (r Ray) Position(t float64) Tuple {
 	return r.Origin.Add(r.Direction.Mul(t))
 }
@@ -27,6 +85,8 @@ func (r Ray) Transform(m Matrix) Ray {
 	return Ray{
 		m.MulT(r.Origin),
 		m.MulT(r.Direction),
+		r.TMin,
+		r.TMax,
 	}
 
 	// A bit faster but probably not really worth it